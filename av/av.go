@@ -26,6 +26,7 @@ const (
 	SOUND_MULAW                 = 8
 	SOUND_AAC                   = 10
 	SOUND_SPEEX                 = 11
+	SOUND_MP3_8KHZ              = 14
 
 	SOUND_5_5Khz = 0
 	SOUND_11Khz  = 1
@@ -51,6 +52,25 @@ const (
 	FRAME_INTER = 2
 
 	VIDEO_H264 = 7
+	VIDEO_HEVC = 12
+	VIDEO_AV1  = 13
+	VIDEO_VP9  = 14
+)
+
+// Enhanced RTMP ExVideoTagHeader packet types and FourCCs, legacy AVC packet
+// types share the values of the first three
+const (
+	PKT_SEQUENCE_START        = 0
+	PKT_CODED_FRAMES          = 1
+	PKT_SEQUENCE_END          = 2
+	PKT_CODED_FRAMESX         = 3
+	PKT_METADATA              = 4
+	PKT_MPEG2TS_SEQUENCESTART = 5
+
+	FOURCC_AVC  = "avc1"
+	FOURCC_HEVC = "hvc1"
+	FOURCC_AV1  = "av01"
+	FOURCC_VP9  = "vp09"
 )
 
 var (
@@ -82,6 +102,8 @@ type VideoPacketHeader interface {
 	PacketHeader
 	IsKeyFrame() bool
 	IsSeq() bool
+	IsExHeader() bool
+	PacketType() uint8
 	CodecID() uint8
 	CompositionTime() int32
 }
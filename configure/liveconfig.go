@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"strings"
+	"sync"
 
 	"github.com/kr/pretty"
 	log "github.com/sirupsen/logrus"
@@ -25,12 +26,46 @@ import (
 */
 
 type Application struct {
-	Appname    string   `mapstructure:"appname"`
-	Live       bool     `mapstructure:"live"`
-	Hls        bool     `mapstructure:"hls"`
-	Flv        bool     `mapstructure:"flv"`
-	Api        bool     `mapstructure:"api"`
-	StaticPush []string `mapstructure:"static_push"`
+	Appname    string         `mapstructure:"appname"`
+	Live       bool           `mapstructure:"live"`
+	Hls        bool           `mapstructure:"hls"`
+	Dash       bool           `mapstructure:"dash"`
+	Flv        bool           `mapstructure:"flv"`
+	Api        bool           `mapstructure:"api"`
+	FLVArchive bool           `mapstructure:"flv_archive"`
+	MP4Archive bool           `mapstructure:"mp4_archive"`
+	StaticPush []string       `mapstructure:"static_push"`
+	OnPublish  string         `mapstructure:"on_publish"`
+	OnPlay     string         `mapstructure:"on_play"`
+	OnPlayDone string         `mapstructure:"on_play_done"`
+	Variants   []VariantGroup `mapstructure:"hls_variants"`
+	HLSOptions `mapstructure:",squash"`
+}
+
+// HLSOptions can be set globally and overridden per application, zero values
+// inherit the global setting
+type HLSOptions struct {
+	SegmentDuration int    `mapstructure:"hls_segment_duration"`
+	PlaylistSize    int    `mapstructure:"hls_playlist_size"`
+	ExtraSegments   int    `mapstructure:"hls_extra_segments"`
+	LowLatency      bool   `mapstructure:"hls_low_latency"`
+	PartDuration    int    `mapstructure:"hls_part_duration"`
+	SegmentType     string `mapstructure:"hls_segment_type"`
+	DVR             bool   `mapstructure:"hls_dvr"`
+	DVRDir          string `mapstructure:"hls_dvr_dir"`
+	DVRWindow       int    `mapstructure:"hls_dvr_window"`
+	DVRMaxSize      int    `mapstructure:"hls_dvr_max_size"`
+	Record          bool   `mapstructure:"hls_record"`
+	RecordDir       string `mapstructure:"hls_record_dir"`
+	Encryption      string `mapstructure:"hls_encryption"`
+	KeyRotation     int    `mapstructure:"hls_key_rotation"`
+	KeyProvider     string `mapstructure:"hls_key_provider"`
+	KeyDir          string `mapstructure:"hls_key_dir"`
+	KeyURL          string `mapstructure:"hls_key_url"`
+	PublisherClock  bool   `mapstructure:"hls_publisher_clock"`
+	TimedMetadata   bool   `mapstructure:"hls_timed_metadata"`
+	Subtitles       bool   `mapstructure:"hls_subtitles"`
+	SubtitlesLang   string `mapstructure:"hls_subtitles_language"`
 }
 
 type Applications []Application
@@ -40,15 +75,24 @@ type JWT struct {
 	Algorithm string `mapstructure:"algorithm"`
 }
 type ServerCfg struct {
-	Level           string       `mapstructure:"level"`
-	ConfigFile      string       `mapstructure:"config_file"`
-	FLVArchive      bool         `mapstructure:"flv_archive"`
-	FLVDir          string       `mapstructure:"flv_dir"`
-	RTMPNoAuth      bool         `mapstructure:"rtmp_noauth"`
-	RTMPAddr        string       `mapstructure:"rtmp_addr"`
-	HTTPFLVAddr     string       `mapstructure:"httpflv_addr"`
-	HLSAddr         string       `mapstructure:"hls_addr"`
-	HLSKeepAfterEnd bool         `mapstructure:"hls_keep_after_end"`
+	Level           string `mapstructure:"level"`
+	ConfigFile      string `mapstructure:"config_file"`
+	FLVArchive      bool   `mapstructure:"flv_archive"`
+	FLVDir          string `mapstructure:"flv_dir"`
+	FLVRotateDur    int    `mapstructure:"flv_rotate_duration"`
+	FLVRotateSize   int    `mapstructure:"flv_rotate_size"`
+	FLVRotateHourly bool   `mapstructure:"flv_rotate_hourly"`
+	MP4Archive      bool   `mapstructure:"mp4_archive"`
+	MP4Faststart    bool   `mapstructure:"mp4_faststart"`
+	RTMPNoAuth      bool   `mapstructure:"rtmp_noauth"`
+	RTMPAddr        string `mapstructure:"rtmp_addr"`
+	HTTPFLVAddr     string `mapstructure:"httpflv_addr"`
+	HTTPFLVRealtime bool   `mapstructure:"httpflv_vod_realtime"`
+	HLSAddr         string `mapstructure:"hls_addr"`
+	HLSKeepAfterEnd bool   `mapstructure:"hls_keep_after_end"`
+	HLSSessionTTL   int    `mapstructure:"hls_session_timeout"`
+	HLSOptions      `mapstructure:",squash"`
+	DASHAddr        string       `mapstructure:"dash_addr"`
 	APIAddr         string       `mapstructure:"api_addr"`
 	RedisAddr       string       `mapstructure:"redis_addr"`
 	RedisPwd        string       `mapstructure:"redis_pwd"`
@@ -56,6 +100,7 @@ type ServerCfg struct {
 	WriteTimeout    int          `mapstructure:"write_timeout"`
 	EnableTLSVerify bool         `mapstructure:"enable_tls_verify"`
 	GopNum          int          `mapstructure:"gop_num"`
+	HookTimeout     int          `mapstructure:"hook_timeout"`
 	JWT             JWT          `mapstructure:"jwt"`
 	Server          Applications `mapstructure:"server"`
 }
@@ -64,16 +109,35 @@ type ServerCfg struct {
 var defaultConf = ServerCfg{
 	ConfigFile:      "livego.yaml",
 	FLVArchive:      false,
+	MP4Archive:      false,
+	MP4Faststart:    true,
 	RTMPNoAuth:      false,
 	RTMPAddr:        ":1935",
 	HTTPFLVAddr:     ":7001",
 	HLSAddr:         ":7002",
 	HLSKeepAfterEnd: false,
+	HLSSessionTTL:   30,
+	HLSOptions: HLSOptions{
+		SegmentDuration: 3000,
+		PlaylistSize:    3,
+		ExtraSegments:   0,
+		PartDuration:    1000,
+		SegmentType:     "ts",
+		DVRDir:          "dvr",
+		DVRWindow:       120,
+		RecordDir:       "record",
+		KeyRotation:     10,
+		KeyProvider:     "file",
+		KeyDir:          "keys",
+		SubtitlesLang:   "en",
+	},
+	DASHAddr:        ":7003",
 	APIAddr:         ":8090",
 	WriteTimeout:    10,
 	ReadTimeout:     10,
 	EnableTLSVerify: true,
 	GopNum:          1,
+	HookTimeout:     5,
 	Server: Applications{{
 		Appname:    "live",
 		Live:       true,
@@ -88,12 +152,36 @@ var (
 	Config = viper.New()
 
 	// BypassInit can be used to bypass the init() function by setting this
-	// value to True at compile time.
+	// value to True at compile time, LoadApplications must then be called
+	// once Config is set.
 	//
 	// go build -ldflags "-X 'github.com/gwuhaolin/livego/configure.BypassInit=true'" -o livego main.go
 	BypassInit string = ""
 )
 
+// applications is the "server" configuration by appname, decoded once as
+// it is looked up on every request
+var applications struct {
+	sync.RWMutex
+	m map[string]Application
+}
+
+// LoadApplications decode the applications of the "server" configuration,
+// it must be called again after changing it
+func LoadApplications() {
+	apps := Applications{}
+	Config.UnmarshalKey("server", &apps)
+	m := make(map[string]Application, len(apps))
+	for _, app := range apps {
+		if _, ok := m[app.Appname]; !ok {
+			m[app.Appname] = app
+		}
+	}
+	applications.Lock()
+	applications.m = m
+	applications.Unlock()
+}
+
 func initLog() {
 	if l, err := log.ParseLevel(Config.GetString("level")); err == nil {
 		log.SetLevel(l)
@@ -123,15 +211,44 @@ func initDefault() {
 	pflag.String("rtmps_cert", "server.crt", "cert file path required for RTMPS")
 	pflag.String("rtmps_key", "server.key", "key file path required for RTMPS")
 	pflag.String("httpflv_addr", ":7001", "HTTP-FLV server listen address")
+	pflag.Bool("httpflv_vod_realtime", false, "send the recorded files of /vod/ at their playback speed instead of as fast as possible")
 	pflag.String("hls_addr", ":7002", "HLS server listen address")
+	pflag.String("dash_addr", ":7003", "MPEG-DASH server listen address")
 	pflag.String("api_addr", ":8090", "HTTP manage interface server listen address")
 	pflag.String("config_file", "livego.yaml", "configure filename")
 	pflag.String("level", "info", "Log level")
-	pflag.Bool("hls_keep_after_end", false, "Maintains the HLS after the stream ends")
+	pflag.Bool("hls_keep_after_end", false, "Maintains the HLS and DASH outputs after the stream ends")
+	pflag.Int("hls_session_timeout", 30, "HLS and DASH viewer sessions expire after this many idle seconds")
+	pflag.Int("hls_segment_duration", 3000, "HLS target segment duration in milliseconds")
+	pflag.Int("hls_playlist_size", 3, "number of segments in the HLS playlist")
+	pflag.Int("hls_extra_segments", 0, "number of segments kept after leaving the HLS playlist")
+	pflag.Bool("hls_low_latency", false, "Serve Low-Latency HLS with partial segments")
+	pflag.Int("hls_part_duration", 1000, "LL-HLS partial segment duration in milliseconds")
+	pflag.String("hls_segment_type", "ts", "HLS segment container, ts or fmp4")
+	pflag.Bool("hls_dvr", false, "Keep the HLS segments on disk so viewers can rewind")
+	pflag.String("hls_dvr_dir", "dvr", "HLS DVR segments directory")
+	pflag.Int("hls_dvr_window", 120, "HLS DVR window in minutes")
+	pflag.Int("hls_dvr_max_size", 0, "HLS DVR disk quota of all the streams in MB, 0 is unlimited")
+	pflag.Bool("hls_record", false, "Record the HLS segments and playlists of every publication")
+	pflag.String("hls_record_dir", "record", "HLS recordings directory")
+	pflag.String("hls_encryption", "", "HLS encryption method, aes-128 or sample-aes")
+	pflag.Int("hls_key_rotation", 10, "number of HLS segments encrypted with the same key, 0 never rotate")
+	pflag.String("hls_key_provider", "file", "HLS key provider, file or http")
+	pflag.String("hls_key_dir", "keys", "HLS keys directory of the file key provider")
+	pflag.String("hls_key_url", "", "HLS key service url of the http key provider")
+	pflag.Bool("hls_publisher_clock", false, "Take the HLS program date time from the publisher onFI or onMetaData")
+	pflag.Bool("hls_timed_metadata", false, "Mux the publisher data messages as ID3 timed metadata in HLS ts segments")
+	pflag.Bool("hls_subtitles", false, "Serve a WebVTT subtitles rendition from onTextData and CEA-608 captions")
+	pflag.String("hls_subtitles_language", "en", "language of the HLS subtitles rendition")
 	pflag.String("flv_dir", "tmp", "output flv file at flvDir/APP/KEY_TIME.flv")
+	pflag.Int("flv_rotate_duration", 0, "start a new flv archive file after this many seconds, 0 never rotate")
+	pflag.Int("flv_rotate_size", 0, "start a new flv archive file once it reaches this size in MB, 0 never rotate")
+	pflag.Bool("flv_rotate_hourly", false, "start a new flv archive file at the start of every hour")
+	pflag.Bool("mp4_faststart", true, "remux the mp4 archive to a progressive mp4 with the moov box first once closed")
 	pflag.Int("read_timeout", 10, "read time out")
 	pflag.Int("write_timeout", 10, "write time out")
 	pflag.Int("gop_num", 1, "gop num")
+	pflag.Int("hook_timeout", 5, "HTTP callback timeout in seconds")
 	pflag.Bool("enable_tls_verify", true, "Use system root CA to verify RTMPS connection, set this flag to false on Windows")
 	pflag.Parse()
 	Config.BindPFlags(pflag.CommandLine)
@@ -156,6 +273,8 @@ func initDefault() {
 	// Log
 	initLog()
 
+	LoadApplications()
+
 	// Print final config
 	c := ServerCfg{}
 	Config.Unmarshal(&c)
@@ -163,27 +282,176 @@ func initDefault() {
 }
 
 func CheckAppName(appname string) bool {
-	apps := Applications{}
-	Config.UnmarshalKey("server", &apps)
-	for _, app := range apps {
-		if app.Appname == appname {
-			return app.Live
-		}
-	}
-	return false
+	app, ok := GetApplication(appname)
+	return ok && app.Live
 }
 
 func GetStaticPushUrlList(appname string) ([]string, bool) {
-	apps := Applications{}
-	Config.UnmarshalKey("server", &apps)
-	for _, app := range apps {
-		if (app.Appname == appname) && app.Live {
-			if len(app.StaticPush) > 0 {
-				return app.StaticPush, true
-			} else {
-				return nil, false
-			}
+	app, ok := GetApplication(appname)
+	if !ok || !app.Live || len(app.StaticPush) == 0 {
+		return nil, false
+	}
+	return app.StaticPush, true
+}
+
+func GetApplication(appname string) (Application, bool) {
+	applications.RLock()
+	defer applications.RUnlock()
+	app, ok := applications.m[appname]
+	return app, ok
+}
+
+func GetOnPublishURL(appname string) (string, bool) {
+	app, ok := GetApplication(appname)
+	if !ok || !app.Live || app.OnPublish == "" {
+		return "", false
+	}
+	return app.OnPublish, true
+}
+
+// IsFLVArchive tell whether the streams of appname are recorded to FLV,
+// flv_archive applies to every application
+func IsFLVArchive(appname string) bool {
+	app, _ := GetApplication(appname)
+	return Config.GetBool("flv_archive") || app.FLVArchive
+}
+
+// IsMP4Archive tell whether the streams of appname are recorded to MP4,
+// mp4_archive applies to every application
+func IsMP4Archive(appname string) bool {
+	app, _ := GetApplication(appname)
+	return Config.GetBool("mp4_archive") || app.MP4Archive
+}
+
+// GetHLSOptions return the HLS options of appname merged with the global ones
+func GetHLSOptions(appname string) HLSOptions {
+	opts := HLSOptions{
+		SegmentDuration: Config.GetInt("hls_segment_duration"),
+		PlaylistSize:    Config.GetInt("hls_playlist_size"),
+		ExtraSegments:   Config.GetInt("hls_extra_segments"),
+		LowLatency:      Config.GetBool("hls_low_latency"),
+		PartDuration:    Config.GetInt("hls_part_duration"),
+		SegmentType:     Config.GetString("hls_segment_type"),
+		DVR:             Config.GetBool("hls_dvr"),
+		DVRDir:          Config.GetString("hls_dvr_dir"),
+		DVRWindow:       Config.GetInt("hls_dvr_window"),
+		DVRMaxSize:      Config.GetInt("hls_dvr_max_size"),
+		Record:          Config.GetBool("hls_record"),
+		RecordDir:       Config.GetString("hls_record_dir"),
+		Encryption:      Config.GetString("hls_encryption"),
+		KeyRotation:     Config.GetInt("hls_key_rotation"),
+		KeyProvider:     Config.GetString("hls_key_provider"),
+		KeyDir:          Config.GetString("hls_key_dir"),
+		KeyURL:          Config.GetString("hls_key_url"),
+		PublisherClock:  Config.GetBool("hls_publisher_clock"),
+		TimedMetadata:   Config.GetBool("hls_timed_metadata"),
+		Subtitles:       Config.GetBool("hls_subtitles"),
+		SubtitlesLang:   Config.GetString("hls_subtitles_language"),
+	}
+	if app, ok := GetApplication(appname); ok {
+		if app.SegmentDuration > 0 {
+			opts.SegmentDuration = app.SegmentDuration
 		}
+		if app.PlaylistSize > 0 {
+			opts.PlaylistSize = app.PlaylistSize
+		}
+		if app.ExtraSegments > 0 {
+			opts.ExtraSegments = app.ExtraSegments
+		}
+		if app.LowLatency {
+			opts.LowLatency = true
+		}
+		if app.PartDuration > 0 {
+			opts.PartDuration = app.PartDuration
+		}
+		if app.SegmentType != "" {
+			opts.SegmentType = app.SegmentType
+		}
+		if app.DVR {
+			opts.DVR = true
+		}
+		if app.DVRDir != "" {
+			opts.DVRDir = app.DVRDir
+		}
+		if app.DVRWindow > 0 {
+			opts.DVRWindow = app.DVRWindow
+		}
+		if app.DVRMaxSize > 0 {
+			opts.DVRMaxSize = app.DVRMaxSize
+		}
+		if app.Record {
+			opts.Record = true
+		}
+		if app.RecordDir != "" {
+			opts.RecordDir = app.RecordDir
+		}
+		if app.Encryption != "" {
+			opts.Encryption = app.Encryption
+		}
+		if app.KeyRotation > 0 {
+			opts.KeyRotation = app.KeyRotation
+		}
+		if app.KeyProvider != "" {
+			opts.KeyProvider = app.KeyProvider
+		}
+		if app.KeyDir != "" {
+			opts.KeyDir = app.KeyDir
+		}
+		if app.KeyURL != "" {
+			opts.KeyURL = app.KeyURL
+		}
+		if app.PublisherClock {
+			opts.PublisherClock = true
+		}
+		if app.TimedMetadata {
+			opts.TimedMetadata = true
+		}
+		if app.Subtitles {
+			opts.Subtitles = true
+		}
+		if app.SubtitlesLang != "" {
+			opts.SubtitlesLang = app.SubtitlesLang
+		}
+	}
+	if opts.SegmentDuration <= 0 {
+		opts.SegmentDuration = 3000
+	}
+	if opts.PlaylistSize <= 0 {
+		opts.PlaylistSize = 3
+	}
+	if opts.ExtraSegments < 0 {
+		opts.ExtraSegments = 0
+	}
+	if opts.PartDuration <= 0 {
+		opts.PartDuration = 1000
+	}
+	if opts.PartDuration > opts.SegmentDuration {
+		opts.PartDuration = opts.SegmentDuration
+	}
+	if opts.SegmentType != "fmp4" {
+		opts.SegmentType = "ts"
+	}
+	if opts.DVRDir == "" {
+		opts.DVRDir = "dvr"
+	}
+	if opts.DVRWindow <= 0 {
+		opts.DVRWindow = 120
+	}
+	if opts.RecordDir == "" {
+		opts.RecordDir = "record"
+	}
+	opts.Encryption = strings.ToLower(opts.Encryption)
+	if opts.KeyRotation < 0 {
+		opts.KeyRotation = 0
+	}
+	if opts.KeyProvider != "http" {
+		opts.KeyProvider = "file"
+	}
+	if opts.KeyDir == "" {
+		opts.KeyDir = "keys"
+	}
+	if opts.SubtitlesLang == "" {
+		opts.SubtitlesLang = "en"
 	}
-	return nil, false
+	return opts
 }
@@ -0,0 +1,104 @@
+package configure
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrVariantName       = fmt.Errorf("variant group name invalid")
+	ErrVariantRenditions = fmt.Errorf("variant group has no rendition")
+	ErrRenditionInvalid  = fmt.Errorf("rendition invalid")
+)
+
+var (
+	streamNameRegexp = regexp.MustCompile(`^[^/?#\s]+$`)
+	resolutionRegexp = regexp.MustCompile(`^[0-9]+x[0-9]+$`)
+	// a comma separated list of RFC 6381 codec identifiers
+	codecsRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+-]*(,[A-Za-z0-9][A-Za-z0-9.+-]*)*$`)
+)
+
+// Rendition is a stream of a variant group with the attributes announced in
+// its EXT-X-STREAM-INF tag, Name is the stream name in the application
+type Rendition struct {
+	Name       string  `mapstructure:"name" json:"name"`
+	Bandwidth  int     `mapstructure:"bandwidth" json:"bandwidth"`
+	Resolution string  `mapstructure:"resolution" json:"resolution,omitempty"`
+	Codecs     string  `mapstructure:"codecs" json:"codecs,omitempty"`
+	FrameRate  float64 `mapstructure:"frame_rate" json:"frame_rate,omitempty"`
+}
+
+// VariantGroup map the master playlist Name to the renditions published as
+// separate streams, the first live rendition is the one players start with
+type VariantGroup struct {
+	Name       string      `mapstructure:"name" json:"name"`
+	Renditions []Rendition `mapstructure:"renditions" json:"renditions"`
+}
+
+func (group *VariantGroup) Validate() error {
+	if !streamNameRegexp.MatchString(group.Name) {
+		return ErrVariantName
+	}
+	if len(group.Renditions) == 0 {
+		return ErrVariantRenditions
+	}
+	for _, r := range group.Renditions {
+		if !streamNameRegexp.MatchString(r.Name) || r.Name == group.Name || r.Bandwidth <= 0 ||
+			(r.Resolution != "" && !resolutionRegexp.MatchString(r.Resolution)) ||
+			(r.Codecs != "" && !codecsRegexp.MatchString(r.Codecs)) || r.FrameRate < 0 {
+			return fmt.Errorf("%v: %q", ErrRenditionInvalid, r.Name)
+		}
+	}
+	return nil
+}
+
+type VariantsType struct {
+	localCache *cache.Cache
+}
+
+// Variants keep the variant groups defined through the API, they take
+// precedence over the hls_variants of the application
+var Variants = &VariantsType{
+	localCache: cache.New(cache.NoExpiration, 0),
+}
+
+func (v *VariantsType) Set(appname string, group VariantGroup) error {
+	if err := group.Validate(); err != nil {
+		return err
+	}
+	v.localCache.SetDefault(appname+"/"+group.Name, group)
+	return nil
+}
+
+func (v *VariantsType) Delete(appname, name string) bool {
+	if _, ok := v.localCache.Get(appname + "/" + name); !ok {
+		return false
+	}
+	v.localCache.Delete(appname + "/" + name)
+	return true
+}
+
+// Get return the variant group name of the application appname
+func (v *VariantsType) Get(appname, name string) (VariantGroup, bool) {
+	if group, ok := v.localCache.Get(appname + "/" + name); ok {
+		return group.(VariantGroup), true
+	}
+	app, ok := GetApplication(appname)
+	if !ok {
+		return VariantGroup{}, false
+	}
+	for _, group := range app.Variants {
+		if group.Name == name {
+			// the groups of the configuration file are not checked on load
+			if err := group.Validate(); err != nil {
+				log.Warningf("hls_variants %s/%s: %v", appname, name, err)
+				return VariantGroup{}, false
+			}
+			return group, true
+		}
+	}
+	return VariantGroup{}, false
+}
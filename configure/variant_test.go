@@ -0,0 +1,33 @@
+package configure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariantGroupValidate(t *testing.T) {
+	at := assert.New(t)
+	group := VariantGroup{
+		Name: "show",
+		Renditions: []Rendition{
+			{Name: "show_1080", Bandwidth: 6000000, Resolution: "1920x1080", Codecs: "avc1.640028,mp4a.40.2"},
+			{Name: "show_720", Bandwidth: 3000000, Codecs: "hvc1.1.6.L93.B0"},
+		},
+	}
+	at.Equal(nil, group.Validate())
+
+	for _, codecs := range []string{
+		`avc1.640028",URI="x`,
+		"avc1.640028, mp4a.40.2",
+		"avc1.640028,,mp4a.40.2",
+		",mp4a.40.2",
+		"mp4a.40.2,",
+		"avc1\n#EXT-X-ENDLIST",
+	} {
+		group.Renditions[1].Codecs = codecs
+		err := group.Validate()
+		at.NotEqual(nil, err, codecs)
+		at.Contains(err.Error(), ErrRenditionInvalid.Error())
+	}
+}
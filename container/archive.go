@@ -0,0 +1,25 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CreateArchive create the recording file base_TIME.ext, files created
+// within the same second get a counter after the time
+func CreateArchive(base, ext string, t time.Time) (*os.File, error) {
+	fileName := fmt.Sprintf("%s_%d.%s", base, t.Unix(), ext)
+	for i := 1; ; i++ {
+		w, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0755)
+		if !os.IsExist(err) {
+			if err == nil {
+				log.Debugf("%s dvr save stream to: %s", ext, fileName)
+			}
+			return w, err
+		}
+		fileName = fmt.Sprintf("%s_%d_%d.%s", base, t.Unix(), i, ext)
+	}
+}
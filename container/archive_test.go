@@ -0,0 +1,29 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateArchive(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, err := CreateArchive(filepath.Join(dir, "movie"), "mp4", time.Unix(1700000000, 0))
+	at.Equal(nil, err)
+	first.Close()
+	second, err := CreateArchive(filepath.Join(dir, "movie"), "mp4", time.Unix(1700000000, 0))
+	at.Equal(nil, err)
+	second.Close()
+	at.Equal(filepath.Join(dir, "movie_1700000000.mp4"), first.Name())
+	at.Equal(filepath.Join(dir, "movie_1700000000_1.mp4"), second.Name())
+}
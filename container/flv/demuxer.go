@@ -37,6 +37,9 @@ func (d *Demuxer) Demux(p *av.Packet) error {
 		p.Data[0] == 0x17 && p.Data[1] == 0x02 {
 		return ErrAvcEndSEQ
 	}
+	if tag.IsExHeader() && tag.PacketType() == av.PKT_SEQUENCE_END {
+		return ErrAvcEndSEQ
+	}
 	p.Header = &tag
 	p.Data = p.Data[n:]
 
@@ -1,7 +1,8 @@
 package flv
 
 import (
-	"fmt"
+	"bytes"
+	"io"
 	"os"
 	"path"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container"
 	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/gwuhaolin/livego/utils/pio"
 	"github.com/gwuhaolin/livego/utils/uid"
@@ -47,8 +49,34 @@ func NewFlv(handler av.Handler, info av.Info) {
 
 const (
 	headerLen = 11
+	// the onMetaData tag at the start of each file has reserved space, it is
+	// rewritten in place with the duration and the keyframe index on close.
+	// The space is the fields of the publisher's metadata and the expected
+	// keyframe index, two AMF0 numbers per keyframe.
+	metadataFields    = 4 << 10
+	keyframeEntrySize = 18
+	maxMetadataSize   = 256 << 10
+	// the expected length and keyframe interval of a file when neither the
+	// rotation nor a previous file tell them
+	expectedFileDuration = 10 * time.Minute
+	expectedGOP          = 2 * time.Second
+	metadataOffset       = 13
+	// interval of the index entries of a stream without video
+	audioIndexInterval = 1000 // ms
 )
 
+// Rotation start a new archive file after Duration, once the file reaches
+// Size bytes or at the start of every hour, zero values disable a rule
+type Rotation struct {
+	Duration time.Duration
+	Size     int64
+	Hourly   bool
+}
+
+func (r Rotation) enabled() bool {
+	return r.Duration > 0 || r.Size > 0 || r.Hourly
+}
+
 type FLVWriter struct {
 	Uid string
 	av.RWBaser
@@ -57,30 +85,112 @@ type FLVWriter struct {
 	closed          chan struct{}
 	ctx             *os.File
 	closedWriter    bool
+	rotation        Rotation
+	create          func() (*os.File, error)
+	fileStart       time.Time
+	fileSize        int64
+	fileTimestamp   uint32
+	fileFrames      bool
+	reserve         int
+	started         bool
+	hasVideo        bool
+	metadata        amf.Object
+	videoSeq        []byte
+	audioSeq        []byte
+	lastTimestamp   uint32
+	keyframes       []keyframe
+}
+
+// keyframe is an entry of the keyframe index of a file
+type keyframe struct {
+	timestamp uint32
+	position  int64
 }
 
 func NewFLVWriter(app, title, url string, ctx *os.File) *FLVWriter {
 	ret := &FLVWriter{
-		Uid:     uid.NewId(),
-		app:     app,
-		title:   title,
-		url:     url,
-		ctx:     ctx,
-		RWBaser: av.NewRWBaser(time.Second * 10),
-		closed:  make(chan struct{}),
-		buf:     make([]byte, headerLen),
+		Uid:       uid.NewId(),
+		app:       app,
+		title:     title,
+		url:       url,
+		ctx:       ctx,
+		RWBaser:   av.NewRWBaser(time.Second * 10),
+		closed:    make(chan struct{}),
+		buf:       make([]byte, headerLen),
+		fileStart: time.Now(),
 	}
 
-	ret.ctx.Write(flvHeader)
-	pio.PutI32BE(ret.buf[:4], 0)
-	ret.ctx.Write(ret.buf[:4])
+	ret.writeHeader()
 
 	return ret
 }
 
+// SetRotation make the writer continue in a new file created by create
+// when rotation is due. Files start on a key frame with the metadata and
+// the sequence headers of the stream, so that each file plays on its own.
+// It must be called before the first Write.
+func (writer *FLVWriter) SetRotation(rotation Rotation, create func() (*os.File, error)) {
+	writer.rotation = rotation
+	writer.create = create
+	// the reserved space depends on the rotation
+	if err := writer.ctx.Truncate(0); err != nil {
+		log.Warning("flv truncate error: ", err)
+		return
+	}
+	if _, err := writer.ctx.Seek(0, io.SeekStart); err != nil {
+		log.Warning("flv seek error: ", err)
+		return
+	}
+	writer.writeHeader()
+}
+
+// metadataReserve return the space of the onMetaData tag of the next file.
+// Its length comes from the rotation or the previous file and its keyframe
+// interval from the previous file.
+func (writer *FLVWriter) metadataReserve() int {
+	r := writer.rotation
+	duration := expectedFileDuration
+	previous := time.Duration(writer.lastTimestamp) * time.Millisecond
+	if r.Duration > 0 {
+		duration = r.Duration
+	} else if r.Size > 0 && previous > 0 {
+		// the previous file of the same size
+		duration = previous
+	}
+	if r.Hourly && (r.Duration == 0 || r.Duration > time.Hour) {
+		duration = time.Hour
+	}
+	gop := expectedGOP
+	if len(writer.keyframes) > 1 && previous > 0 {
+		gop = previous / time.Duration(len(writer.keyframes)-1)
+	}
+	if gop < audioIndexInterval*time.Millisecond {
+		gop = audioIndexInterval * time.Millisecond
+	}
+	reserve := metadataFields + int(duration/gop+1)*keyframeEntrySize
+	if reserve > maxMetadataSize {
+		reserve = maxMetadataSize
+	}
+	return reserve
+}
+
+func (writer *FLVWriter) writeHeader() error {
+	writer.reserve = writer.metadataReserve()
+	if _, err := writer.ctx.Write(flvHeader); err != nil {
+		return err
+	}
+	pio.PutI32BE(writer.buf[:4], 0)
+	if _, err := writer.ctx.Write(writer.buf[:4]); err != nil {
+		return err
+	}
+	writer.fileSize = int64(len(flvHeader) + 4)
+	writer.lastTimestamp = 0
+	writer.keyframes = nil
+	return writer.writeTag(av.TAG_SCRIPTDATAAMF0, 0, writer.metadataTag(false))
+}
+
 func (writer *FLVWriter) Write(p *av.Packet) error {
 	writer.RWBaser.SetPreTime()
-	h := writer.buf[:headerLen]
 	typeID := av.TAG_VIDEO
 	if !p.IsVideo {
 		if p.IsMetadata {
@@ -94,11 +204,278 @@ func (writer *FLVWriter) Write(p *av.Packet) error {
 			typeID = av.TAG_AUDIO
 		}
 	}
-	dataLen := len(p.Data)
 	timestamp := p.TimeStamp
 	timestamp += writer.BaseTimeStamp()
 	writer.RWBaser.RecTimeStamp(timestamp, uint32(typeID))
 
+	if p.IsMetadata {
+		if metadata, ok := onMetaData(p.Data); ok {
+			writer.metadata = metadata
+			return writer.rewriteMetadata(false)
+		}
+		return writer.writeTag(typeID, writer.relative(timestamp), p.Data)
+	}
+
+	if writer.keepHeader(p) {
+		return writer.writeTag(typeID, writer.relative(timestamp), p.Data)
+	}
+	if !writer.started {
+		// the first file starts at zero like the rotated ones, a writer
+		// may join a stream long after it started
+		writer.started = true
+		writer.fileTimestamp = timestamp
+	}
+	if writer.randomAccess(p) {
+		if writer.create != nil && writer.fileFrames && writer.rotationDue(time.Now()) {
+			if err := writer.rotate(timestamp); err != nil {
+				return err
+			}
+		}
+		writer.addKeyframe(writer.relative(timestamp))
+	}
+	writer.fileFrames = true
+	if t := writer.relative(timestamp); t > writer.lastTimestamp {
+		writer.lastTimestamp = t
+	}
+	return writer.writeTag(typeID, writer.relative(timestamp), p.Data)
+}
+
+// keepHeader save the sequence headers repeated at the start of each file,
+// it return true for them
+func (writer *FLVWriter) keepHeader(p *av.Packet) bool {
+	switch {
+	case p.IsVideo:
+		writer.hasVideo = true
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok || !vh.IsSeq() {
+			return false
+		}
+		writer.videoSeq = append([]byte(nil), p.Data...)
+	default:
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		if !ok || ah.SoundFormat() != av.SOUND_AAC || ah.AACPacketType() != av.AAC_SEQHDR {
+			return false
+		}
+		writer.audioSeq = append([]byte(nil), p.Data...)
+	}
+	return true
+}
+
+// randomAccess tell whether a file can start with p, a video key frame or
+// any audio frame of a stream without video
+func (writer *FLVWriter) randomAccess(p *av.Packet) bool {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsKeyFrame()
+	}
+	return !p.IsMetadata && !writer.hasVideo
+}
+
+// addKeyframe index the tag about to be written at timestamp, the audio of
+// a stream without video is indexed every second
+func (writer *FLVWriter) addKeyframe(timestamp uint32) {
+	if n := len(writer.keyframes); n > 0 && !writer.hasVideo &&
+		timestamp < writer.keyframes[n-1].timestamp+audioIndexInterval {
+		return
+	}
+	writer.keyframes = append(writer.keyframes, keyframe{timestamp: timestamp, position: writer.fileSize})
+}
+
+// onMetaData return the object of an onMetaData data message, what follows
+// it is ignored like the padding of the reserved tag
+func onMetaData(data []byte) (amf.Object, bool) {
+	r := bytes.NewReader(data)
+	decoder := &amf.Decoder{}
+	if name, err := decoder.Decode(r, amf.AMF0); err != nil || name != amf.OnMetaData {
+		return nil, false
+	}
+	v, err := decoder.Decode(r, amf.AMF0)
+	if err != nil {
+		return nil, false
+	}
+	metadata, ok := v.(amf.Object)
+	return metadata, ok
+}
+
+// encodeMetadata return the onMetaData tag data of metadata, with the
+// duration, the size and keyframes as index of the file when final. The
+// file positions are moved by shift bytes.
+func (writer *FLVWriter) encodeMetadata(metadata amf.Object, final bool, keyframes []keyframe, shift int64) ([]byte, error) {
+	obj := amf.Object{}
+	for k, v := range metadata {
+		obj[k] = v
+	}
+	for _, k := range []string{"duration", "filesize", "lasttimestamp", "keyframes"} {
+		delete(obj, k)
+	}
+	if final {
+		duration := float64(writer.lastTimestamp) / 1000
+		obj["duration"] = duration
+		obj["lasttimestamp"] = duration
+		obj["filesize"] = float64(writer.fileSize + shift)
+		times := make(amf.Array, len(keyframes))
+		positions := make(amf.Array, len(keyframes))
+		for i, k := range keyframes {
+			times[i] = float64(k.timestamp) / 1000
+			positions[i] = float64(k.position + shift)
+		}
+		obj["keyframes"] = amf.Object{"filepositions": positions, "times": times}
+	}
+	b := bytes.NewBuffer(nil)
+	encoder := &amf.Encoder{}
+	if _, err := encoder.EncodeAmf0String(b, amf.OnMetaData, true); err != nil {
+		return nil, err
+	}
+	if _, err := encoder.EncodeAmf0EcmaArray(b, obj, true); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// metadataTag return the data of the reserved onMetaData tag. The index is
+// thinned out when it does not fit in the reserved space.
+func (writer *FLVWriter) metadataTag(final bool) []byte {
+	metadata, keyframes := writer.metadata, writer.keyframes
+	for {
+		b, err := writer.encodeMetadata(metadata, final, keyframes, 0)
+		if err == nil && len(b) <= writer.reserve {
+			if len(keyframes) < len(writer.keyframes) {
+				log.Warningf("flv keyframe index of %s thinned out to %d entries", writer.ctx.Name(), len(keyframes))
+			}
+			data := make([]byte, writer.reserve)
+			copy(data, b)
+			return data
+		}
+		if final && len(keyframes) > 0 {
+			thinned := make([]keyframe, 0, len(keyframes)/2)
+			for i := 0; i+1 < len(keyframes); i += 2 {
+				thinned = append(thinned, keyframes[i])
+			}
+			keyframes = thinned
+			continue
+		}
+		log.Warning("flv metadata does not fit the reserved space: ", err)
+		metadata = nil
+		final = false
+	}
+}
+
+// rewriteMetadata replace the reserved onMetaData tag of the current file.
+// A final index larger than the reserved space is written by rewriting the
+// file, it is thinned out when that fails.
+func (writer *FLVWriter) rewriteMetadata(final bool) error {
+	if final {
+		b, err := writer.encodeMetadata(writer.metadata, true, writer.keyframes, 0)
+		if err == nil && len(b) > writer.reserve {
+			if err = writer.relocate(len(b)); err == nil {
+				return nil
+			}
+			log.Warningf("flv keyframe index of %s not rewritten: %v", writer.ctx.Name(), err)
+		}
+	}
+	_, err := writer.ctx.WriteAt(writer.metadataTag(final), metadataOffset+headerLen)
+	return err
+}
+
+// relocate write the file again with an onMetaData tag of size bytes
+// holding the whole index, the tags which follow it are moved. The new file
+// replaces the current one, which is still to be closed.
+func (writer *FLVWriter) relocate(size int) error {
+	shift := int64(size - writer.reserve)
+	data, err := writer.encodeMetadata(writer.metadata, true, writer.keyframes, shift)
+	if err != nil {
+		return err
+	}
+	name := writer.ctx.Name()
+	tmp, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	h := make([]byte, headerLen)
+	pio.PutU8(h[0:1], uint8(av.TAG_SCRIPTDATAAMF0))
+	pio.PutI24BE(h[1:4], int32(len(data)))
+	tail := make([]byte, 4)
+	pio.PutI32BE(tail, int32(len(data)+headerLen))
+	start := int64(metadataOffset + headerLen + writer.reserve + 4)
+	for _, b := range [][]byte{flvHeader, {0, 0, 0, 0}, h, data, tail} {
+		if _, err = tmp.Write(b); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = io.Copy(tmp, io.NewSectionReader(writer.ctx, start, writer.fileSize-start))
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+	}
+	return err
+}
+
+func (writer *FLVWriter) rotationDue(now time.Time) bool {
+	r := writer.rotation
+	return (r.Duration > 0 && now.Sub(writer.fileStart) >= r.Duration) ||
+		(r.Size > 0 && writer.fileSize >= r.Size) ||
+		(r.Hourly && !sameHour(writer.fileStart, now))
+}
+
+// sameHour tell whether a and b are in the same hour of the wall clock of b,
+// time.Truncate would use the absolute time and miss the zones which are
+// not a whole number of hours from UTC
+func sameHour(a, b time.Time) bool {
+	a = a.In(b.Location())
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay() && a.Hour() == b.Hour()
+}
+
+// rotate close the current file and start the next one at timestamp
+func (writer *FLVWriter) rotate(timestamp uint32) error {
+	ctx, err := writer.create()
+	if err != nil {
+		return err
+	}
+	if err := writer.rewriteMetadata(true); err != nil {
+		log.Warning("write flv metadata error: ", err)
+	}
+	if err := writer.ctx.Close(); err != nil {
+		log.Warning("close flv file error: ", err)
+	}
+	writer.ctx = ctx
+	writer.fileStart = time.Now()
+	writer.fileTimestamp = timestamp
+	writer.fileFrames = false
+	if err := writer.writeHeader(); err != nil {
+		return err
+	}
+	if writer.videoSeq != nil {
+		if err := writer.writeTag(av.TAG_VIDEO, 0, writer.videoSeq); err != nil {
+			return err
+		}
+	}
+	if writer.audioSeq != nil {
+		if err := writer.writeTag(av.TAG_AUDIO, 0, writer.audioSeq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relative return timestamp in the time line of the current file, which
+// starts at zero, the headers preceding the first frame are at zero
+func (writer *FLVWriter) relative(timestamp uint32) uint32 {
+	if !writer.started || timestamp < writer.fileTimestamp {
+		return 0
+	}
+	return timestamp - writer.fileTimestamp
+}
+
+func (writer *FLVWriter) writeTag(typeID int, timestamp uint32, data []byte) error {
+	h := writer.buf[:headerLen]
+	dataLen := len(data)
 	preDataLen := dataLen + headerLen
 	timestampbase := timestamp & 0xffffff
 	timestampExt := timestamp >> 24 & 0xff
@@ -112,7 +489,7 @@ func (writer *FLVWriter) Write(p *av.Packet) error {
 		return err
 	}
 
-	if _, err := writer.ctx.Write(p.Data); err != nil {
+	if _, err := writer.ctx.Write(data); err != nil {
 		return err
 	}
 
@@ -120,10 +497,16 @@ func (writer *FLVWriter) Write(p *av.Packet) error {
 	if _, err := writer.ctx.Write(h[:4]); err != nil {
 		return err
 	}
+	writer.fileSize += int64(preDataLen + 4)
 
 	return nil
 }
 
+// Name return the path of the file being written
+func (writer *FLVWriter) Name() string {
+	return writer.ctx.Name()
+}
+
 func (writer *FLVWriter) Wait() {
 	select {
 	case <-writer.closed:
@@ -136,6 +519,9 @@ func (writer *FLVWriter) Close(error) {
 		return
 	}
 	writer.closedWriter = true
+	if err := writer.rewriteMetadata(true); err != nil {
+		log.Warning("write flv metadata error: ", err)
+	}
 	writer.ctx.Close()
 	close(writer.closed)
 }
@@ -164,15 +550,24 @@ func (f *FlvDvr) GetWriter(info av.Info) av.WriteCloser {
 		return nil
 	}
 
-	fileName := fmt.Sprintf("%s_%d.%s", path.Join(flvDir, info.Key), time.Now().Unix(), "flv")
-	log.Debug("flv dvr save stream to: ", fileName)
-	w, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0755)
+	create := func() (*os.File, error) {
+		return container.CreateArchive(path.Join(flvDir, info.Key), "flv", time.Now())
+	}
+	w, err := create()
 	if err != nil {
 		log.Error("open file error: ", err)
 		return nil
 	}
 
 	writer := NewFLVWriter(paths[0], paths[1], info.URL, w)
+	rotation := Rotation{
+		Duration: time.Duration(configure.Config.GetInt("flv_rotate_duration")) * time.Second,
+		Size:     int64(configure.Config.GetInt("flv_rotate_size")) << 20,
+		Hourly:   configure.Config.GetBool("flv_rotate_hourly"),
+	}
+	if rotation.enabled() {
+		writer.SetRotation(rotation, create)
+	}
 	log.Debug("new flv dvr: ", writer.Info())
 	return writer
 }
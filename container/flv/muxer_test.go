@@ -0,0 +1,289 @@
+package flv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/utils/pio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTag struct {
+	typeID    uint8
+	timestamp uint32
+	data      []byte
+}
+
+func newTestPacket(video bool, timestamp uint32, data ...byte) *av.Packet {
+	p := &av.Packet{IsVideo: video, IsAudio: !video, TimeStamp: timestamp, Data: data}
+	NewDemuxer().DemuxH(p)
+	return p
+}
+
+func readTestTags(t *testing.T, name string) []testTag {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, flvHeader) {
+		t.Fatalf("%s has no flv header", name)
+	}
+	var tags []testTag
+	for i := len(flvHeader) + 4; i+headerLen <= len(b); {
+		size := int(pio.U24BE(b[i+1:]))
+		tags = append(tags, testTag{
+			typeID:    b[i],
+			timestamp: pio.U24BE(b[i+4:]) | uint32(b[i+7])<<24,
+			data:      b[i+headerLen : i+headerLen+size],
+		})
+		i += headerLen + size + 4
+	}
+	return tags
+}
+
+func readTestMetadata(t *testing.T, tag testTag) amf.Object {
+	if tag.typeID != av.TAG_SCRIPTDATAAMF0 {
+		t.Fatalf("tag %d is not a script tag", tag.typeID)
+	}
+	metadata, ok := onMetaData(tag.data)
+	if !ok {
+		t.Fatal("script tag is not onMetaData")
+	}
+	return metadata
+}
+
+func TestFLVWriterRotation(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	create := func() (*os.File, error) {
+		return container.CreateArchive(filepath.Join(dir, "movie"), "flv", now)
+	}
+	w, err := create()
+	at.Equal(nil, err)
+	writer := NewFLVWriter("live", "movie", "", w)
+	writer.SetRotation(Rotation{Size: 1}, create)
+
+	b := bytes.NewBuffer(nil)
+	encoder := &amf.Encoder{}
+	encoder.EncodeBatch(b, amf.AMF0, amf.SetDataFrame, amf.OnMetaData, amf.Object{"width": float64(1280)})
+	metadata := &av.Packet{IsMetadata: true, Data: b.Bytes()}
+	packets := []*av.Packet{
+		metadata,
+		newTestPacket(true, 0, 0x17, 0x00, 0x00, 0x00, 0x00, 0x01),
+		newTestPacket(false, 0, 0xaf, 0x00, 0x12, 0x10),
+		newTestPacket(true, 0, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(true, 40, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+		newTestPacket(false, 50, 0xaf, 0x01, 0x21),
+		newTestPacket(true, 1000, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(false, 990, 0xaf, 0x01, 0x21),
+		newTestPacket(true, 1040, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+	}
+	for _, p := range packets {
+		at.Equal(nil, writer.Write(p))
+	}
+	writer.Close(nil)
+
+	first := readTestTags(t, filepath.Join(dir, "movie_"+strconv.FormatInt(now.Unix(), 10)+".flv"))
+	at.Equal(6, len(first))
+	at.Equal(uint8(av.TAG_SCRIPTDATAAMF0), first[0].typeID)
+	at.Equal(uint32(50), first[5].timestamp)
+
+	// the next file repeats the headers and starts on the key frame
+	second := readTestTags(t, filepath.Join(dir, "movie_"+strconv.FormatInt(now.Unix(), 10)+"_1.flv"))
+	at.Equal(6, len(second))
+	at.Equal(float64(1280), readTestMetadata(t, second[0])["width"])
+	at.Equal(float64(0.04), readTestMetadata(t, second[0])["duration"])
+	at.Equal(first[1].data, second[1].data)
+	at.Equal(first[2].data, second[2].data)
+	at.Equal(uint32(0), second[3].timestamp)
+	at.Equal(byte(0x17), second[3].data[0])
+	at.Equal(uint32(0), second[4].timestamp)
+	at.Equal(uint32(40), second[5].timestamp)
+}
+
+func TestFLVWriterTimeline(t *testing.T) {
+	at := assert.New(t)
+	f, err := ioutil.TempFile("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// a writer joining a stream an hour after its start
+	writer := NewFLVWriter("live", "movie", "", f)
+	packets := []*av.Packet{
+		newTestPacket(true, 3600000, 0x17, 0x00, 0x00, 0x00, 0x00, 0x01),
+		newTestPacket(true, 3600000, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(true, 3600040, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+	}
+	for _, p := range packets {
+		at.Equal(nil, writer.Write(p))
+	}
+	writer.Close(nil)
+
+	tags := readTestTags(t, f.Name())
+	at.Equal(4, len(tags))
+	at.Equal(uint32(0), tags[1].timestamp)
+	at.Equal(uint32(0), tags[2].timestamp)
+	at.Equal(uint32(40), tags[3].timestamp)
+	at.Equal(float64(0.04), readTestMetadata(t, tags[0])["duration"])
+}
+
+func TestFLVWriterKeyframes(t *testing.T) {
+	at := assert.New(t)
+	f, err := ioutil.TempFile("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	writer := NewFLVWriter("live", "movie", "", f)
+	b := bytes.NewBuffer(nil)
+	encoder := &amf.Encoder{}
+	encoder.EncodeBatch(b, amf.AMF0, amf.SetDataFrame, amf.OnMetaData, amf.Object{"width": float64(1280), "duration": float64(0)})
+	packets := []*av.Packet{
+		newTestPacket(true, 0, 0x17, 0x00, 0x00, 0x00, 0x00, 0x01),
+		{IsMetadata: true, Data: b.Bytes()},
+		newTestPacket(true, 0, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(true, 40, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+		newTestPacket(true, 2000, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(true, 2040, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+	}
+	for _, p := range packets {
+		at.Equal(nil, writer.Write(p))
+	}
+	writer.Close(nil)
+
+	// the metadata replaces the reserved tag rather than following it
+	tags := readTestTags(t, f.Name())
+	at.Equal(6, len(tags))
+	at.Equal(writer.reserve, len(tags[0].data))
+	at.True(writer.reserve < 16<<10)
+	metadata := readTestMetadata(t, tags[0])
+	at.Equal(float64(1280), metadata["width"])
+	at.Equal(float64(2.04), metadata["duration"])
+	at.Equal(float64(2.04), metadata["lasttimestamp"])
+
+	info, err := os.Stat(f.Name())
+	at.Equal(nil, err)
+	at.Equal(float64(info.Size()), metadata["filesize"])
+
+	keyframes := metadata["keyframes"].(amf.Object)
+	at.Equal(amf.Array{float64(0), float64(2)}, keyframes["times"])
+	positions := keyframes["filepositions"].(amf.Array)
+	at.Equal(2, len(positions))
+	content, err := ioutil.ReadFile(f.Name())
+	at.Equal(nil, err)
+	for _, pos := range positions {
+		tag := content[int(pos.(float64)):]
+		at.Equal(byte(av.TAG_VIDEO), tag[0])
+		at.Equal(byte(0x17), tag[headerLen])
+	}
+}
+
+func TestFLVWriterIndexRewrite(t *testing.T) {
+	at := assert.New(t)
+	f, err := ioutil.TempFile("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// a key frame every second outgrows the space reserved for ten minutes
+	writer := NewFLVWriter("live", "movie", "", f)
+	reserve := writer.reserve
+	at.Equal(nil, writer.Write(newTestPacket(true, 0, 0x17, 0x00, 0x00, 0x00, 0x00, 0x01)))
+	for i := 0; i < 1200; i++ {
+		at.Equal(nil, writer.Write(newTestPacket(true, uint32(i*1000), 0x17, 0x01, 0x00, 0x00, 0x00, 0x65)))
+	}
+	writer.Close(nil)
+
+	tags := readTestTags(t, f.Name())
+	at.Equal(1202, len(tags))
+	at.True(len(tags[0].data) > reserve)
+	metadata := readTestMetadata(t, tags[0])
+	info, err := os.Stat(f.Name())
+	at.Equal(nil, err)
+	at.Equal(float64(info.Size()), metadata["filesize"])
+	positions := metadata["keyframes"].(amf.Object)["filepositions"].(amf.Array)
+	at.Equal(1200, len(positions))
+	content, err := ioutil.ReadFile(f.Name())
+	at.Equal(nil, err)
+	for _, pos := range positions {
+		tag := content[int(pos.(float64)):]
+		at.Equal(byte(av.TAG_VIDEO), tag[0])
+		at.Equal(byte(0x17), tag[headerLen])
+	}
+}
+
+func TestMetadataReserve(t *testing.T) {
+	at := assert.New(t)
+	writer := &FLVWriter{}
+	at.Equal(metadataFields+301*keyframeEntrySize, writer.metadataReserve())
+	writer.rotation = Rotation{Duration: time.Minute}
+	at.Equal(metadataFields+31*keyframeEntrySize, writer.metadataReserve())
+
+	// the next file of the size rotation is like the previous one
+	writer.rotation = Rotation{Size: 1 << 20}
+	writer.lastTimestamp = 100000
+	writer.keyframes = make([]keyframe, 101)
+	at.Equal(metadataFields+101*keyframeEntrySize, writer.metadataReserve())
+}
+
+func TestMetadataTagThinning(t *testing.T) {
+	at := assert.New(t)
+	f, err := ioutil.TempFile("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	writer := &FLVWriter{ctx: f, lastTimestamp: 1000, reserve: maxMetadataSize}
+	for i := 0; i < 20000; i++ {
+		writer.keyframes = append(writer.keyframes, keyframe{timestamp: uint32(i * 2000), position: int64(i)})
+	}
+	metadata, ok := onMetaData(writer.metadataTag(true))
+	at.True(ok)
+	times := metadata["keyframes"].(amf.Object)["times"].(amf.Array)
+	at.True(len(times) > 0 && len(times) < 20000)
+	at.Equal(float64(0), times[0])
+	at.Equal(float64(4), times[1])
+}
+
+func TestRotationDue(t *testing.T) {
+	at := assert.New(t)
+	start := time.Date(2026, 10, 17, 10, 59, 0, 0, time.UTC)
+	writer := &FLVWriter{fileStart: start}
+
+	writer.rotation = Rotation{Duration: time.Minute}
+	at.False(writer.rotationDue(start.Add(59 * time.Second)))
+	at.True(writer.rotationDue(start.Add(time.Minute)))
+
+	writer.rotation = Rotation{Hourly: true}
+	at.False(writer.rotationDue(start.Add(59 * time.Second)))
+	at.True(writer.rotationDue(start.Add(time.Minute)))
+
+	// hours of the local wall clock, 10:59 in +05:30 is 05:29 UTC
+	india := time.FixedZone("IST", 5*3600+1800)
+	start = time.Date(2026, 10, 17, 10, 59, 0, 0, india)
+	writer = &FLVWriter{fileStart: start, rotation: Rotation{Hourly: true}}
+	at.True(writer.rotationDue(start.Add(time.Minute)))
+	writer.fileStart = start.Add(time.Minute)
+	at.False(writer.rotationDue(start.Add(31 * time.Minute)))
+	at.True(writer.rotationDue(start.Add(61 * time.Minute)))
+}
@@ -0,0 +1,315 @@
+package flv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/gwuhaolin/livego/utils/pio"
+)
+
+var (
+	ErrNotFLV = fmt.Errorf("not a flv file")
+)
+
+// Reader read the tags of a recorded flv file and seek it to its random
+// access points
+type Reader struct {
+	r         io.ReadSeeker
+	pos       int64
+	dataStart int64
+	metadata  amf.Object
+	videoSeq  *av.Packet
+	audioSeq  *av.Packet
+	hasVideo  bool
+	demuxer   *Demuxer
+}
+
+// NewReader read the flv header of r and the onMetaData and sequence headers
+// preceding its first frame
+func NewReader(r io.ReadSeeker) (*Reader, error) {
+	b := make([]byte, len(flvHeader)+4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrNotFLV
+	}
+	if !bytes.Equal(b[:3], flvHeader[:3]) {
+		return nil, ErrNotFLV
+	}
+	reader := &Reader{
+		r:       r,
+		demuxer: NewDemuxer(),
+	}
+	if err := reader.seek(int64(pio.U32BE(b[5:9])) + 4); err != nil {
+		return nil, err
+	}
+	for {
+		pos := reader.pos
+		p, err := reader.ReadPacket()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a recording without frames yet
+			reader.dataStart = pos
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if p.IsMetadata {
+			if metadata, ok := onMetaData(p.Data); ok && reader.metadata == nil {
+				reader.metadata = metadata
+			}
+			continue
+		}
+		if reader.keepHeader(p) {
+			continue
+		}
+		reader.dataStart = pos
+		break
+	}
+	return reader, reader.seek(reader.dataStart)
+}
+
+// ReadPacket return the next tag, its data keeps the media tag header like
+// the packets of a live stream. io.ErrUnexpectedEOF is returned for a
+// truncated tag, the last one of a file being recorded.
+func (reader *Reader) ReadPacket() (*av.Packet, error) {
+	for {
+		h := make([]byte, headerLen)
+		if _, err := io.ReadFull(reader.r, h); err != nil {
+			return nil, err
+		}
+		size := pio.U24BE(h[1:4])
+		data := make([]byte, size+4)
+		if _, err := io.ReadFull(reader.r, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		reader.pos += int64(headerLen) + int64(len(data))
+
+		p := &av.Packet{
+			TimeStamp: pio.U24BE(h[4:7]) | uint32(h[7])<<24,
+			Data:      data[:size],
+		}
+		switch h[0] {
+		case av.TAG_VIDEO:
+			p.IsVideo = true
+		case av.TAG_AUDIO:
+			p.IsAudio = true
+		case av.TAG_SCRIPTDATAAMF0, av.TAG_SCRIPTDATAAMF3:
+			p.IsMetadata = true
+			return p, nil
+		default:
+			continue
+		}
+		if size == 0 {
+			continue
+		}
+		if err := reader.demuxer.DemuxH(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+// Metadata return the onMetaData data message of the file without its
+// keyframe index, the file positions mean nothing to a player reading it
+// as a stream, or nil when the file has none
+func (reader *Reader) Metadata() []byte {
+	if reader.metadata == nil {
+		return nil
+	}
+	obj := amf.Object{}
+	for k, v := range reader.metadata {
+		obj[k] = v
+	}
+	delete(obj, "keyframes")
+	b := bytes.NewBuffer(nil)
+	encoder := &amf.Encoder{}
+	if _, err := encoder.EncodeAmf0String(b, amf.OnMetaData, true); err != nil {
+		return nil
+	}
+	if _, err := encoder.EncodeAmf0EcmaArray(b, obj, true); err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+// Headers return the sequence headers of the frames following the last
+// Seek, to be sent before them
+func (reader *Reader) Headers() []*av.Packet {
+	var headers []*av.Packet
+	for _, p := range []*av.Packet{reader.videoSeq, reader.audioSeq} {
+		if p != nil {
+			headers = append(headers, p)
+		}
+	}
+	return headers
+}
+
+// Seek move to the last random access point at or before timestamp, found
+// in the keyframe index of the onMetaData when the file has one or by
+// reading the tags otherwise
+func (reader *Reader) Seek(timestamp uint32) error {
+	if pos, ok := reader.indexed(timestamp); ok && pos >= reader.dataStart {
+		// an index of another file, or of a file changed since, is not
+		// trusted blindly
+		if err := reader.seek(pos); err != nil {
+			return err
+		}
+		if p, err := reader.ReadPacket(); err == nil && reader.randomAccess(p) {
+			if err := reader.preceding(pos); err != nil {
+				return err
+			}
+			return reader.seek(pos)
+		}
+	}
+	return reader.scan(timestamp)
+}
+
+// preceding keep the sequence headers written right before the tag at pos,
+// those of a codec change in the middle of the file
+func (reader *Reader) preceding(pos int64) error {
+	var headers []*av.Packet
+	b := make([]byte, 4)
+	for pos > reader.dataStart {
+		if err := reader.seek(pos - 4); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(reader.r, b); err != nil {
+			return err
+		}
+		prev := pos - 4 - int64(pio.U32BE(b))
+		if prev < reader.dataStart {
+			break
+		}
+		if err := reader.seek(prev); err != nil {
+			return err
+		}
+		p, err := reader.ReadPacket()
+		if err != nil || reader.pos != pos || p.IsMetadata || !isHeader(p) {
+			break
+		}
+		headers = append(headers, p)
+		pos = prev
+	}
+	// the nearest header of a kind wins
+	for i := len(headers) - 1; i >= 0; i-- {
+		reader.keepHeader(headers[i])
+	}
+	return nil
+}
+
+// indexed return the position of the last key frame of the index at or
+// before timestamp
+func (reader *Reader) indexed(timestamp uint32) (int64, bool) {
+	keyframes, ok := reader.metadata["keyframes"].(amf.Object)
+	if !ok {
+		return 0, false
+	}
+	times, _ := keyframes["times"].(amf.Array)
+	positions, _ := keyframes["filepositions"].(amf.Array)
+	if len(times) == 0 || len(times) != len(positions) {
+		return 0, false
+	}
+	pos := reader.dataStart
+	for i, v := range times {
+		t, ok := v.(float64)
+		if !ok {
+			return 0, false
+		}
+		if uint32(t*1000) > timestamp {
+			break
+		}
+		position, ok := positions[i].(float64)
+		if !ok {
+			return 0, false
+		}
+		pos = int64(position)
+	}
+	return pos, true
+}
+
+// scan read the tags from the first frame up to timestamp, the sequence
+// headers met on the way replace those of the file start
+func (reader *Reader) scan(timestamp uint32) error {
+	if err := reader.seek(reader.dataStart); err != nil {
+		return err
+	}
+	pos := reader.dataStart
+	var pending []*av.Packet
+	for {
+		at := reader.pos
+		p, err := reader.ReadPacket()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if p.IsMetadata {
+			continue
+		}
+		if p.IsVideo {
+			reader.hasVideo = true
+		}
+		if isHeader(p) {
+			pending = append(pending, p)
+			continue
+		}
+		if p.TimeStamp > timestamp {
+			break
+		}
+		if reader.randomAccess(p) {
+			pos = at
+			for _, h := range pending {
+				reader.keepHeader(h)
+			}
+			pending = nil
+		}
+	}
+	return reader.seek(pos)
+}
+
+func (reader *Reader) seek(pos int64) error {
+	if _, err := reader.r.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	reader.pos = pos
+	return nil
+}
+
+// keepHeader save the sequence header p, it return false for other tags
+func (reader *Reader) keepHeader(p *av.Packet) bool {
+	if p.IsVideo {
+		reader.hasVideo = true
+	}
+	if !isHeader(p) {
+		return false
+	}
+	if p.IsVideo {
+		reader.videoSeq = p
+	} else {
+		reader.audioSeq = p
+	}
+	return true
+}
+
+// randomAccess tell whether playback can start with p, a video key frame or
+// any audio frame of a file without video
+func (reader *Reader) randomAccess(p *av.Packet) bool {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsKeyFrame()
+	}
+	return p.IsAudio && !reader.hasVideo
+}
+
+func isHeader(p *av.Packet) bool {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsSeq()
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	return ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+}
@@ -0,0 +1,90 @@
+package flv
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestArchive record a stream with key frames at 0, 2 and 4 seconds and
+// a new sequence header before the last one, the index is written on close
+func writeTestArchive(t *testing.T, closed bool) string {
+	f, err := ioutil.TempFile("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewFLVWriter("live", "movie", "", f)
+	packets := []*av.Packet{
+		newTestPacket(true, 0, 0x17, 0x00, 0x00, 0x00, 0x00, 0x01),
+		newTestPacket(false, 0, 0xaf, 0x00, 0x12, 0x10),
+		newTestPacket(true, 0, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(false, 20, 0xaf, 0x01, 0xaa),
+		newTestPacket(true, 40, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+		newTestPacket(true, 2000, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(true, 2040, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+		newTestPacket(true, 4000, 0x17, 0x00, 0x00, 0x00, 0x00, 0x02),
+		newTestPacket(true, 4000, 0x17, 0x01, 0x00, 0x00, 0x00, 0x65),
+		newTestPacket(true, 4040, 0x27, 0x01, 0x00, 0x00, 0x00, 0x41),
+	}
+	for _, p := range packets {
+		if err := writer.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closed {
+		writer.Close(nil)
+	} else {
+		f.Close()
+	}
+	return f.Name()
+}
+
+func testSeek(t *testing.T, closed bool) {
+	at := assert.New(t)
+	name := writeTestArchive(t, closed)
+	defer os.Remove(name)
+
+	for _, c := range []struct {
+		start     uint32
+		timestamp uint32
+		seq       byte
+	}{
+		{0, 0, 0x01},
+		{1999, 0, 0x01},
+		{3000, 2000, 0x01},
+		{4500, 4000, 0x02},
+		{60000, 4000, 0x02},
+	} {
+		f, err := os.Open(name)
+		at.Equal(nil, err)
+		reader, err := NewReader(f)
+		at.Equal(nil, err)
+		at.Equal(nil, reader.Seek(c.start))
+
+		headers := reader.Headers()
+		at.Equal(2, len(headers))
+		at.True(headers[0].IsVideo)
+		at.Equal(c.seq, headers[0].Data[len(headers[0].Data)-1])
+		at.True(headers[1].IsAudio)
+
+		p, err := reader.ReadPacket()
+		at.Equal(nil, err)
+		at.True(p.IsVideo)
+		at.Equal(c.timestamp, p.TimeStamp)
+		at.Equal(byte(0x17), p.Data[0])
+		f.Close()
+	}
+}
+
+func TestReaderSeekIndex(t *testing.T) {
+	testSeek(t, true)
+}
+
+func TestReaderSeekScan(t *testing.T) {
+	// a file still being recorded has no index yet
+	testSeek(t, false)
+}
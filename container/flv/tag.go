@@ -88,6 +88,7 @@ type mediaTag struct {
 		5: On2 VP6 with alpha channel
 		6: Screen video version 2
 		7: AVC
+		12: HEVC (legacy extension, enhanced RTMP uses the FourCC)
 	*/
 	codecID uint8
 
@@ -98,6 +99,19 @@ type mediaTag struct {
 	*/
 	avcPacketType uint8
 
+	/*
+		IsExHeader: UB[1], enhanced RTMP ExVideoTagHeader follows, the
+		frameType is then UB[3] and the packetType UB[4]:
+		0: SequenceStart
+		1: CodedFrames
+		2: SequenceEnd
+		3: CodedFramesX, CodedFrames without composition time
+		4: Metadata
+		5: MPEG2TSSequenceStart
+	*/
+	isExHeader bool
+	fourCC     string
+
 	compositionTime int32
 }
 
@@ -115,7 +129,17 @@ func (tag *Tag) AACPacketType() uint8 {
 }
 
 func (tag *Tag) IsKeyFrame() bool {
-	return tag.mediat.frameType == av.FRAME_KEY
+	if tag.mediat.frameType != av.FRAME_KEY {
+		return false
+	}
+	if !tag.mediat.isExHeader {
+		return true
+	}
+	switch tag.mediat.avcPacketType {
+	case av.PKT_SEQUENCE_START, av.PKT_CODED_FRAMES, av.PKT_CODED_FRAMESX:
+		return true
+	}
+	return false
 }
 
 func (tag *Tag) IsSeq() bool {
@@ -123,6 +147,21 @@ func (tag *Tag) IsSeq() bool {
 		tag.mediat.avcPacketType == av.AVC_SEQHDR
 }
 
+func (tag *Tag) IsExHeader() bool {
+	return tag.mediat.isExHeader
+}
+
+// PacketType return the AVC packet type of legacy tags or the enhanced RTMP
+// packet type, see av.PKT_SEQUENCE_START
+func (tag *Tag) PacketType() uint8 {
+	return tag.mediat.avcPacketType
+}
+
+// FourCC return the FourCC of enhanced RTMP tags, empty for legacy ones
+func (tag *Tag) FourCC() string {
+	return tag.mediat.fourCC
+}
+
 func (tag *Tag) CodecID() uint8 {
 	return tag.mediat.codecID
 }
@@ -161,11 +200,21 @@ func (tag *Tag) parseAudioHeader(b []byte) (n int, err error) {
 	return
 }
 
+var fourCCCodecs = map[string]uint8{
+	av.FOURCC_AVC:  av.VIDEO_H264,
+	av.FOURCC_HEVC: av.VIDEO_HEVC,
+	av.FOURCC_AV1:  av.VIDEO_AV1,
+	av.FOURCC_VP9:  av.VIDEO_VP9,
+}
+
 func (tag *Tag) parseVideoHeader(b []byte) (n int, err error) {
 	if len(b) < n+5 {
 		err = fmt.Errorf("invalid videodata len=%d", len(b))
 		return
 	}
+	if b[0]&0x80 != 0 {
+		return tag.parseExVideoHeader(b)
+	}
 	flags := b[0]
 	tag.mediat.frameType = flags >> 4
 	tag.mediat.codecID = flags & 0xf
@@ -179,3 +228,36 @@ func (tag *Tag) parseVideoHeader(b []byte) (n int, err error) {
 	}
 	return
 }
+
+func (tag *Tag) parseExVideoHeader(b []byte) (n int, err error) {
+	tag.mediat.isExHeader = true
+	tag.mediat.frameType = (b[0] >> 4) & 0x7
+	tag.mediat.avcPacketType = b[0] & 0xf
+	n++
+
+	tag.mediat.fourCC = string(b[1:5])
+	codecID, ok := fourCCCodecs[tag.mediat.fourCC]
+	if !ok {
+		err = fmt.Errorf("invalid video fourcc=%q", tag.mediat.fourCC)
+		return
+	}
+	tag.mediat.codecID = codecID
+	n += 4
+
+	// only AVC and HEVC coded frames carry a composition time
+	if tag.mediat.avcPacketType == av.PKT_CODED_FRAMES &&
+		(codecID == av.VIDEO_H264 || codecID == av.VIDEO_HEVC) {
+		if len(b) < n+3 {
+			err = fmt.Errorf("invalid videodata len=%d", len(b))
+			return
+		}
+		ct := int32(b[5])<<16 | int32(b[6])<<8 | int32(b[7])
+		// SI24
+		if ct&0x800000 != 0 {
+			ct -= 0x1000000
+		}
+		tag.mediat.compositionTime = ct
+		n += 3
+	}
+	return
+}
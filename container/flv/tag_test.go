@@ -0,0 +1,64 @@
+package flv
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLegacyVideoHeader(t *testing.T) {
+	at := assert.New(t)
+
+	var tag Tag
+	n, err := tag.ParseMediaTagHeader([]byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}, true)
+	at.Equal(nil, err)
+	at.Equal(5, n)
+	at.Equal(false, tag.IsExHeader())
+	at.Equal(true, tag.IsSeq())
+	at.Equal(uint8(av.VIDEO_H264), tag.CodecID())
+}
+
+func TestParseExVideoHeader(t *testing.T) {
+	at := assert.New(t)
+
+	// hvc1 SequenceStart
+	var tag Tag
+	n, err := tag.ParseMediaTagHeader([]byte{0x90, 'h', 'v', 'c', '1', 0x01}, true)
+	at.Equal(nil, err)
+	at.Equal(5, n)
+	at.Equal(true, tag.IsExHeader())
+	at.Equal(true, tag.IsSeq())
+	at.Equal(true, tag.IsKeyFrame())
+	at.Equal(uint8(av.VIDEO_HEVC), tag.CodecID())
+	at.Equal(av.FOURCC_HEVC, tag.FourCC())
+
+	// hvc1 CodedFrames carry a signed composition time
+	tag = Tag{}
+	n, err = tag.ParseMediaTagHeader([]byte{0xa1, 'h', 'v', 'c', '1', 0xff, 0xff, 0xfe, 0x00}, true)
+	at.Equal(nil, err)
+	at.Equal(8, n)
+	at.Equal(false, tag.IsKeyFrame())
+	at.Equal(false, tag.IsSeq())
+	at.Equal(int32(-2), tag.CompositionTime())
+
+	// av01 CodedFrames have no composition time
+	tag = Tag{}
+	n, err = tag.ParseMediaTagHeader([]byte{0x91, 'a', 'v', '0', '1', 0x12}, true)
+	at.Equal(nil, err)
+	at.Equal(5, n)
+	at.Equal(true, tag.IsKeyFrame())
+	at.Equal(uint8(av.VIDEO_AV1), tag.CodecID())
+
+	// key frame Metadata is not a random access point
+	tag = Tag{}
+	_, err = tag.ParseMediaTagHeader([]byte{0x94, 'h', 'v', 'c', '1', 0x02}, true)
+	at.Equal(nil, err)
+	at.Equal(false, tag.IsKeyFrame())
+	at.Equal(uint8(av.PKT_METADATA), tag.PacketType())
+
+	tag = Tag{}
+	_, err = tag.ParseMediaTagHeader([]byte{0x91, 'x', 'x', 'x', 'x', 0x00}, true)
+	at.NotEqual(nil, err)
+}
@@ -0,0 +1,72 @@
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// unity transformation matrix of mvhd and tkhd
+var matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00,
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, b := range payload {
+		size += len(b)
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	copy(buf[4:], typ)
+	for _, b := range payload {
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// descriptor write a MPEG-4 descriptor (ISO/IEC 14496-1 8.3.3) with the
+// 4 bytes expandable size used by most muxers
+func descriptor(tag byte, payload ...[]byte) []byte {
+	size := 0
+	for _, b := range payload {
+		size += len(b)
+	}
+	buf := []byte{tag,
+		0x80 | byte(size>>21&0x7f), 0x80 | byte(size>>14&0x7f), 0x80 | byte(size>>7&0x7f), byte(size & 0x7f)}
+	for _, b := range payload {
+		buf = append(buf, b...)
+	}
+	return buf
+}
@@ -0,0 +1,324 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+var (
+	errConfigInvalid = fmt.Errorf("decoder configuration invalid")
+	errSPSInvalid    = fmt.Errorf("sps invalid")
+)
+
+var aacRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+// newBitReader strip the emulation prevention bytes of a NAL unit
+func newBitReader(nalu []byte) *bitReader {
+	rbsp := make([]byte, 0, len(nalu))
+	zeroCount := 0
+	for _, b := range nalu {
+		if zeroCount == 2 && b == 0x03 {
+			zeroCount = 0
+			continue
+		}
+		if b == 0 {
+			zeroCount++
+		} else {
+			zeroCount = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return &bitReader{buf: rbsp}
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.buf)*8 {
+			return 0, errSPSInvalid
+		}
+		bit := (r.buf[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) skip(n int) error {
+	_, err := r.bits(n)
+	return err
+}
+
+// ue read an unsigned Exp-Golomb code
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errSPSInvalid
+		}
+	}
+	v, err := r.bits(zeros)
+	return (1<<uint(zeros) - 1) + v, err
+}
+
+// se read a signed Exp-Golomb code
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if v&1 == 1 {
+		return int32(v+1) / 2, err
+	}
+	return -int32(v / 2), err
+}
+
+// cropUnits return the horizontal and vertical crop units of a chroma format
+func cropUnits(chromaFormat uint32) (int, int) {
+	switch chromaFormat {
+	case 1:
+		return 2, 2
+	case 2:
+		return 2, 1
+	}
+	return 1, 1
+}
+
+// avcSize read the picture size from the first SPS of an
+// AVCDecoderConfigurationRecord
+func avcSize(record []byte) (int, int, error) {
+	if len(record) < 8 || record[5]&0x1f == 0 {
+		return 0, 0, errConfigInvalid
+	}
+	spsLen := int(record[6])<<8 | int(record[7])
+	if len(record) < 8+spsLen || spsLen < 4 {
+		return 0, 0, errConfigInvalid
+	}
+	return h264SPSSize(record[8 : 8+spsLen])
+}
+
+func h264SPSSize(sps []byte) (int, int, error) {
+	r := newBitReader(sps[1:])
+	profile, _ := r.bits(8)
+	r.skip(16)
+	r.ue()
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat, _ = r.ue()
+		if chromaFormat == 3 {
+			r.skip(1)
+		}
+		r.ue()
+		r.ue()
+		r.skip(1)
+		if present, _ := r.bits(1); present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if listPresent, _ := r.bits(1); listPresent == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, _ := r.se()
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue()
+	pocType, _ := r.ue()
+	switch pocType {
+	case 0:
+		r.ue()
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		cycle, _ := r.ue()
+		for i := uint32(0); i < cycle; i++ {
+			r.se()
+		}
+	}
+	r.ue()
+	r.skip(1)
+	widthMbs, _ := r.ue()
+	heightMapUnits, _ := r.ue()
+	frameMbsOnly, _ := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.skip(1)
+	}
+	r.skip(1)
+	var left, right, top, bottom uint32
+	cropping, err := r.bits(1)
+	if cropping == 1 {
+		left, _ = r.ue()
+		right, _ = r.ue()
+		top, _ = r.ue()
+		bottom, err = r.ue()
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	unitX, unitY := cropUnits(chromaFormat)
+	unitY *= int(2 - frameMbsOnly)
+	width := int(widthMbs+1)*16 - int(left+right)*unitX
+	height := int(2-frameMbsOnly)*int(heightMapUnits+1)*16 - int(top+bottom)*unitY
+	return width, height, nil
+}
+
+// hevcSize read the picture size from the SPS of an
+// HEVCDecoderConfigurationRecord
+func hevcSize(record []byte) (int, int, error) {
+	if len(record) < 23 {
+		return 0, 0, errConfigInvalid
+	}
+	index := 23
+	for i := 0; i < int(record[22]); i++ {
+		if len(record) < index+3 {
+			break
+		}
+		nalType := record[index] & 0x3f
+		numNalus := int(record[index+1])<<8 | int(record[index+2])
+		index += 3
+		for j := 0; j < numNalus; j++ {
+			if len(record) < index+2 {
+				return 0, 0, errConfigInvalid
+			}
+			nalLen := int(record[index])<<8 | int(record[index+1])
+			index += 2
+			if len(record) < index+nalLen {
+				return 0, 0, errConfigInvalid
+			}
+			if nalType == 33 && nalLen > 2 {
+				return hevcSPSSize(record[index : index+nalLen])
+			}
+			index += nalLen
+		}
+	}
+	return 0, 0, errConfigInvalid
+}
+
+func hevcSPSSize(sps []byte) (int, int, error) {
+	r := newBitReader(sps[2:])
+	r.skip(4)
+	maxSubLayers, _ := r.bits(3)
+	r.skip(1)
+	// profile_tier_level
+	r.skip(96)
+	profilePresent := make([]uint32, maxSubLayers)
+	levelPresent := make([]uint32, maxSubLayers)
+	for i := range profilePresent {
+		profilePresent[i], _ = r.bits(1)
+		levelPresent[i], _ = r.bits(1)
+	}
+	if maxSubLayers > 0 {
+		r.skip(2 * int(8-maxSubLayers))
+	}
+	for i := range profilePresent {
+		if profilePresent[i] == 1 {
+			r.skip(88)
+		}
+		if levelPresent[i] == 1 {
+			r.skip(8)
+		}
+	}
+	r.ue()
+	chromaFormat, _ := r.ue()
+	if chromaFormat == 3 {
+		r.skip(1)
+	}
+	width, _ := r.ue()
+	height, _ := r.ue()
+	var left, right, top, bottom uint32
+	window, err := r.bits(1)
+	if window == 1 {
+		left, _ = r.ue()
+		right, _ = r.ue()
+		top, _ = r.ue()
+		bottom, err = r.ue()
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	unitX, unitY := cropUnits(chromaFormat)
+	return int(width) - int(left+right)*unitX, int(height) - int(top+bottom)*unitY, nil
+}
+
+// aacConfig read the sample rate and channel count of an AudioSpecificConfig
+func aacConfig(asc []byte) (int, int, error) {
+	if len(asc) < 2 {
+		return 0, 0, errConfigInvalid
+	}
+	index := int((asc[0]&0x07)<<1 | asc[1]>>7)
+	if index >= len(aacRates) {
+		return 0, 0, errConfigInvalid
+	}
+	channels := int(asc[1]>>3) & 0x0f
+	return aacRates[index], channels, nil
+}
+
+// mp3Channels return the channel count of a MPEG audio frame header
+func mp3Channels(frame []byte) int {
+	if len(frame) > 3 && frame[3]>>6 == 3 {
+		return 1
+	}
+	return 2
+}
+
+// avcCodecs return the RFC 6381 codecs parameter of an
+// AVCDecoderConfigurationRecord
+func avcCodecs(record []byte) string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", record[1], record[2], record[3])
+}
+
+// hevcCodecs return the codecs parameter of an HEVCDecoderConfigurationRecord
+// as described in ISO/IEC 14496-15 Annex E
+func hevcCodecs(record []byte) string {
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if space := record[1] >> 6; space > 0 {
+		b.WriteByte('A' + space - 1)
+	}
+	compat := binary.BigEndian.Uint32(record[2:6])
+	var reversed uint32
+	for i := 0; i < 32; i++ {
+		reversed = reversed<<1 | (compat>>uint(i))&1
+	}
+	tier := byte('L')
+	if record[1]&0x20 != 0 {
+		tier = 'H'
+	}
+	fmt.Fprintf(&b, "%d.%X.%c%d", record[1]&0x1f, reversed, tier, record[12])
+	constraints := record[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
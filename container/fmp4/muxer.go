@@ -0,0 +1,401 @@
+package fmp4
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/parser/mp3"
+)
+
+const (
+	videoTrackID   = 1
+	audioTrackID   = 2
+	movieTimescale = 1000
+	videoTimescale = 90000
+	videoHZ        = videoTimescale / 1000
+	aacFrameLen    = 1024
+
+	objectTypeAAC    = 0x40
+	objectTypeMP3    = 0x6b
+	objectTypeMP3LSF = 0x69
+
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+
+	// data-offset, sample-duration, sample-size, sample-flags and
+	// sample-composition-time-offsets present
+	trunFlags = 0x000f01
+	// default-base-is-moof
+	tfhdFlags = 0x020000
+)
+
+var (
+	ErrNoSupportCodec = fmt.Errorf("no support codec")
+)
+
+type sample struct {
+	data     []byte
+	dts      uint64
+	duration uint32
+	cto      int32
+	flags    uint32
+}
+
+type track struct {
+	id           uint32
+	handler      string
+	timescale    uint32
+	entry        []byte
+	config       []byte
+	codecs       string
+	width        uint32
+	height       uint32
+	inInit       bool
+	samples      []sample
+	frameSamples uint32
+	decodeTime   uint64
+	hasTime      bool
+	lastDuration uint32
+}
+
+// Muxer write a fragmented MP4 (CMAF) stream, an init segment holding the
+// moov box and moof/mdat fragments of the packets written since the
+// previous fragment. Packets must be demuxed, with their FLV payload left
+// untouched.
+type Muxer struct {
+	seq   uint32
+	video *track
+	audio *track
+}
+
+func NewMuxer() *Muxer {
+	return &Muxer{}
+}
+
+// Configure read the codec configuration carried by p, a video or AAC
+// sequence header or a MP3 frame. It report whether the init segment has
+// to be written again.
+func (muxer *Muxer) Configure(p *av.Packet) (bool, error) {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok || !vh.IsSeq() {
+			return false, nil
+		}
+		return muxer.configureVideo(vh.CodecID(), p.Data)
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if !ok {
+		return false, nil
+	}
+	switch ah.SoundFormat() {
+	case av.SOUND_AAC:
+		if ah.AACPacketType() != av.AAC_SEQHDR {
+			return false, nil
+		}
+		return muxer.configureAAC(p.Data)
+	case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
+		return muxer.configureMP3(p.Data)
+	}
+	return false, ErrNoSupportCodec
+}
+
+func (muxer *Muxer) configureVideo(codecID uint8, record []byte) (bool, error) {
+	if muxer.video != nil && bytes.Equal(muxer.video.config, record) {
+		return false, nil
+	}
+	var fourCC, configType string
+	var width, height int
+	var err error
+	var codecs string
+	switch codecID {
+	case av.VIDEO_H264:
+		fourCC, configType = av.FOURCC_AVC, "avcC"
+		width, height, err = avcSize(record)
+		if err == nil {
+			codecs = avcCodecs(record)
+		}
+	case av.VIDEO_HEVC:
+		fourCC, configType = av.FOURCC_HEVC, "hvcC"
+		width, height, err = hevcSize(record)
+		if err == nil {
+			codecs = hevcCodecs(record)
+		}
+	default:
+		return false, ErrNoSupportCodec
+	}
+	if err != nil {
+		return false, err
+	}
+	t := muxer.video
+	if t == nil {
+		t = &track{id: videoTrackID, handler: "vide", timescale: videoTimescale}
+		muxer.video = t
+	}
+	t.config = append([]byte(nil), record...)
+	t.codecs = codecs
+	t.width, t.height = uint32(width), uint32(height)
+	t.entry = box(fourCC,
+		zeros(6), u16(1), zeros(16),
+		u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000), zeros(4), u16(1),
+		zeros(32), u16(0x18), u16(0xffff),
+		box(configType, record))
+	return true, nil
+}
+
+func (muxer *Muxer) configureAAC(asc []byte) (bool, error) {
+	if muxer.audio != nil && bytes.Equal(muxer.audio.config, asc) {
+		return false, nil
+	}
+	sampleRate, channels, err := aacConfig(asc)
+	if err != nil {
+		return false, err
+	}
+	muxer.setAudio(asc, objectTypeAAC, sampleRate, channels, aacFrameLen, descriptor(5, asc))
+	return true, nil
+}
+
+func (muxer *Muxer) configureMP3(frame []byte) (bool, error) {
+	parser := mp3.NewParser()
+	if err := parser.Parse(frame); err != nil {
+		return false, err
+	}
+	channels := mp3Channels(frame)
+	// MPEG-2 and 2.5 low sampling frequencies have their own object type
+	objectType := byte(objectTypeMP3)
+	if parser.SampleRate() < 32000 {
+		objectType = objectTypeMP3LSF
+	}
+	config := []byte{objectType, byte(channels)}
+	config = append(config, u32(uint32(parser.SampleRate()))...)
+	config = append(config, u32(uint32(parser.FrameSamples()))...)
+	if muxer.audio != nil && bytes.Equal(muxer.audio.config, config) {
+		return false, nil
+	}
+	muxer.setAudio(config, objectType, parser.SampleRate(), channels, parser.FrameSamples(), nil)
+	return true, nil
+}
+
+func (muxer *Muxer) setAudio(config []byte, objectType byte, sampleRate, channels, frameSamples int, dsi []byte) {
+	t := muxer.audio
+	if t == nil {
+		t = &track{id: audioTrackID, handler: "soun"}
+		muxer.audio = t
+	} else if t.timescale != uint32(sampleRate) {
+		// the decode time is counted in samples of the previous rate
+		t.hasTime = false
+	}
+	t.config = append([]byte(nil), config...)
+	t.codecs = fmt.Sprintf("mp4a.%02X", objectType)
+	if dsi != nil {
+		t.codecs = fmt.Sprintf("mp4a.40.%d", config[0]>>3)
+	}
+	t.timescale = uint32(sampleRate)
+	t.frameSamples = uint32(frameSamples)
+	decoderConfig := [][]byte{u8(objectType), u8(0x15), zeros(3), u32(0), u32(0)}
+	if dsi != nil {
+		decoderConfig = append(decoderConfig, dsi)
+	}
+	esds := fullBox("esds", 0, 0,
+		descriptor(3, u16(0), u8(0),
+			descriptor(4, decoderConfig...),
+			descriptor(6, u8(2))))
+	t.entry = box("mp4a",
+		zeros(6), u16(1), zeros(8),
+		u16(uint16(channels)), u16(16), zeros(4),
+		u32(uint32(sampleRate)<<16),
+		esds)
+}
+
+// Codecs return the RFC 6381 codecs parameter of the configured tracks
+func (muxer *Muxer) Codecs() string {
+	var codecs []string
+	for _, t := range []*track{muxer.video, muxer.audio} {
+		if t != nil {
+			codecs = append(codecs, t.codecs)
+		}
+	}
+	return strings.Join(codecs, ",")
+}
+
+// VideoSize return the picture size of the video track
+func (muxer *Muxer) VideoSize() (int, int) {
+	if muxer.video == nil {
+		return 0, 0
+	}
+	return int(muxer.video.width), int(muxer.video.height)
+}
+
+// SampleRate return the sample rate of the audio track
+func (muxer *Muxer) SampleRate() int {
+	if muxer.audio == nil {
+		return 0
+	}
+	return int(muxer.audio.timescale)
+}
+
+// InitSegment return the ftyp and moov boxes of the configured tracks, only
+// the samples of these tracks are written to the following fragments
+func (muxer *Muxer) InitSegment() []byte {
+	var traks, trexs [][]byte
+	for _, t := range []*track{muxer.video, muxer.audio} {
+		if t == nil {
+			continue
+		}
+		t.inInit = true
+		traks = append(traks, t.trak())
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(movieTimescale), u32(0),
+		u32(0x00010000), u16(0x0100), zeros(10), matrix, zeros(24),
+		u32(audioTrackID+1))
+	moov := append([][]byte{mvhd}, traks...)
+	moov = append(moov, box("mvex", trexs...))
+
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41cmfc"))
+	return append(ftyp, box("moov", moov...)...)
+}
+
+func (t *track) trak() []byte {
+	var volume uint16
+	var mediaHeader []byte
+	name := "SoundHandler"
+	if t.handler == "vide" {
+		name = "VideoHandler"
+		mediaHeader = fullBox("vmhd", 0, 1, zeros(8))
+	} else {
+		volume = 0x0100
+		mediaHeader = fullBox("smhd", 0, 0, zeros(4))
+	}
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(t.id), u32(0), u32(0),
+		zeros(8), u16(0), u16(0), u16(volume), u16(0),
+		matrix, u32(t.width<<16), u32(t.height<<16))
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0), u32(t.timescale), u32(0), u16(0x55c4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0,
+		u32(0), []byte(t.handler), zeros(12), []byte(name), u8(0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), t.entry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl)))
+}
+
+// WritePacket buffer a coded frame until the next call to Fragment
+func (muxer *Muxer) WritePacket(p *av.Packet) error {
+	if p.IsVideo {
+		t := muxer.video
+		if t == nil || !t.inInit {
+			return nil
+		}
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return ErrNoSupportCodec
+		}
+		s := sample{
+			data:  append([]byte(nil), p.Data...),
+			dts:   uint64(p.TimeStamp) * videoHZ,
+			cto:   vh.CompositionTime() * videoHZ,
+			flags: sampleFlagsNonSync,
+		}
+		if vh.IsKeyFrame() {
+			s.flags = sampleFlagsSync
+		}
+		if n := len(t.samples); n > 0 {
+			t.samples[n-1].duration = t.duration(s.dts, t.samples[n-1].dts)
+		}
+		t.samples = append(t.samples, s)
+		return nil
+	}
+
+	t := muxer.audio
+	if t == nil || !t.inInit {
+		return nil
+	}
+	if !t.hasTime {
+		t.hasTime = true
+		t.decodeTime = uint64(p.TimeStamp) * uint64(t.timescale) / movieTimescale
+	}
+	t.samples = append(t.samples, sample{
+		data:     append([]byte(nil), p.Data...),
+		duration: t.frameSamples,
+		flags:    sampleFlagsSync,
+	})
+	return nil
+}
+
+// duration return the duration of the sample at dts followed by a sample at
+// next, keeping the previous one when the timestamps do not increase
+func (t *track) duration(next, dts uint64) uint32 {
+	if next > dts {
+		t.lastDuration = uint32(next - dts)
+	}
+	if t.lastDuration == 0 {
+		t.lastDuration = videoTimescale / 25
+	}
+	return t.lastDuration
+}
+
+// Fragment return a moof and mdat pair holding the buffered samples, the
+// last video sample lasts until timestamp. It return nil if there is no
+// buffered sample.
+func (muxer *Muxer) Fragment(timestamp uint32) []byte {
+	var tracks []*track
+	for _, t := range []*track{muxer.video, muxer.audio} {
+		if t != nil && len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	if t := muxer.video; t != nil && len(t.samples) > 0 {
+		last := &t.samples[len(t.samples)-1]
+		last.duration = t.duration(uint64(timestamp)*videoHZ, last.dts)
+	}
+
+	muxer.seq++
+	// the moof size does not depend on the data offsets, build it once to
+	// learn where mdat starts
+	moof := muxer.moof(tracks, 0)
+	moof = muxer.moof(tracks, uint32(len(moof)+8))
+
+	var mdat [][]byte
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			mdat = append(mdat, s.data)
+		}
+		if t.handler == "soun" {
+			t.decodeTime += uint64(len(t.samples)) * uint64(t.frameSamples)
+		}
+		t.samples = t.samples[:0]
+	}
+	return append(moof, box("mdat", mdat...)...)
+}
+
+func (muxer *Muxer) moof(tracks []*track, offset uint32) []byte {
+	trafs := [][]byte{fullBox("mfhd", 0, 0, u32(muxer.seq))}
+	for _, t := range tracks {
+		baseTime := t.decodeTime
+		if t.handler == "vide" {
+			baseTime = t.samples[0].dts
+		}
+		run := [][]byte{u32(uint32(len(t.samples))), u32(offset)}
+		for _, s := range t.samples {
+			run = append(run, u32(s.duration), u32(uint32(len(s.data))), u32(s.flags), u32(uint32(s.cto)))
+			offset += uint32(len(s.data))
+		}
+		trafs = append(trafs, box("traf",
+			fullBox("tfhd", 0, tfhdFlags, u32(t.id)),
+			fullBox("tfdt", 1, 0, u64(baseTime)),
+			fullBox("trun", 1, trunFlags, run...)))
+	}
+	return box("moof", trafs...)
+}
@@ -0,0 +1,106 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var avcRecord = []byte{0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0,
+	0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+	0x60, 0xc6, 0x58, 0x01, 0x00, 0x04, 0x68, 0xeb, 0xe3, 0xcb,
+}
+
+func demux(t *testing.T, data []byte, isVideo bool, ts uint32) *av.Packet {
+	p := &av.Packet{IsVideo: isVideo, IsAudio: !isVideo, Data: data, TimeStamp: ts}
+	if err := flv.NewDemuxer().Demux(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// findBox return the payload of the first box of type typ in b
+func findBox(b []byte, typ string) []byte {
+	for len(b) >= 8 {
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			return nil
+		}
+		if string(b[4:8]) == typ {
+			return b[8:size]
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+func TestInitSegment(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+
+	changed, err := m.Configure(demux(t, append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcRecord...), true, 0))
+	at.Equal(nil, err)
+	at.True(changed)
+	changed, err = m.Configure(demux(t, []byte{0xaf, 0x00, 0x12, 0x10}, false, 0))
+	at.Equal(nil, err)
+	at.True(changed)
+	changed, _ = m.Configure(demux(t, []byte{0xaf, 0x00, 0x12, 0x10}, false, 0))
+	at.False(changed)
+
+	init := m.InitSegment()
+	at.Equal("ftyp", string(init[4:8]))
+	moov := findBox(init, "moov")
+	at.NotNil(moov)
+	trak := findBox(moov, "trak")
+	tkhd := findBox(trak, "tkhd")
+	// width and height are the last two 16.16 fields of tkhd
+	at.Equal(uint32(1920<<16), binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]))
+	at.Equal(uint32(1080<<16), binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]))
+	at.True(bytes.Contains(moov, append([]byte("avcC"), avcRecord...)))
+	at.True(bytes.Contains(moov, []byte("esds")))
+	at.NotNil(findBox(moov, "mvex"))
+	at.Equal("avc1.640028,mp4a.40.2", m.Codecs())
+}
+
+func TestFragment(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	m.Configure(demux(t, append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcRecord...), true, 0))
+	m.Configure(demux(t, []byte{0xaf, 0x00, 0x12, 0x10}, false, 0))
+	at.Nil(m.Fragment(0))
+	m.InitSegment()
+
+	m.WritePacket(demux(t, []byte{0x17, 0x01, 0x00, 0x00, 0x28, 0xaa, 0xbb}, true, 1000))
+	m.WritePacket(demux(t, []byte{0xaf, 0x01, 0xcc}, false, 1000))
+	m.WritePacket(demux(t, []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xdd}, true, 1040))
+	frag := m.Fragment(1080)
+
+	at.Equal("moof", string(frag[4:8]))
+	moofLen := int(binary.BigEndian.Uint32(frag))
+	mdat := findBox(frag, "mdat")
+	at.Equal([]byte{0xaa, 0xbb, 0xdd, 0xcc}, mdat)
+
+	traf := findBox(findBox(frag, "moof"), "traf")
+	tfdt := findBox(traf, "tfdt")
+	at.Equal(uint64(90000), binary.BigEndian.Uint64(tfdt[4:]))
+	trun := findBox(traf, "trun")
+	at.Equal(uint32(2), binary.BigEndian.Uint32(trun[4:]))
+	// the data offset point to the first video byte in mdat
+	at.Equal(uint32(moofLen+8), binary.BigEndian.Uint32(trun[8:]))
+	// sample durations, sizes, flags and composition offsets
+	at.Equal(uint32(40*90), binary.BigEndian.Uint32(trun[12:]))
+	at.Equal(uint32(2), binary.BigEndian.Uint32(trun[16:]))
+	at.Equal(uint32(sampleFlagsSync), binary.BigEndian.Uint32(trun[20:]))
+	at.Equal(uint32(40*90), binary.BigEndian.Uint32(trun[24:]))
+	at.Equal(uint32(40*90), binary.BigEndian.Uint32(trun[28:]))
+	at.Equal(uint32(sampleFlagsNonSync), binary.BigEndian.Uint32(trun[36:]))
+
+	// nothing left to write
+	at.Nil(m.Fragment(1120))
+}
@@ -0,0 +1,84 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+var (
+	errBoxInvalid = fmt.Errorf("mp4 box invalid")
+)
+
+// atom is a box read back from a file, data is its payload
+type atom struct {
+	typ  string
+	data []byte
+}
+
+// children split the payload of a container box into its boxes
+func children(data []byte) ([]atom, error) {
+	var atoms []atom
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errBoxInvalid
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		headerLen := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errBoxInvalid
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			headerLen = 16
+		}
+		if size < headerLen || size > uint64(len(data)) {
+			return nil, errBoxInvalid
+		}
+		atoms = append(atoms, atom{typ: string(data[4:8]), data: data[headerLen:size]})
+		data = data[size:]
+	}
+	return atoms, nil
+}
+
+func find(atoms []atom, typ string) (atom, bool) {
+	for _, a := range atoms {
+		if a.typ == typ {
+			return a, true
+		}
+	}
+	return atom{}, false
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, b := range payload {
+		size += len(b)
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	copy(buf[4:], typ)
+	for _, b := range payload {
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
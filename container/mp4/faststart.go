@@ -0,0 +1,655 @@
+package mp4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// trun, tfhd and sample flags of ISO/IEC 14496-12
+const (
+	trunDataOffset = 0x000001
+	trunFirstFlags = 0x000004
+	trunDuration   = 0x000100
+	trunSize       = 0x000200
+	trunFlags      = 0x000400
+	trunCTO        = 0x000800
+
+	tfhdBaseOffset = 0x000001
+	tfhdDescIndex  = 0x000002
+	tfhdDuration   = 0x000008
+	tfhdSize       = 0x000010
+	tfhdFlags      = 0x000020
+
+	sampleNonSync = 0x00010000
+)
+
+var (
+	ErrNoMoov       = fmt.Errorf("mp4 has no moov box")
+	errNoTrack      = fmt.Errorf("mp4 fragment of an unknown track")
+	errTruncated    = fmt.Errorf("mp4 fragment truncated")
+	errNotContainer = fmt.Errorf("mp4 track misses a box")
+)
+
+// reader read the fields of a box payload, the first out of range read
+// sets err and every following one returns zero
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) u32() uint32 {
+	if r.err != nil || r.pos+4 > len(r.data) {
+		r.err = errBoxInvalid
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *reader) u64() uint64 {
+	if r.err != nil || r.pos+8 > len(r.data) {
+		r.err = errBoxInvalid
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data[r.pos:])
+	r.pos += 8
+	return v
+}
+
+type sampleDefaults struct {
+	duration uint32
+	size     uint32
+	flags    uint32
+}
+
+// chunk is the data of a track run, copied as one chunk of the
+// progressive file
+type chunk struct {
+	src   int64
+	dst   int64
+	size  int64
+	count uint32
+}
+
+type trackTable struct {
+	id        uint32
+	trak      []atom
+	defaults  sampleDefaults
+	startTime uint64
+	hasStart  bool
+	sizes     []uint32
+	durations []uint32
+	ctos      []int32
+	syncs     []uint32
+	chunks    []*chunk
+}
+
+type movie struct {
+	mvhd   []byte
+	tracks []*trackTable
+	chunks []*chunk
+}
+
+// Faststart remux the fragmented MP4 file name to a progressive one having
+// its moov box ahead of the media data. The fragments of a file left by a
+// crash are kept up to the last complete one.
+func Faststart(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	m, err := readFragmented(src)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	tmp := name + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	err = m.write(dst, src)
+	src.Close()
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func readFragmented(f *os.File) (*movie, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	var m *movie
+	header := make([]byte, 16)
+	for offset := int64(0); offset+8 <= size; {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		typ := string(header[4:8])
+		boxSize, headerLen := int64(binary.BigEndian.Uint32(header)), int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - offset
+		case 1:
+			if _, err := f.ReadAt(header[8:], offset+8); err != nil {
+				return nil, err
+			}
+			boxSize, headerLen = int64(binary.BigEndian.Uint64(header[8:])), 16
+		}
+		if boxSize < headerLen || offset+boxSize > size {
+			// the last box of a file left by a crash
+			break
+		}
+		if typ == "moov" || typ == "moof" {
+			data := make([]byte, boxSize-headerLen)
+			if _, err := f.ReadAt(data, offset+headerLen); err != nil {
+				return nil, err
+			}
+			if typ == "moov" {
+				if m, err = readMoov(data); err != nil {
+					return nil, err
+				}
+			} else if m == nil {
+				return nil, ErrNoMoov
+			} else if err := m.readMoof(data, offset, size); err == errTruncated {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		offset += boxSize
+	}
+	if m == nil {
+		return nil, ErrNoMoov
+	}
+	return m, nil
+}
+
+func readMoov(data []byte) (*movie, error) {
+	atoms, err := children(data)
+	if err != nil {
+		return nil, err
+	}
+	mvhd, ok := find(atoms, "mvhd")
+	if !ok {
+		return nil, ErrNoMoov
+	}
+	m := &movie{mvhd: mvhd.data}
+
+	defaults := make(map[uint32]sampleDefaults)
+	if mvex, ok := find(atoms, "mvex"); ok {
+		trexs, err := children(mvex.data)
+		if err != nil {
+			return nil, err
+		}
+		for _, trex := range trexs {
+			if trex.typ != "trex" {
+				continue
+			}
+			r := &reader{data: trex.data, pos: 4}
+			id := r.u32()
+			r.u32()
+			d := sampleDefaults{duration: r.u32(), size: r.u32(), flags: r.u32()}
+			if r.err != nil {
+				return nil, r.err
+			}
+			defaults[id] = d
+		}
+	}
+
+	for _, a := range atoms {
+		if a.typ != "trak" {
+			continue
+		}
+		trak, err := children(a.data)
+		if err != nil {
+			return nil, err
+		}
+		tkhd, ok := find(trak, "tkhd")
+		if !ok {
+			return nil, errNotContainer
+		}
+		id, err := headerField(tkhd.data)
+		if err != nil {
+			return nil, err
+		}
+		m.tracks = append(m.tracks, &trackTable{id: id, trak: trak, defaults: defaults[id]})
+	}
+	return m, nil
+}
+
+func (m *movie) track(id uint32) *trackTable {
+	for _, t := range m.tracks {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// trackRun is the samples of a trun waiting for the whole moof to be read
+type trackRun struct {
+	t         *trackTable
+	startTime uint64
+	hasStart  bool
+	src       int64
+	size      int64
+	sizes     []uint32
+	durations []uint32
+	ctos      []int32
+	flags     []uint32
+}
+
+// readMoof add the samples of the moof box at offset, it returns
+// errTruncated when their data goes past the end of the file
+func (m *movie) readMoof(data []byte, offset, fileSize int64) error {
+	atoms, err := children(data)
+	if err != nil {
+		return err
+	}
+	var runs []*trackRun
+	for _, traf := range atoms {
+		if traf.typ != "traf" {
+			continue
+		}
+		boxes, err := children(traf.data)
+		if err != nil {
+			return err
+		}
+		tfhd, ok := find(boxes, "tfhd")
+		if !ok {
+			return errBoxInvalid
+		}
+		r := &reader{data: tfhd.data}
+		flags := r.u32() & 0xffffff
+		t := m.track(r.u32())
+		if t == nil {
+			return errNoTrack
+		}
+		base, d := offset, t.defaults
+		if flags&tfhdBaseOffset != 0 {
+			base = int64(r.u64())
+		}
+		if flags&tfhdDescIndex != 0 {
+			r.u32()
+		}
+		if flags&tfhdDuration != 0 {
+			d.duration = r.u32()
+		}
+		if flags&tfhdSize != 0 {
+			d.size = r.u32()
+		}
+		if flags&tfhdFlags != 0 {
+			d.flags = r.u32()
+		}
+		if r.err != nil {
+			return r.err
+		}
+
+		var startTime uint64
+		tfdt, hasStart := find(boxes, "tfdt")
+		if hasStart {
+			r := &reader{data: tfdt.data}
+			if r.u32()>>24 == 1 {
+				startTime = r.u64()
+			} else {
+				startTime = uint64(r.u32())
+			}
+			if r.err != nil {
+				return r.err
+			}
+		}
+
+		pos := base
+		for _, trun := range boxes {
+			if trun.typ != "trun" {
+				continue
+			}
+			run, err := readTrun(trun.data, t, d, base, pos)
+			if err != nil {
+				return err
+			}
+			run.startTime, run.hasStart = startTime, hasStart
+			pos = run.src + run.size
+			if pos > fileSize {
+				return errTruncated
+			}
+			runs = append(runs, run)
+		}
+	}
+
+	for _, run := range runs {
+		t := run.t
+		if !t.hasStart {
+			t.startTime, t.hasStart = run.startTime, run.hasStart
+		}
+		for i, flags := range run.flags {
+			if flags&sampleNonSync == 0 {
+				t.syncs = append(t.syncs, uint32(len(t.sizes)+i+1))
+			}
+		}
+		t.sizes = append(t.sizes, run.sizes...)
+		t.durations = append(t.durations, run.durations...)
+		t.ctos = append(t.ctos, run.ctos...)
+		c := &chunk{src: run.src, size: run.size, count: uint32(len(run.sizes))}
+		t.chunks = append(t.chunks, c)
+		m.chunks = append(m.chunks, c)
+	}
+	return nil
+}
+
+// readTrun read the samples of a trun, their data starts at pos unless the
+// trun has a data offset from base
+func readTrun(data []byte, t *trackTable, d sampleDefaults, base, pos int64) (*trackRun, error) {
+	r := &reader{data: data}
+	flags := r.u32() & 0xffffff
+	count := r.u32()
+	if flags&trunDataOffset != 0 {
+		pos = base + int64(int32(r.u32()))
+	}
+	firstFlags := d.flags
+	if flags&trunFirstFlags != 0 {
+		firstFlags = r.u32()
+	}
+	if r.err != nil || int(count) > len(data) {
+		return nil, errBoxInvalid
+	}
+	run := &trackRun{t: t, src: pos}
+	for i := uint32(0); i < count; i++ {
+		duration, size, sampleFlags, cto := d.duration, d.size, d.flags, int32(0)
+		if flags&trunDuration != 0 {
+			duration = r.u32()
+		}
+		if flags&trunSize != 0 {
+			size = r.u32()
+		}
+		if flags&trunFlags != 0 {
+			sampleFlags = r.u32()
+		} else if i == 0 {
+			sampleFlags = firstFlags
+		}
+		if flags&trunCTO != 0 {
+			cto = int32(r.u32())
+		}
+		run.durations = append(run.durations, duration)
+		run.sizes = append(run.sizes, size)
+		run.flags = append(run.flags, sampleFlags)
+		run.ctos = append(run.ctos, cto)
+		run.size += int64(size)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return run, nil
+}
+
+// write the progressive file, the samples are copied from src
+func (m *movie) write(w io.Writer, src io.ReaderAt) error {
+	ftyp := box("ftyp", []byte("isom"), u32(512), []byte("isomiso2avc1mp41"))
+	// chunk offsets are 64 bits, the moov size does not depend on them
+	moov, err := m.moov()
+	if err != nil {
+		return err
+	}
+	start := int64(len(ftyp)+len(moov)) + 16
+	offset := start
+	for _, c := range m.chunks {
+		c.dst = offset
+		offset += c.size
+	}
+	if moov, err = m.moov(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(ftyp)
+	bw.Write(moov)
+	bw.Write(u32(1))
+	bw.WriteString("mdat")
+	bw.Write(u64(uint64(offset - start + 16)))
+	for _, c := range m.chunks {
+		if _, err := io.Copy(bw, io.NewSectionReader(src, c.src, c.size)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (m *movie) moov() ([]byte, error) {
+	movieTimescale, err := headerField(m.mvhd)
+	if err != nil {
+		return nil, err
+	}
+	if movieTimescale == 0 {
+		return nil, errBoxInvalid
+	}
+	var movieDuration uint64
+	var traks [][]byte
+	for _, t := range m.tracks {
+		trak, duration, err := t.trakBox(movieTimescale)
+		if err != nil {
+			return nil, err
+		}
+		if duration > movieDuration {
+			movieDuration = duration
+		}
+		traks = append(traks, trak)
+	}
+	mvhd, err := withDuration(m.mvhd, 4, movieDuration)
+	if err != nil {
+		return nil, err
+	}
+	return box("moov", append([][]byte{box("mvhd", mvhd)}, traks...)...), nil
+}
+
+// trakBox return the trak box of t with its sample tables and its duration
+// in the movie timescale. A track starting after zero is delayed by an
+// edit list.
+func (t *trackTable) trakBox(movieTimescale uint32) ([]byte, uint64, error) {
+	mdia, ok := find(t.trak, "mdia")
+	if !ok {
+		return nil, 0, errNotContainer
+	}
+	mdiaBoxes, err := children(mdia.data)
+	if err != nil {
+		return nil, 0, err
+	}
+	mdhd, ok := find(mdiaBoxes, "mdhd")
+	if !ok {
+		return nil, 0, errNotContainer
+	}
+	timescale, err := headerField(mdhd.data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if timescale == 0 {
+		return nil, 0, errBoxInvalid
+	}
+	var mediaDuration uint64
+	for _, d := range t.durations {
+		mediaDuration += uint64(d)
+	}
+	delay := t.startTime * uint64(movieTimescale) / uint64(timescale)
+	duration := mediaDuration*uint64(movieTimescale)/uint64(timescale) + delay
+
+	var boxes [][]byte
+	for _, a := range t.trak {
+		switch a.typ {
+		case "tkhd":
+			tkhd, err := withDuration(a.data, 8, duration)
+			if err != nil {
+				return nil, 0, err
+			}
+			boxes = append(boxes, box("tkhd", tkhd))
+			if delay > 0 {
+				boxes = append(boxes, box("edts", fullBox("elst", 1, 0, u32(2),
+					u64(delay), u64(0xffffffffffffffff), u32(0x00010000),
+					u64(duration-delay), u64(0), u32(0x00010000))))
+			}
+		case "edts":
+		case "mdia":
+			b, err := t.mdiaBox(mdiaBoxes, mediaDuration)
+			if err != nil {
+				return nil, 0, err
+			}
+			boxes = append(boxes, b)
+		default:
+			boxes = append(boxes, box(a.typ, a.data))
+		}
+	}
+	return box("trak", boxes...), duration, nil
+}
+
+func (t *trackTable) mdiaBox(mdia []atom, duration uint64) ([]byte, error) {
+	var boxes [][]byte
+	for _, a := range mdia {
+		switch a.typ {
+		case "mdhd":
+			mdhd, err := withDuration(a.data, 4, duration)
+			if err != nil {
+				return nil, err
+			}
+			boxes = append(boxes, box("mdhd", mdhd))
+		case "minf":
+			minf, err := children(a.data)
+			if err != nil {
+				return nil, err
+			}
+			var minfBoxes [][]byte
+			for _, b := range minf {
+				if b.typ != "stbl" {
+					minfBoxes = append(minfBoxes, box(b.typ, b.data))
+					continue
+				}
+				stbl, err := t.stblBox(b.data)
+				if err != nil {
+					return nil, err
+				}
+				minfBoxes = append(minfBoxes, stbl)
+			}
+			boxes = append(boxes, box("minf", minfBoxes...))
+		default:
+			boxes = append(boxes, box(a.typ, a.data))
+		}
+	}
+	return box("mdia", boxes...), nil
+}
+
+func (t *trackTable) stblBox(data []byte) ([]byte, error) {
+	stbl, err := children(data)
+	if err != nil {
+		return nil, err
+	}
+	stsd, ok := find(stbl, "stsd")
+	if !ok {
+		return nil, errNotContainer
+	}
+	boxes := [][]byte{box("stsd", stsd.data)}
+
+	var stts [][]byte
+	for i, n := 0, 0; i < len(t.durations); i += n {
+		for n = 1; i+n < len(t.durations) && t.durations[i+n] == t.durations[i]; n++ {
+		}
+		stts = append(stts, u32(uint32(n)), u32(t.durations[i]))
+	}
+	boxes = append(boxes, fullBox("stts", 0, 0, append([][]byte{u32(uint32(len(stts) / 2))}, stts...)...))
+
+	var ctts [][]byte
+	version, offsets := byte(0), false
+	for i, n := 0, 0; i < len(t.ctos); i += n {
+		for n = 1; i+n < len(t.ctos) && t.ctos[i+n] == t.ctos[i]; n++ {
+		}
+		ctts = append(ctts, u32(uint32(n)), u32(uint32(t.ctos[i])))
+		offsets = offsets || t.ctos[i] != 0
+		if t.ctos[i] < 0 {
+			version = 1
+		}
+	}
+	if offsets {
+		boxes = append(boxes, fullBox("ctts", version, 0, append([][]byte{u32(uint32(len(ctts) / 2))}, ctts...)...))
+	}
+
+	if len(t.syncs) < len(t.sizes) {
+		stss := [][]byte{u32(uint32(len(t.syncs)))}
+		for _, s := range t.syncs {
+			stss = append(stss, u32(s))
+		}
+		boxes = append(boxes, fullBox("stss", 0, 0, stss...))
+	}
+
+	var stsc [][]byte
+	for i, c := range t.chunks {
+		if i == 0 || c.count != t.chunks[i-1].count {
+			stsc = append(stsc, u32(uint32(i+1)), u32(c.count), u32(1))
+		}
+	}
+	boxes = append(boxes, fullBox("stsc", 0, 0, append([][]byte{u32(uint32(len(stsc) / 3))}, stsc...)...))
+
+	stsz := [][]byte{u32(0), u32(uint32(len(t.sizes)))}
+	for _, s := range t.sizes {
+		stsz = append(stsz, u32(s))
+	}
+	boxes = append(boxes, fullBox("stsz", 0, 0, stsz...))
+
+	co64 := [][]byte{u32(uint32(len(t.chunks)))}
+	for _, c := range t.chunks {
+		co64 = append(co64, u64(uint64(c.dst)))
+	}
+	boxes = append(boxes, fullBox("co64", 0, 0, co64...))
+	return box("stbl", boxes...), nil
+}
+
+// headerField return the field following the creation and modification
+// times of a mvhd, tkhd or mdhd payload, the timescale or the track ID
+func headerField(data []byte) (uint32, error) {
+	r := &reader{data: data}
+	if r.u32()>>24 == 1 {
+		r.pos += 16
+	} else {
+		r.pos += 8
+	}
+	v := r.u32()
+	return v, r.err
+}
+
+// withDuration return a mvhd, tkhd or mdhd payload with duration, midLen
+// bytes sit between the times and the duration. The box is made version 1
+// so that long recordings fit.
+func withDuration(data []byte, midLen int, duration uint64) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errBoxInvalid
+	}
+	timeLen := 4
+	if data[0] == 1 {
+		timeLen = 8
+	}
+	durationAt := 4 + 2*timeLen + midLen
+	if len(data) < durationAt+timeLen {
+		return nil, errBoxInvalid
+	}
+	time := func(pos int) []byte {
+		if timeLen == 4 {
+			return u64(uint64(binary.BigEndian.Uint32(data[pos:])))
+		}
+		return data[pos : pos+8]
+	}
+	out := []byte{1, data[1], data[2], data[3]}
+	out = append(out, time(4)...)
+	out = append(out, time(4+timeLen)...)
+	out = append(out, data[4+2*timeLen:durationAt]...)
+	out = append(out, u64(duration)...)
+	return append(out, data[durationAt+timeLen:]...), nil
+}
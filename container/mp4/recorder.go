@@ -0,0 +1,243 @@
+package mp4
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/fmp4"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// longest fragment, a crash loses at most the fragment being written
+	fragmentDuration = 2000 // ms
+)
+
+// Recorder write a stream to a fragmented MP4 file, which stays playable
+// up to its last fragment if livego stops without closing it. With
+// faststart the file is remuxed to a progressive MP4 once closed.
+type Recorder struct {
+	Uid string
+	av.RWBaser
+	app, title, url string
+	lock            sync.Mutex
+	file            *os.File
+	muxer           *fmp4.Muxer
+	demuxer         *flv.Demuxer
+	faststart       bool
+	started         bool
+	hasVideo        bool
+	unsupported     bool
+	base            uint32
+	fragmentStart   uint32
+	lastTimestamp   uint32
+	closedWriter    bool
+	closed          chan struct{}
+}
+
+func NewRecorder(app, title, url string, file *os.File, faststart bool) *Recorder {
+	return &Recorder{
+		Uid:       uid.NewId(),
+		app:       app,
+		title:     title,
+		url:       url,
+		file:      file,
+		muxer:     fmp4.NewMuxer(),
+		demuxer:   flv.NewDemuxer(),
+		faststart: faststart,
+		RWBaser:   av.NewRWBaser(time.Second * 10),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Name return the path of the recorded file
+func (writer *Recorder) Name() string {
+	return writer.file.Name()
+}
+
+func (writer *Recorder) Write(p *av.Packet) error {
+	writer.RWBaser.SetPreTime()
+	if p.IsMetadata {
+		return nil
+	}
+	typeID := av.TAG_VIDEO
+	if !p.IsVideo {
+		typeID = av.TAG_AUDIO
+	}
+	timestamp := p.TimeStamp + writer.BaseTimeStamp()
+	writer.RWBaser.RecTimeStamp(timestamp, uint32(typeID))
+
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.closedWriter {
+		return nil
+	}
+	pkt := *p
+	if err := writer.demuxer.Demux(&pkt); err == flv.ErrAvcEndSEQ {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pkt.TimeStamp = timestamp
+	return writer.mux(&pkt)
+}
+
+func (writer *Recorder) mux(p *av.Packet) error {
+	keyframe := false
+	if p.IsVideo {
+		vh := p.Header.(av.VideoPacketHeader)
+		if vh.IsExHeader() && vh.PacketType() == av.PKT_METADATA {
+			return nil
+		}
+		if vh.IsSeq() {
+			writer.hasVideo = true
+			writer.configure(p)
+			return nil
+		}
+		keyframe = vh.IsKeyFrame()
+	} else {
+		ah := p.Header.(av.AudioPacketHeader)
+		if !writer.configure(p) {
+			return nil
+		}
+		if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+			return nil
+		}
+	}
+
+	// the file starts on a video key frame, audio only streams start on
+	// their first frame
+	if !writer.started {
+		if writer.hasVideo && !keyframe {
+			return nil
+		}
+		writer.started = true
+		writer.base = p.TimeStamp
+		if _, err := writer.file.Write(writer.muxer.InitSegment()); err != nil {
+			return err
+		}
+	}
+	if p.TimeStamp < writer.base {
+		p.TimeStamp = 0
+	} else {
+		p.TimeStamp -= writer.base
+	}
+	if keyframe || p.TimeStamp-writer.fragmentStart >= fragmentDuration {
+		if err := writer.fragment(p.TimeStamp); err != nil {
+			return err
+		}
+	}
+	if p.TimeStamp > writer.lastTimestamp {
+		writer.lastTimestamp = p.TimeStamp
+	}
+	return writer.muxer.WritePacket(p)
+}
+
+// configure pass the codec configuration of p to the muxer, it return false
+// for a codec which cannot be recorded
+func (writer *Recorder) configure(p *av.Packet) bool {
+	changed, err := writer.muxer.Configure(p)
+	if err != nil {
+		if !writer.unsupported {
+			log.Warningf("mp4 recorder %s: %v", writer.Name(), err)
+			writer.unsupported = true
+		}
+		return false
+	}
+	if changed && writer.started {
+		log.Warningf("mp4 recorder %s: codec configuration changed, the file keeps the first one", writer.Name())
+	}
+	return true
+}
+
+// fragment write the samples buffered until timestamp
+func (writer *Recorder) fragment(timestamp uint32) error {
+	writer.fragmentStart = timestamp
+	if data := writer.muxer.Fragment(timestamp); data != nil {
+		if _, err := writer.file.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait until the file is closed and remuxed
+func (writer *Recorder) Wait() {
+	<-writer.closed
+}
+
+func (writer *Recorder) Close(error) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.closedWriter {
+		return
+	}
+	writer.closedWriter = true
+	if writer.started {
+		if err := writer.fragment(writer.lastTimestamp); err != nil {
+			log.Warning("write mp4 fragment error: ", err)
+		}
+	}
+	writer.file.Close()
+
+	name, started := writer.Name(), writer.started
+	go func() {
+		defer close(writer.closed)
+		if !started {
+			// nothing was recorded, an empty file is no MP4
+			os.Remove(name)
+			return
+		}
+		if writer.faststart {
+			if err := Faststart(name); err != nil {
+				log.Warningf("mp4 faststart %s error: %v", name, err)
+				return
+			}
+		}
+		log.Debug("mp4 recorder closed: ", name)
+	}()
+}
+
+func (writer *Recorder) Info() (ret av.Info) {
+	ret.UID = writer.Uid
+	ret.URL = writer.url
+	ret.Key = writer.app + "/" + writer.title
+	return
+}
+
+type Mp4Dvr struct{}
+
+func (f *Mp4Dvr) GetWriter(info av.Info) av.WriteCloser {
+	paths := strings.SplitN(info.Key, "/", 2)
+	if len(paths) != 2 {
+		log.Warning("invalid info")
+		return nil
+	}
+
+	flvDir := configure.Config.GetString("flv_dir")
+
+	err := os.MkdirAll(path.Join(flvDir, paths[0]), 0755)
+	if err != nil {
+		log.Error("mkdir error: ", err)
+		return nil
+	}
+
+	w, err := container.CreateArchive(path.Join(flvDir, info.Key), "mp4", time.Now())
+	if err != nil {
+		log.Error("open file error: ", err)
+		return nil
+	}
+
+	writer := NewRecorder(paths[0], paths[1], info.URL, w, configure.Config.GetBool("mp4_faststart"))
+	log.Debug("new mp4 dvr: ", writer.Info())
+	return writer
+}
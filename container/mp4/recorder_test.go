@@ -0,0 +1,161 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var avcRecord = []byte{0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0,
+	0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+	0x60, 0xc6, 0x58, 0x01, 0x00, 0x04, 0x68, 0xeb, 0xe3, 0xcb,
+}
+
+func record(t *testing.T, faststart bool) string {
+	f, err := ioutil.TempFile("", "mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewRecorder("live", "movie", "", f, faststart)
+	packets := []*av.Packet{
+		{IsVideo: true, Data: append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcRecord...)},
+		{IsAudio: true, Data: []byte{0xaf, 0x00, 0x12, 0x10}},
+		// dropped until the first key frame
+		{IsVideo: true, TimeStamp: 960, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x01}},
+		{IsVideo: true, TimeStamp: 1000, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xaa, 0xbb}},
+		{IsAudio: true, TimeStamp: 1000, Data: []byte{0xaf, 0x01, 0xcc}},
+		{IsVideo: true, TimeStamp: 1040, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xdd}},
+		{IsAudio: true, TimeStamp: 1023, Data: []byte{0xaf, 0x01, 0xee}},
+		{IsVideo: true, TimeStamp: 3000, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xa1, 0xb1}},
+		{IsVideo: true, TimeStamp: 3040, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xd1}},
+	}
+	for _, p := range packets {
+		if err := writer.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close(nil)
+	writer.Wait()
+	return f.Name()
+}
+
+// words return the big endian bytes of the 32 bits fields v
+func words(v ...uint32) []byte {
+	var b []byte
+	for _, w := range v {
+		b = append(b, u32(w)...)
+	}
+	return b
+}
+
+// topBoxes return the types of the boxes of a file
+func topBoxes(t *testing.T, b []byte) []string {
+	var types []string
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		if size == 1 {
+			size = binary.BigEndian.Uint64(b[8:])
+		}
+		types = append(types, string(b[4:8]))
+		b = b[size:]
+	}
+	return types
+}
+
+// sampleTable return the stbl boxes of the track handled by handler
+func sampleTable(t *testing.T, b []byte, handler string) map[string][]byte {
+	top, err := children(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moov, _ := find(top, "moov")
+	traks, _ := children(moov.data)
+	for _, trak := range traks {
+		if trak.typ != "trak" {
+			continue
+		}
+		boxes, _ := children(trak.data)
+		mdia, _ := find(boxes, "mdia")
+		boxes, _ = children(mdia.data)
+		if hdlr, _ := find(boxes, "hdlr"); string(hdlr.data[8:12]) != handler {
+			continue
+		}
+		minf, _ := find(boxes, "minf")
+		boxes, _ = children(minf.data)
+		stbl, _ := find(boxes, "stbl")
+		boxes, _ = children(stbl.data)
+		table := make(map[string][]byte)
+		for _, a := range boxes {
+			table[a.typ] = a.data
+		}
+		return table
+	}
+	t.Fatalf("no %s track", handler)
+	return nil
+}
+
+func TestRecorderFragmented(t *testing.T) {
+	at := assert.New(t)
+	name := record(t, false)
+	defer os.Remove(name)
+
+	b, err := ioutil.ReadFile(name)
+	at.Equal(nil, err)
+	// the second fragment starts on the second key frame
+	at.Equal([]string{"ftyp", "moov", "moof", "mdat", "moof", "mdat"}, topBoxes(t, b))
+}
+
+func TestRecorderFaststart(t *testing.T) {
+	at := assert.New(t)
+	name := record(t, true)
+	defer os.Remove(name)
+
+	b, err := ioutil.ReadFile(name)
+	at.Equal(nil, err)
+	at.Equal([]string{"ftyp", "moov", "mdat"}, topBoxes(t, b))
+
+	video := sampleTable(t, b, "vide")
+	at.Equal(words(0, 4), video["stsz"][4:12])
+	// samples 1 and 3 are the key frames
+	at.Equal(words(2, 1, 3), video["stss"][4:])
+	// each track run is a chunk holding its samples
+	at.Equal(words(1, 1, 2, 1), video["stsc"][4:])
+	at.Equal(words(2), video["co64"][4:8])
+	first := binary.BigEndian.Uint64(video["co64"][8:])
+	at.Equal([]byte{0xaa, 0xbb, 0xdd}, b[first:first+3])
+	second := binary.BigEndian.Uint64(video["co64"][16:])
+	at.Equal([]byte{0xa1, 0xb1, 0xd1}, b[second:second+3])
+	// 40ms, 1960ms then 40ms twice at 90kHz
+	at.Equal(words(3, 1, 40*90, 1, 1960*90, 2, 40*90), video["stts"][4:])
+
+	audio := sampleTable(t, b, "soun")
+	at.Equal(words(0, 2), audio["stsz"][4:12])
+	at.Nil(audio["stss"])
+	offset := binary.BigEndian.Uint64(audio["co64"][8:])
+	at.Equal([]byte{0xcc, 0xee}, b[offset:offset+2])
+}
+
+func TestFaststartTruncated(t *testing.T) {
+	at := assert.New(t)
+	name := record(t, false)
+	defer os.Remove(name)
+
+	// a crash in the middle of the last fragment
+	b, err := ioutil.ReadFile(name)
+	at.Equal(nil, err)
+	at.Equal(nil, ioutil.WriteFile(name, b[:len(b)-2], 0644))
+
+	at.Equal(nil, Faststart(name))
+	b, err = ioutil.ReadFile(name)
+	at.Equal(nil, err)
+	video := sampleTable(t, b, "vide")
+	at.Equal(words(0, 2), video["stsz"][4:12])
+	at.True(bytes.HasSuffix(b, []byte{0xaa, 0xbb, 0xdd, 0xcc, 0xee}))
+}
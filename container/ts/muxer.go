@@ -6,29 +6,123 @@ import (
 	"github.com/gwuhaolin/livego/av"
 )
 
+// ID3 timed metadata descriptors of the HLS timed metadata specification,
+// metadata_pointer_descriptor in the program info and metadata_descriptor
+// in the ES info
+var (
+	id3PointerDescriptor = []byte{0x25, 0x0f, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ',
+		0x00, 0x1f, 0x00, 0x01}
+	id3Descriptor = []byte{0x26, 0x0d, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ',
+		0x00, 0x0f}
+)
+
 const (
 	tsDefaultDataLen = 184
 	tsPacketLen      = 188
 	h264DefaultHZ    = 90
 
-	videoPID = 0x100
-	audioPID = 0x101
-	videoSID = 0xe0
-	audioSID = 0xc0
+	videoPID    = 0x100
+	audioPID    = 0x101
+	metadataPID = 0x102
+	videoSID    = 0xe0
+	audioSID    = 0xc0
+	// private_stream_1
+	metadataSID = 0xbd
+
+	streamTypeMP3  = 0x03
+	streamTypeMP2  = 0x04
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+	streamTypeHEVC = 0x24
+	// metadata carried in PES packets
+	streamTypeMetadata = 0x15
+
+	// SAMPLE-AES stream types of the HLS sample encryption specification
+	streamTypeSampleAESH264 = 0xdb
+	streamTypeSampleAESAAC  = 0xcf
 )
 
 type Muxer struct {
-	videoCc  byte
-	audioCc  byte
-	patCc    byte
-	pmtCc    byte
-	pat      [tsPacketLen]byte
-	pmt      [tsPacketLen]byte
-	tsPacket [tsPacketLen]byte
+	videoType byte
+	audioType byte
+	pcrPID    int
+	videoCc   byte
+	audioCc   byte
+	metaCc    byte
+	patCc     byte
+	pmtCc     byte
+	sampleAES bool
+	audioConf []byte
+	metadata  bool
+	pat       [tsPacketLen]byte
+	pmt       [tsPacketLen]byte
+	tsPacket  [tsPacketLen]byte
 }
 
 func NewMuxer() *Muxer {
-	return &Muxer{}
+	return &Muxer{
+		videoType: streamTypeH264,
+		pcrPID:    videoPID,
+	}
+}
+
+// SetAudioCodec select the PMT stream type of the audio, MP3 at MPEG-1 sample
+// rates is announced as 0x03 and the MPEG-2 lower sample rates as 0x04
+func (muxer *Muxer) SetAudioCodec(soundFormat uint8, sampleRate int) {
+	switch soundFormat {
+	case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
+		if sampleRate >= 32000 {
+			muxer.audioType = streamTypeMP3
+		} else {
+			muxer.audioType = streamTypeMP2
+		}
+	default:
+		muxer.audioType = streamTypeAAC
+	}
+}
+
+// SetVideoCodec select the PMT stream type of the video, see av.VIDEO_H264
+func (muxer *Muxer) SetVideoCodec(codecID uint8) {
+	switch codecID {
+	case av.VIDEO_HEVC:
+		muxer.videoType = streamTypeHEVC
+	default:
+		muxer.videoType = streamTypeH264
+	}
+}
+
+// SetSampleAES announce H.264 and AAC as SAMPLE-AES encrypted streams,
+// audioConfig is the AudioSpecificConfig carried in the audio setup
+// information of the PMT
+func (muxer *Muxer) SetSampleAES(enable bool, audioConfig []byte) {
+	muxer.sampleAES = enable
+	muxer.audioConf = audioConfig
+}
+
+// SetMetadata announce the ID3 timed metadata stream, metadata packets
+// are muxed on its PID
+func (muxer *Muxer) SetMetadata(enable bool) {
+	muxer.metadata = enable
+}
+
+// esInfo return the PMT stream type and descriptors of an elementary stream
+func (muxer *Muxer) esInfo(streamType byte) (byte, []byte) {
+	if !muxer.sampleAES {
+		return streamType, nil
+	}
+	switch streamType {
+	case streamTypeH264:
+		// private_data_indicator_descriptor
+		return streamTypeSampleAESH264, []byte{0x0f, 0x04, 'z', 'a', 'v', 'c'}
+	case streamTypeAAC:
+		desc := []byte{0x0f, 0x04, 'a', 'a', 'c', 'd'}
+		// registration_descriptor with the audio setup information
+		desc = append(desc, 0x05, byte(12+len(muxer.audioConf)), 'a', 'p', 'a', 'd',
+			'z', 'a', 'a', 'c', 0x00, 0x00, 0x01, byte(len(muxer.audioConf)))
+		desc = append(desc, muxer.audioConf...)
+		return streamTypeSampleAESAAC, desc
+	}
+	return streamType, nil
 }
 
 func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
@@ -41,12 +135,14 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 	var pes pesHeader
 	dts := int64(p.TimeStamp) * int64(h264DefaultHZ)
 	pts := dts
-	pid := audioPID
+	pid, cc := audioPID, &muxer.audioCc
 	var videoH av.VideoPacketHeader
 	if p.IsVideo {
-		pid = videoPID
+		pid, cc = videoPID, &muxer.videoCc
 		videoH, _ = p.Header.(av.VideoPacketHeader)
 		pts = dts + int64(videoH.CompositionTime())*int64(h264DefaultHZ)
+	} else if p.IsMetadata {
+		pid, cc = metadataPID, &muxer.metaCc
 	}
 	err := pes.packet(p, pts, dts)
 	if err != nil {
@@ -59,16 +155,9 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		if packetBytesLen <= 0 {
 			break
 		}
-		if p.IsVideo {
-			muxer.videoCc++
-			if muxer.videoCc > 0xf {
-				muxer.videoCc = 0
-			}
-		} else {
-			muxer.audioCc++
-			if muxer.audioCc > 0xf {
-				muxer.audioCc = 0
-			}
+		*cc++
+		if *cc > 0xf {
+			*cc = 0
 		}
 
 		i := byte(0)
@@ -89,15 +178,11 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		i++
 
 		//scram control, adaptation control, counter
-		if p.IsVideo {
-			muxer.tsPacket[i] = 0x10 | byte(muxer.videoCc&0x0f)
-		} else {
-			muxer.tsPacket[i] = 0x10 | byte(muxer.audioCc&0x0f)
-		}
+		muxer.tsPacket[i] = 0x10 | byte(*cc&0x0f)
 		i++
 
-		//关键帧需要加pcr
-		if first && p.IsVideo && videoH.IsKeyFrame() {
+		//关键帧需要加pcr, audio only streams carry it on every audio pes
+		if first && pid == muxer.pcrPID && !p.IsMetadata && (!p.IsVideo || videoH.IsKeyFrame()) {
 			muxer.tsPacket[3] |= 0x20
 			muxer.tsPacket[i] = 7
 			i++
@@ -195,22 +280,47 @@ func (muxer *Muxer) PAT() []byte {
 	return muxer.pat[0:]
 }
 
-// PMT return pmt data
-func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
+// PMT return pmt data announcing the audio and video tracks and the timed
+// metadata, the PCR is carried by the video or by the audio of audio only
+// streams
+func (muxer *Muxer) PMT(soundFormat byte, hasAudio, hasVideo bool) []byte {
 	i := int(0)
 	j := int(0)
 	var progInfo []byte
 	remainBytes := int(0)
 	tsHeader := []byte{0x47, 0x50, 0x01, 0x10, 0x00}
 	pmtHeader := []byte{0x02, 0xb0, 0xff, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
-	if !hasVideo {
-		pmtHeader[9] = 0x01
-		progInfo = []byte{0x0f, 0xe1, 0x01, 0xf0, 0x00}
-	} else {
-		progInfo = []byte{0x1b, 0xe1, 0x00, 0xf0, 0x00, //h264 or h265*
-			0x0f, 0xe1, 0x01, 0xf0, 0x00, //mp3 or aac
+
+	audioType := muxer.audioType
+	if audioType == 0 {
+		audioType = streamTypeAAC
+		if soundFormat == av.SOUND_MP3 ||
+			soundFormat == av.SOUND_MP3_8KHZ {
+			audioType = streamTypeMP2
 		}
 	}
+	if muxer.metadata {
+		progInfo = append(progInfo, id3PointerDescriptor...)
+		pmtHeader[11] = byte(len(id3PointerDescriptor))
+	}
+	if hasVideo || !hasAudio {
+		muxer.pcrPID = videoPID
+		videoType, desc := muxer.esInfo(muxer.videoType)
+		progInfo = append(progInfo, videoType, 0xe1, 0x00, 0xf0, byte(len(desc))) //h264 or h265
+		progInfo = append(progInfo, desc...)
+	} else {
+		muxer.pcrPID = audioPID
+		pmtHeader[9] = 0x01
+	}
+	if hasAudio {
+		audioType, desc := muxer.esInfo(audioType)
+		progInfo = append(progInfo, audioType, 0xe1, 0x01, 0xf0, byte(len(desc))) //mp3 or aac
+		progInfo = append(progInfo, desc...)
+	}
+	if muxer.metadata {
+		progInfo = append(progInfo, streamTypeMetadata, 0xe1, 0x02, 0xf0, byte(len(id3Descriptor)))
+		progInfo = append(progInfo, id3Descriptor...)
+	}
 	pmtHeader[2] = byte(len(progInfo) + 9 + 4)
 
 	if muxer.pmtCc > 0xf {
@@ -219,15 +329,6 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	tsHeader[3] |= muxer.pmtCc & 0x0f
 	muxer.pmtCc++
 
-	if soundFormat == 2 ||
-		soundFormat == 14 {
-		if hasVideo {
-			progInfo[5] = 0x4
-		} else {
-			progInfo[0] = 0x4
-		}
-	}
-
 	copy(muxer.pmt[i:], tsHeader)
 	i += len(tsHeader)
 
@@ -300,8 +401,13 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 	i++
 
 	sid := audioSID
+	// data_alignment_indicator, an ID3 tag starts each metadata packet
+	alignment := byte(0x80)
 	if p.IsVideo {
 		sid = videoSID
+	} else if p.IsMetadata {
+		sid = metadataSID
+		alignment = 0x84
 	}
 	header.data[i] = byte(sid)
 	i++
@@ -323,7 +429,7 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 	header.data[i] = byte(size)
 	i++
 
-	header.data[i] = 0x80
+	header.data[i] = alignment
 	i++
 	header.data[i] = byte(flag)
 	i++
@@ -51,3 +51,79 @@ func TestTSEncoder(t *testing.T) {
 		0x80, 0x00, 0x5b, 0xb7, 0x78, 0x00, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x38, 0x30, 0x00,
 		0x06, 0x00, 0x38})
 }
+
+func TestPMTStreamType(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+
+	pmt := m.PMT(av.SOUND_AAC, true, true)
+	at.Equal(byte(streamTypeH264), pmt[17])
+	at.Equal(byte(streamTypeAAC), pmt[22])
+
+	m.SetVideoCodec(av.VIDEO_HEVC)
+	m.SetAudioCodec(av.SOUND_MP3, 44100)
+	pmt = m.PMT(av.SOUND_MP3, true, true)
+	at.Equal(byte(streamTypeHEVC), pmt[17])
+	at.Equal(byte(streamTypeMP3), pmt[22])
+
+	m.SetAudioCodec(av.SOUND_MP3, 22050)
+	pmt = m.PMT(av.SOUND_MP3, true, false)
+	at.Equal(byte(streamTypeMP2), pmt[17])
+	at.Equal(byte(0x01), pmt[14])
+	at.Equal(audioPID, m.pcrPID)
+
+	// video only streams omit the audio pid
+	pmt = m.PMT(0, false, true)
+	at.Equal(byte(streamTypeHEVC), pmt[17])
+	at.Equal(byte(0xff), pmt[26])
+	at.Equal(videoPID, m.pcrPID)
+}
+
+func TestPMTSampleAES(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	m.SetAudioCodec(av.SOUND_AAC, 44100)
+	m.SetSampleAES(true, []byte{0x12, 0x10})
+
+	pmt := m.PMT(av.SOUND_AAC, true, true)
+	at.Equal(byte(streamTypeSampleAESH264), pmt[17])
+	at.Equal([]byte{0x0f, 0x04, 'z', 'a', 'v', 'c'}, pmt[22:28])
+	at.Equal(byte(streamTypeSampleAESAAC), pmt[28])
+	at.Equal(byte(6+16), pmt[32])
+	at.Equal([]byte{'a', 'p', 'a', 'd', 'z', 'a', 'a', 'c', 0x00, 0x00, 0x01, 0x02, 0x12, 0x10}, pmt[41:55])
+	// the section length cover both streams and their descriptors
+	at.Equal(byte(9+5+6+5+22+4), pmt[7])
+	crc := GenCrc32(pmt[5:55])
+	at.Equal([]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}, pmt[55:59])
+}
+
+func TestMuxMetadata(t *testing.T) {
+	at := assert.New(t)
+	m := NewMuxer()
+	m.SetMetadata(true)
+
+	pmt := m.PMT(av.SOUND_AAC, true, true)
+	// program info length and the metadata pointer descriptor
+	at.Equal(byte(len(id3PointerDescriptor)), pmt[16])
+	at.Equal(id3PointerDescriptor, pmt[17:34])
+	at.Equal(byte(streamTypeMetadata), pmt[44])
+	at.Equal([]byte{0xe1, 0x02, 0xf0, 0x0f}, pmt[45:49])
+	at.Equal(id3Descriptor, pmt[49:64])
+	at.Equal(byte(9+17+5+5+5+15+4), pmt[7])
+	crc := GenCrc32(pmt[5:64])
+	at.Equal([]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}, pmt[64:68])
+
+	w := &TestWriter{}
+	p := av.Packet{
+		IsMetadata: true,
+		TimeStamp:  1000,
+		Data:       []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	}
+	at.Equal(nil, m.Mux(&p, w))
+	at.Equal(1, w.count)
+	at.Equal([]byte{0x47, 0x41, 0x02}, w.buf[:3])
+	// no PCR on the metadata PID, the PES is a private stream with a PTS
+	pes := w.buf[tsPacketLen-len(p.Data)-14:]
+	at.Equal([]byte{0x00, 0x00, 0x01, 0xbd, 0x00, 0x12, 0x84, 0x80, 0x05}, pes[:9])
+	at.Equal(p.Data, pes[14:])
+}
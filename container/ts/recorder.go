@@ -0,0 +1,227 @@
+package ts
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/parser"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PAT and PMT interval of audio only streams, video streams repeat them
+	// before each key frame
+	tableInterval = 1000 // ms
+)
+
+// Recorder write a stream to a single MPEG-TS file
+type Recorder struct {
+	Uid string
+	av.RWBaser
+	app, title, url string
+	lock            sync.Mutex
+	file            *os.File
+	w               *bufio.Writer
+	muxer           *Muxer
+	parser          *parser.CodecParser
+	demuxer         *flv.Demuxer
+	buf             *bytes.Buffer
+	hasVideo        bool
+	hasAudio        bool
+	soundFormat     byte
+	started         bool
+	base            uint32
+	hasTables       bool
+	tableTimestamp  uint32
+	closedWriter    bool
+}
+
+func NewRecorder(app, title, url string, file *os.File) *Recorder {
+	return &Recorder{
+		Uid:     uid.NewId(),
+		app:     app,
+		title:   title,
+		url:     url,
+		file:    file,
+		w:       bufio.NewWriter(file),
+		muxer:   NewMuxer(),
+		parser:  parser.NewCodecParser(),
+		demuxer: flv.NewDemuxer(),
+		buf:     bytes.NewBuffer(nil),
+		RWBaser: av.NewRWBaser(time.Second * 10),
+	}
+}
+
+// Name return the path of the recorded file
+func (writer *Recorder) Name() string {
+	return writer.file.Name()
+}
+
+func (writer *Recorder) Write(p *av.Packet) error {
+	writer.RWBaser.SetPreTime()
+	if p.IsMetadata {
+		return nil
+	}
+	typeID := av.TAG_VIDEO
+	if !p.IsVideo {
+		typeID = av.TAG_AUDIO
+	}
+	timestamp := p.TimeStamp + writer.BaseTimeStamp()
+	writer.RWBaser.RecTimeStamp(timestamp, uint32(typeID))
+
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.closedWriter {
+		return nil
+	}
+	pkt := *p
+	if err := writer.demuxer.Demux(&pkt); err == flv.ErrAvcEndSEQ {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pkt.TimeStamp = timestamp
+	return writer.mux(&pkt)
+}
+
+func (writer *Recorder) mux(p *av.Packet) error {
+	keyframe := false
+	if p.IsVideo {
+		vh := p.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VIDEO_H264 && vh.CodecID() != av.VIDEO_HEVC {
+			return nil
+		}
+		if vh.IsExHeader() && vh.PacketType() == av.PKT_METADATA {
+			return nil
+		}
+		if vh.IsSeq() {
+			if err := writer.parser.Parse(p, writer.buf); err != nil {
+				return err
+			}
+			writer.hasVideo = true
+			writer.muxer.SetVideoCodec(vh.CodecID())
+			return nil
+		}
+		keyframe = vh.IsKeyFrame()
+	} else {
+		ah := p.Header.(av.AudioPacketHeader)
+		switch ah.SoundFormat() {
+		case av.SOUND_AAC:
+			if ah.AACPacketType() == av.AAC_SEQHDR {
+				if err := writer.parser.Parse(p, writer.buf); err != nil {
+					return err
+				}
+				writer.setSoundFormat(av.SOUND_AAC)
+				return nil
+			}
+		case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
+		default:
+			return nil
+		}
+	}
+
+	if !writer.started {
+		if writer.hasVideo && !keyframe {
+			return nil
+		}
+		writer.started = true
+		writer.base = p.TimeStamp
+	}
+	writer.buf.Reset()
+	if err := writer.parser.Parse(p, writer.buf); err != nil {
+		return err
+	}
+	if p.IsAudio {
+		ah := p.Header.(av.AudioPacketHeader)
+		writer.setSoundFormat(ah.SoundFormat())
+	}
+	p.Data = writer.buf.Bytes()
+	if p.TimeStamp < writer.base {
+		p.TimeStamp = 0
+	} else {
+		p.TimeStamp -= writer.base
+	}
+
+	// players can join the file at any key frame
+	if keyframe || !writer.hasTables || (!writer.hasVideo && p.TimeStamp-writer.tableTimestamp >= tableInterval) {
+		writer.hasTables = true
+		writer.tableTimestamp = p.TimeStamp
+		if _, err := writer.w.Write(writer.muxer.PAT()); err != nil {
+			return err
+		}
+		if _, err := writer.w.Write(writer.muxer.PMT(writer.soundFormat, writer.hasAudio, writer.hasVideo)); err != nil {
+			return err
+		}
+	}
+	return writer.muxer.Mux(p, writer.w)
+}
+
+func (writer *Recorder) setSoundFormat(soundFormat byte) {
+	if writer.hasAudio && writer.soundFormat == soundFormat {
+		return
+	}
+	writer.hasAudio = true
+	writer.soundFormat = soundFormat
+	sampleRate, _ := writer.parser.SampleRate()
+	writer.muxer.SetAudioCodec(soundFormat, sampleRate)
+}
+
+func (writer *Recorder) Close(error) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.closedWriter {
+		return
+	}
+	writer.closedWriter = true
+	if err := writer.w.Flush(); err != nil {
+		log.Warning("write ts file error: ", err)
+	}
+	writer.file.Close()
+	log.Debug("ts recorder closed: ", writer.Name())
+}
+
+func (writer *Recorder) Info() (ret av.Info) {
+	ret.UID = writer.Uid
+	ret.URL = writer.url
+	ret.Key = writer.app + "/" + writer.title
+	return
+}
+
+type TsDvr struct{}
+
+func (f *TsDvr) GetWriter(info av.Info) av.WriteCloser {
+	paths := strings.SplitN(info.Key, "/", 2)
+	if len(paths) != 2 {
+		log.Warning("invalid info")
+		return nil
+	}
+
+	flvDir := configure.Config.GetString("flv_dir")
+
+	err := os.MkdirAll(path.Join(flvDir, paths[0]), 0755)
+	if err != nil {
+		log.Error("mkdir error: ", err)
+		return nil
+	}
+
+	w, err := container.CreateArchive(path.Join(flvDir, info.Key), "ts", time.Now())
+	if err != nil {
+		log.Error("open file error: ", err)
+		return nil
+	}
+
+	writer := NewRecorder(paths[0], paths[1], info.URL, w)
+	log.Debug("new ts dvr: ", writer.Info())
+	return writer
+}
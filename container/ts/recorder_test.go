@@ -0,0 +1,49 @@
+package ts
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	at := assert.New(t)
+	f, err := ioutil.TempFile("", "ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	avcRecord := []byte{0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x1b,
+		0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0,
+		0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+		0x60, 0xc6, 0x58, 0x01, 0x00, 0x04, 0x68, 0xeb, 0xe3, 0xcb,
+	}
+	writer := NewRecorder("live", "movie", "", f)
+	packets := []*av.Packet{
+		{IsVideo: true, Data: append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcRecord...)},
+		// dropped until the first key frame
+		{IsVideo: true, TimeStamp: 960, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x41}},
+		{IsVideo: true, TimeStamp: 1000, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x65}},
+		{IsVideo: true, TimeStamp: 1040, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x41}},
+	}
+	for _, p := range packets {
+		at.Equal(nil, writer.Write(p))
+	}
+	writer.Close(nil)
+
+	b, err := ioutil.ReadFile(f.Name())
+	at.Equal(nil, err)
+	at.Equal(0, len(b)%188)
+	// PAT, PMT then a packet for each of the two frames
+	at.Equal(4*188, len(b))
+	for i := 0; i < len(b); i += 188 {
+		at.Equal(byte(0x47), b[i])
+	}
+	// the key frame starts a PES of the video PID
+	at.Equal([]byte{0x41, 0x00}, b[2*188+1:2*188+3])
+}
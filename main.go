@@ -8,8 +8,10 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
 	"github.com/gwuhaolin/livego/protocol/api"
+	"github.com/gwuhaolin/livego/protocol/dash"
 	"github.com/gwuhaolin/livego/protocol/hls"
 	"github.com/gwuhaolin/livego/protocol/httpflv"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
@@ -39,7 +41,27 @@ func startHls() *hls.Server {
 	return hlsServer
 }
 
-func startRtmp(stream *rtmp.RtmpStream, hlsServer *hls.Server) {
+func startDash() *dash.Server {
+	dashAddr := configure.Config.GetString("dash_addr")
+	dashListen, err := net.Listen("tcp", dashAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dashServer := dash.NewServer()
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("DASH server panic: ", r)
+			}
+		}()
+		log.Info("DASH listen On ", dashAddr)
+		dashServer.Serve(dashListen)
+	}()
+	return dashServer
+}
+
+func startRtmp(stream *rtmp.RtmpStream, hlsServer *hls.Server, dashServer *dash.Server) {
 	rtmpAddr := configure.Config.GetString("rtmp_addr")
 	isRtmps := configure.Config.GetBool("enable_rtmps")
 
@@ -66,15 +88,18 @@ func startRtmp(stream *rtmp.RtmpStream, hlsServer *hls.Server) {
 		}
 	}
 
-	var rtmpServer *rtmp.Server
-
+	var getters []av.GetWriter
 	if hlsServer == nil {
-		rtmpServer = rtmp.NewRtmpServer(stream, nil)
 		log.Info("HLS server disable....")
 	} else {
-		rtmpServer = rtmp.NewRtmpServer(stream, hlsServer)
+		getters = append(getters, hlsServer)
 		log.Info("HLS server enable....")
 	}
+	if dashServer != nil {
+		getters = append(getters, dashServer)
+		log.Info("DASH server enable....")
+	}
+	rtmpServer := rtmp.NewRtmpServer(stream, getters...)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -109,7 +134,7 @@ func startHTTPFlv(stream *rtmp.RtmpStream) {
 	}()
 }
 
-func startAPI(stream *rtmp.RtmpStream) {
+func startAPI(stream *rtmp.RtmpStream, hlsServer *hls.Server) {
 	apiAddr := configure.Config.GetString("api_addr")
 	rtmpAddr := configure.Config.GetString("rtmp_addr")
 
@@ -118,7 +143,7 @@ func startAPI(stream *rtmp.RtmpStream) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		opServer := api.NewServer(stream, rtmpAddr)
+		opServer := api.NewServer(stream, hlsServer, rtmpAddr)
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
@@ -166,13 +191,17 @@ func main() {
 		if app.Hls {
 			hlsServer = startHls()
 		}
+		var dashServer *dash.Server
+		if app.Dash {
+			dashServer = startDash()
+		}
 		if app.Flv {
 			startHTTPFlv(stream)
 		}
 		if app.Api {
-			startAPI(stream)
+			startAPI(stream, hlsServer)
 		}
 
-		startRtmp(stream, hlsServer)
+		startRtmp(stream, hlsServer, dashServer)
 	}
 }
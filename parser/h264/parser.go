@@ -51,6 +51,7 @@ type Parser struct {
 	frameType    byte
 	specificInfo []byte
 	pps          *bytes.Buffer
+	captions     []byte
 }
 
 type sequenceHeader struct {
@@ -148,6 +149,7 @@ func (parser *Parser) getAnnexbH264(src []byte, w io.Writer) error {
 		return videoDataInvalid
 	}
 	parser.pps.Reset()
+	parser.captions = parser.captions[:0]
 	_, err := w.Write(naluAud)
 	if err != nil {
 		return err
@@ -186,6 +188,9 @@ func (parser *Parser) getAnnexbH264(src []byte, w io.Writer) error {
 			case nalu_type_slice:
 				fallthrough
 			case nalu_type_sei:
+				if nalType == nalu_type_sei {
+					parser.captions = append(parser.captions, seiCaptions(src[index:index+nalLen])...)
+				}
 				_, err := w.Write(startCode)
 				if err != nil {
 					return err
@@ -216,6 +221,12 @@ func (parser *Parser) getAnnexbH264(src []byte, w io.Writer) error {
 	return nil
 }
 
+// Captions return the cc_data triplets of the closed captions carried by
+// the SEI of the last frame parsed
+func (parser *Parser) Captions() []byte {
+	return parser.captions
+}
+
 func (parser *Parser) Parse(b []byte, isSeq bool, w io.Writer) (err error) {
 	switch isSeq {
 	case true:
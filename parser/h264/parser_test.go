@@ -90,3 +90,25 @@ func TestH264Mp4DemuxException2(t *testing.T) {
 	err := d.Parse(nalu, false, w)
 	at.Equal(err, naluBodyLenError)
 }
+
+func TestH264Captions(t *testing.T) {
+	at := assert.New(t)
+	cc := []byte{0xfc, 0x94, 0x20, 0xfc, 0xc8, 0xe9}
+	sei := []byte{0x06, 0x04, byte(10 + len(cc) + 1), 0xb5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03, 0x40 | 2, 0xff}
+	sei = append(sei, cc...)
+	sei = append(sei, 0xff, 0x80)
+	frame := []byte{0x00, 0x00, 0x00, byte(len(sei))}
+	frame = append(frame, sei...)
+	frame = append(frame, 0x00, 0x00, 0x00, 0x02, 0x41, 0x9a)
+
+	d := NewParser()
+	w := bytes.NewBuffer(nil)
+	at.Equal(nil, d.Parse(frame, false, w))
+	at.Equal(cc, d.Captions())
+
+	// frames without captions reset them
+	at.Equal(nil, d.Parse([]byte{0x00, 0x00, 0x00, 0x02, 0x41, 0x9a}, false, w))
+	at.Equal(0, len(d.Captions()))
+
+	at.Equal([]byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x03}, unescapeRBSP([]byte{0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x03, 0x03}))
+}
@@ -0,0 +1,83 @@
+package h264
+
+const (
+	seiUserDataRegistered byte = 4
+	// user data of the ATSC A/53 closed captions
+	ituT35CountryUSA  byte = 0xb5
+	ituT35ProviderA53      = 0x0031
+	a53CCDataType     byte = 0x03
+	rbspTrailingBits  byte = 0x80
+)
+
+var a53Identifier = []byte{'G', 'A', '9', '4'}
+
+// seiCaptions return the cc_data triplets of the A/53 closed captions
+// carried by the SEI NAL unit nalu
+func seiCaptions(nalu []byte) []byte {
+	rbsp := unescapeRBSP(nalu[1:])
+	var captions []byte
+	for i := 0; i < len(rbsp) && rbsp[i] != rbspTrailingBits; {
+		payloadType, n := seiValue(rbsp[i:])
+		i += n
+		payloadSize, n := seiValue(rbsp[i:])
+		i += n
+		if i+payloadSize > len(rbsp) {
+			break
+		}
+		if payloadType == int(seiUserDataRegistered) {
+			captions = append(captions, a53Captions(rbsp[i:i+payloadSize])...)
+		}
+		i += payloadSize
+	}
+	return captions
+}
+
+// seiValue read a payload type or size coded as a sum of bytes
+func seiValue(b []byte) (value, n int) {
+	for n < len(b) {
+		value += int(b[n])
+		n++
+		if b[n-1] != 0xff {
+			break
+		}
+	}
+	return
+}
+
+// a53Captions return the cc_data triplets of a user_data_registered_itu_t_t35
+// SEI payload
+func a53Captions(payload []byte) []byte {
+	if len(payload) < 10 || payload[0] != ituT35CountryUSA ||
+		int(payload[1])<<8|int(payload[2]) != ituT35ProviderA53 ||
+		string(payload[3:7]) != string(a53Identifier) || payload[7] != a53CCDataType {
+		return nil
+	}
+	// process_cc_data_flag
+	if payload[8]&0x40 == 0 {
+		return nil
+	}
+	end := 10 + 3*int(payload[8]&0x1f)
+	if end > len(payload) {
+		return nil
+	}
+	return payload[10:end]
+}
+
+// unescapeRBSP remove the emulation prevention bytes of a NAL unit payload
+func unescapeRBSP(b []byte) []byte {
+	rbsp := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, c)
+	}
+	return rbsp
+}
@@ -0,0 +1,185 @@
+package hevc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	nalu_type_bla_w_lp   byte = 16
+	nalu_type_rsv_irap23 byte = 23 // last IRAP type, 16..23 are random access points
+	nalu_type_vps        byte = 32
+	nalu_type_sps        byte = 33
+	nalu_type_pps        byte = 34
+	nalu_type_aud        byte = 35
+)
+
+const (
+	naluBytesLen int = 4
+	hvccHeadLen  int = 23
+	maxSpsPpsLen int = 2 * 1024
+)
+
+var (
+	decDataNil       = fmt.Errorf("dec buf is nil")
+	hvccDataError    = fmt.Errorf("hvcc data error")
+	videoDataInvalid = fmt.Errorf("video data not match")
+	dataSizeNotMatch = fmt.Errorf("data size not match")
+	naluBodyLenError = fmt.Errorf("nalu body len error")
+)
+
+var startCode = []byte{0x00, 0x00, 0x00, 0x01}
+var naluAud = []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+
+type Parser struct {
+	naluLen      int
+	specificInfo []byte
+	params       *bytes.Buffer
+}
+
+func NewParser() *Parser {
+	return &Parser{
+		naluLen: naluBytesLen,
+		params:  bytes.NewBuffer(make([]byte, maxSpsPpsLen)),
+	}
+}
+
+func naluType(b byte) byte {
+	return (b >> 1) & 0x3f
+}
+
+// parseSpecificInfo read the VPS, SPS and PPS out of a
+// HEVCDecoderConfigurationRecord (ISO/IEC 14496-15 8.3.3.1)
+func (parser *Parser) parseSpecificInfo(src []byte) error {
+	if len(src) < hvccHeadLen {
+		return decDataNil
+	}
+	parser.naluLen = int(src[21]&0x03) + 1
+
+	info := []byte{}
+	numArrays := int(src[22])
+	index := hvccHeadLen
+	for i := 0; i < numArrays; i++ {
+		if len(src) < index+3 {
+			return hvccDataError
+		}
+		nalType := src[index] & 0x3f
+		numNalus := int(src[index+1])<<8 | int(src[index+2])
+		index += 3
+		for j := 0; j < numNalus; j++ {
+			if len(src) < index+2 {
+				return hvccDataError
+			}
+			nalLen := int(src[index])<<8 | int(src[index+1])
+			index += 2
+			if len(src) < index+nalLen {
+				return hvccDataError
+			}
+			switch nalType {
+			case nalu_type_vps, nalu_type_sps, nalu_type_pps:
+				info = append(info, startCode...)
+				info = append(info, src[index:index+nalLen]...)
+			}
+			index += nalLen
+		}
+	}
+	if len(info) == 0 {
+		return hvccDataError
+	}
+	parser.specificInfo = info
+	return nil
+}
+
+func (parser *Parser) isNaluHeader(src []byte) bool {
+	if len(src) < naluBytesLen {
+		return false
+	}
+	return src[0] == 0x00 &&
+		src[1] == 0x00 &&
+		src[2] == 0x00 &&
+		src[3] == 0x01
+}
+
+func (parser *Parser) naluSize(src []byte) (int, error) {
+	if len(src) < parser.naluLen {
+		return 0, fmt.Errorf("nalusizedata invalid")
+	}
+	size := int(0)
+	for i := 0; i < parser.naluLen; i++ {
+		size = size<<8 + int(src[i])
+	}
+	return size, nil
+}
+
+// getAnnexbH265 convert length prefixed NAL units to Annex-B, inserting the
+// parameter sets in front of random access pictures which do not carry them
+func (parser *Parser) getAnnexbH265(src []byte, w io.Writer) error {
+	dataSize := len(src)
+	if dataSize < parser.naluLen {
+		return videoDataInvalid
+	}
+	parser.params.Reset()
+	if _, err := w.Write(naluAud); err != nil {
+		return err
+	}
+
+	index := 0
+	hasParams := false
+	hasWriteParams := false
+
+	for dataSize > 0 {
+		nalLen, err := parser.naluSize(src[index:])
+		if err != nil {
+			return dataSizeNotMatch
+		}
+		index += parser.naluLen
+		dataSize -= parser.naluLen
+		if dataSize < nalLen || len(src[index:]) < nalLen || nalLen <= 0 {
+			return naluBodyLenError
+		}
+		nalType := naluType(src[index])
+		switch {
+		case nalType == nalu_type_aud:
+		case nalType == nalu_type_vps || nalType == nalu_type_sps || nalType == nalu_type_pps:
+			hasParams = true
+			parser.params.Write(startCode)
+			parser.params.Write(src[index : index+nalLen])
+		default:
+			if nalType >= nalu_type_bla_w_lp && nalType <= nalu_type_rsv_irap23 && !hasWriteParams {
+				hasWriteParams = true
+				params := parser.specificInfo
+				if hasParams {
+					params = parser.params.Bytes()
+				}
+				if _, err := w.Write(params); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(startCode); err != nil {
+				return err
+			}
+			if _, err := w.Write(src[index : index+nalLen]); err != nil {
+				return err
+			}
+		}
+		index += nalLen
+		dataSize -= nalLen
+	}
+	return nil
+}
+
+func (parser *Parser) Parse(b []byte, isSeq bool, w io.Writer) (err error) {
+	switch isSeq {
+	case true:
+		err = parser.parseSpecificInfo(b)
+	case false:
+		// is annexb
+		if parser.isNaluHeader(b) {
+			_, err = w.Write(b)
+		} else {
+			err = parser.getAnnexbH265(b, w)
+		}
+	}
+	return
+}
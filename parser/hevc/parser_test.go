@@ -0,0 +1,55 @@
+package hevc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var hvcc = []byte{
+	0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x5d, 0xf0, 0x00, 0xfc, 0xfd, 0xf8, 0xf8, 0x00, 0x00, 0x0f, 0x03,
+	// vps
+	0xa0, 0x00, 0x01, 0x00, 0x03, 0x40, 0x01, 0x0c,
+	// sps
+	0xa1, 0x00, 0x01, 0x00, 0x03, 0x42, 0x01, 0x01,
+	// pps
+	0xa2, 0x00, 0x01, 0x00, 0x03, 0x44, 0x01, 0xc1,
+}
+
+func TestHEVCSeqDemux(t *testing.T) {
+	at := assert.New(t)
+	d := NewParser()
+	err := d.Parse(hvcc, true, nil)
+	at.Equal(nil, err)
+	at.Equal([]byte{
+		0x00, 0x00, 0x00, 0x01, 0x40, 0x01, 0x0c,
+		0x00, 0x00, 0x00, 0x01, 0x42, 0x01, 0x01,
+		0x00, 0x00, 0x00, 0x01, 0x44, 0x01, 0xc1,
+	}, d.specificInfo)
+
+	err = d.Parse(hvcc[:20], true, nil)
+	at.NotEqual(nil, err)
+}
+
+func TestHEVCAnnexbKeyFrame(t *testing.T) {
+	at := assert.New(t)
+	d := NewParser()
+	at.Equal(nil, d.Parse(hvcc, true, nil))
+
+	// IDR_W_RADL without in-band parameter sets
+	nalu := []byte{0x00, 0x00, 0x00, 0x03, 0x26, 0x01, 0xaf}
+	w := bytes.NewBuffer(nil)
+	at.Equal(nil, d.Parse(nalu, false, w))
+	expect := append([]byte{}, naluAud...)
+	expect = append(expect, d.specificInfo...)
+	expect = append(expect, 0x00, 0x00, 0x00, 0x01, 0x26, 0x01, 0xaf)
+	at.Equal(expect, w.Bytes())
+
+	// TRAIL_R
+	nalu = []byte{0x00, 0x00, 0x00, 0x03, 0x02, 0x01, 0xd0}
+	w.Reset()
+	at.Equal(nil, d.Parse(nalu, false, w))
+	at.Equal(append(append([]byte{}, naluAud...), 0x00, 0x00, 0x00, 0x01, 0x02, 0x01, 0xd0), w.Bytes())
+}
@@ -6,17 +6,30 @@ import (
 
 type Parser struct {
 	samplingFrequency int
+	frameSamples      int
 }
 
 func NewParser() *Parser {
 	return &Parser{}
 }
 
+// version - '00' MPEG-2.5, '01' reserved, '10' MPEG-2, '11' MPEG-1
 // sampling_frequency - indicates the sampling frequency, according to the following table.
 // '00' 44.1 kHz
 // '01' 48 kHz
 // '10' 32 kHz
 // '11' reserved
+// MPEG-2 halves these rates and MPEG-2.5 quarters them.
+const (
+	versionMPEG25 = 0
+	versionMPEG2  = 2
+	versionMPEG1  = 3
+
+	layer3 = 1
+	layer2 = 2
+	layer1 = 3
+)
+
 var mp3Rates = []int{44100, 48000, 32000}
 var (
 	errMp3DataInvalid = fmt.Errorf("mp3data  invalid")
@@ -27,12 +40,42 @@ func (parser *Parser) Parse(src []byte) error {
 	if len(src) < 3 {
 		return errMp3DataInvalid
 	}
+	if src[0] != 0xff || src[1]&0xe0 != 0xe0 {
+		return errMp3DataInvalid
+	}
+	version := (src[1] >> 3) & 0x3
+	layer := (src[1] >> 1) & 0x3
 	index := (src[2] >> 2) & 0x3
-	if index <= byte(len(mp3Rates)-1) {
+	if index > byte(len(mp3Rates)-1) {
+		return errIndexInvalid
+	}
+
+	switch version {
+	case versionMPEG1:
 		parser.samplingFrequency = mp3Rates[index]
-		return nil
+	case versionMPEG2:
+		parser.samplingFrequency = mp3Rates[index] / 2
+	case versionMPEG25:
+		parser.samplingFrequency = mp3Rates[index] / 4
+	default:
+		return errMp3DataInvalid
+	}
+
+	switch layer {
+	case layer1:
+		parser.frameSamples = 384
+	case layer2:
+		parser.frameSamples = 1152
+	case layer3:
+		if version == versionMPEG1 {
+			parser.frameSamples = 1152
+		} else {
+			parser.frameSamples = 576
+		}
+	default:
+		return errMp3DataInvalid
 	}
-	return errIndexInvalid
+	return nil
 }
 
 func (parser *Parser) SampleRate() int {
@@ -41,3 +84,11 @@ func (parser *Parser) SampleRate() int {
 	}
 	return parser.samplingFrequency
 }
+
+// FrameSamples return the number of samples carried by one frame
+func (parser *Parser) FrameSamples() int {
+	if parser.frameSamples == 0 {
+		parser.frameSamples = 1152
+	}
+	return parser.frameSamples
+}
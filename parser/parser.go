@@ -7,9 +7,14 @@ import (
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/parser/aac"
 	"github.com/gwuhaolin/livego/parser/h264"
+	"github.com/gwuhaolin/livego/parser/hevc"
 	"github.com/gwuhaolin/livego/parser/mp3"
 )
 
+const (
+	aacFrameSamples = 1024
+)
+
 var (
 	errNoAudio = fmt.Errorf("demuxer no audio")
 )
@@ -18,6 +23,7 @@ type CodecParser struct {
 	aac  *aac.Parser
 	mp3  *mp3.Parser
 	h264 *h264.Parser
+	hevc *hevc.Parser
 }
 
 func NewCodecParser() *CodecParser {
@@ -34,17 +40,42 @@ func (codeParser *CodecParser) SampleRate() (int, error) {
 	return codeParser.mp3.SampleRate(), nil
 }
 
+// FrameSamples return the number of samples per audio frame
+func (codeParser *CodecParser) FrameSamples() (int, error) {
+	if codeParser.aac == nil && codeParser.mp3 == nil {
+		return 0, errNoAudio
+	}
+	if codeParser.aac != nil {
+		return aacFrameSamples, nil
+	}
+	return codeParser.mp3.FrameSamples(), nil
+}
+
+// Captions return the closed captions of the last H.264 frame parsed
+func (codeParser *CodecParser) Captions() []byte {
+	if codeParser.h264 == nil {
+		return nil
+	}
+	return codeParser.h264.Captions()
+}
+
 func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
 
 	switch p.IsVideo {
 	case true:
 		f, ok := p.Header.(av.VideoPacketHeader)
 		if ok {
-			if f.CodecID() == av.VIDEO_H264 {
+			switch f.CodecID() {
+			case av.VIDEO_H264:
 				if codeParser.h264 == nil {
 					codeParser.h264 = h264.NewParser()
 				}
 				err = codeParser.h264.Parse(p.Data, f.IsSeq(), w)
+			case av.VIDEO_HEVC:
+				if codeParser.hevc == nil {
+					codeParser.hevc = hevc.NewParser()
+				}
+				err = codeParser.hevc.Parse(p.Data, f.IsSeq(), w)
 			}
 		}
 	case false:
@@ -56,11 +87,14 @@ func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
 					codeParser.aac = aac.NewParser()
 				}
 				err = codeParser.aac.Parse(p.Data, f.AACPacketType(), w)
-			case av.SOUND_MP3:
+			case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
 				if codeParser.mp3 == nil {
 					codeParser.mp3 = mp3.NewParser()
 				}
-				err = codeParser.mp3.Parse(p.Data)
+				if err = codeParser.mp3.Parse(p.Data); err == nil {
+					// mp3 frames are carried as is
+					_, err = w.Write(p.Data)
+				}
 			}
 		}
 
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/hls"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
 	"github.com/gwuhaolin/livego/protocol/rtmp/rtmprelay"
 
@@ -49,16 +52,20 @@ type ClientInfo struct {
 }
 
 type Server struct {
-	handler  av.Handler
-	session  map[string]*rtmprelay.RtmpRelay
-	rtmpAddr string
+	handler   av.Handler
+	hlsServer *hls.Server
+	session   map[string]*rtmprelay.RtmpRelay
+	rtmpAddr  string
 }
 
-func NewServer(h av.Handler, rtmpAddr string) *Server {
+// NewServer create the API server of the streams of h, hlsServer is nil
+// when HLS is disabled
+func NewServer(h av.Handler, hlsServer *hls.Server, rtmpAddr string) *Server {
 	return &Server{
-		handler:  h,
-		session:  make(map[string]*rtmprelay.RtmpRelay),
-		rtmpAddr: rtmpAddr,
+		handler:   h,
+		hlsServer: hlsServer,
+		session:   make(map[string]*rtmprelay.RtmpRelay),
+		rtmpAddr:  rtmpAddr,
 	}
 }
 
@@ -120,6 +127,12 @@ func (s *Server) Serve(l net.Listener) error {
 	mux.HandleFunc("/control/delete", func(w http.ResponseWriter, r *http.Request) {
 		s.handleDelete(w, r)
 	})
+	mux.HandleFunc("/control/variant", func(w http.ResponseWriter, r *http.Request) {
+		s.handleVariant(w, r)
+	})
+	mux.HandleFunc("/control/record", func(w http.ResponseWriter, r *http.Request) {
+		s.handleRecord(w, r)
+	})
 	mux.HandleFunc("/stat/livestat", func(w http.ResponseWriter, r *http.Request) {
 		s.GetLiveStatics(w, r)
 	})
@@ -138,8 +151,10 @@ type stream struct {
 }
 
 type streams struct {
-	Publishers []stream `json:"publishers"`
-	Players    []stream `json:"players"`
+	Publishers []stream             `json:"publishers"`
+	Players    []stream             `json:"players"`
+	HLS        []hls.StreamStat     `json:"hls,omitempty"`
+	Recordings []rtmp.RecordingStat `json:"recordings,omitempty"`
 }
 
 //http://127.0.0.1:8090/stat/livestat
@@ -238,6 +253,12 @@ func (server *Server) GetLiveStatics(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	// HLS viewers are sessions of the HLS server, not writers of the stream
+	if server.hlsServer != nil {
+		msgs.HLS = server.hlsServer.Stats(room)
+	}
+	msgs.Recordings = rtmpStream.Recordings(room)
+
 	//resp, _ := json.Marshal(msgs)
 	res.Data = msgs
 }
@@ -467,3 +488,144 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	res.Status = 404
 	res.Data = "room not found"
 }
+
+//http://127.0.0.1:8090/control/variant?app=APP&name=NAME
+//GET return the variant group, DELETE remove it and POST set the variant
+//group in the JSON body
+func (s *Server) handleVariant(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJson()
+
+	usage := "url: /control/variant?app=<APP>&name=<NAME>"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	app := r.Form.Get("app")
+	if _, ok := configure.GetApplication(app); !ok {
+		res.Status = 404
+		res.Data = "application not found"
+		return
+	}
+	name := r.Form.Get("name")
+
+	switch r.Method {
+	case http.MethodPost:
+		var group configure.VariantGroup
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			res.Status = 400
+			res.Data = err.Error()
+			return
+		}
+		if name != "" {
+			group.Name = name
+		}
+		if err := configure.Variants.Set(app, group); err != nil {
+			res.Status = 400
+			res.Data = err.Error()
+			return
+		}
+		res.Data = group
+	case http.MethodDelete:
+		if configure.Variants.Delete(app, name) {
+			res.Data = "Ok"
+			return
+		}
+		res.Status = 404
+		res.Data = "variant group not found"
+	default:
+		group, ok := configure.Variants.Get(app, name)
+		if !ok {
+			res.Status = 404
+			res.Data = "variant group not found"
+			return
+		}
+		res.Data = group
+	}
+}
+
+//http://127.0.0.1:8090/control/record?oper=start&app=live&name=123456&format=mp4&max_duration=3600
+//start recording a live stream at its next key frame, format is flv, mp4 or
+//ts and max_duration in seconds. oper=stop stop it at the next key frame.
+func (s *Server) handleRecord(w http.ResponseWriter, r *http.Request) {
+	res := &Response{
+		w:      w,
+		Data:   nil,
+		Status: 200,
+	}
+	defer res.SendJson()
+
+	usage := "url: /control/record?oper=start|stop&app=<APP>&name=<NAME>[&format=flv|mp4|ts][&max_duration=<SECONDS>]"
+	if err := r.ParseForm(); err != nil {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	oper := r.Form.Get("oper")
+	app := r.Form.Get("app")
+	name := r.Form.Get("name")
+	if len(app) == 0 || len(name) == 0 {
+		res.Status = 400
+		res.Data = usage
+		return
+	}
+	if _, ok := configure.GetApplication(app); !ok {
+		res.Status = 404
+		res.Data = "application not found"
+		return
+	}
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	key := app + "/" + name
+
+	log.Debugf("control record: oper=%v, key=%v", oper, key)
+	switch oper {
+	case "start":
+		format := r.Form.Get("format")
+		if format == "" {
+			format = "flv"
+		}
+		var maxDuration time.Duration
+		if v := r.Form.Get("max_duration"); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 || seconds > int(rtmp.MaxRecordingDuration/time.Second) {
+				res.Status = 400
+				res.Data = rtmp.ErrRecordingDuration.Error()
+				return
+			}
+			maxDuration = time.Duration(seconds) * time.Second
+		}
+		stat, err := rtmpStream.StartRecording(key, format, maxDuration)
+		switch err {
+		case nil:
+			res.Data = stat
+		case rtmp.ErrNoPublisher:
+			res.Status = 404
+			res.Data = err.Error()
+		case rtmp.ErrRecordingExists:
+			res.Status = 409
+			res.Data = err.Error()
+		case rtmp.ErrRecordingCreate:
+			res.Status = 500
+			res.Data = err.Error()
+		default:
+			res.Status = 400
+			res.Data = err.Error()
+		}
+	case "stop":
+		stat, err := rtmpStream.StopRecording(key)
+		if err != nil {
+			res.Status = 404
+			res.Data = err.Error()
+			return
+		}
+		res.Data = stat
+	default:
+		res.Status = 400
+		res.Data = usage
+	}
+}
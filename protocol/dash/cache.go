@@ -0,0 +1,271 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	trackVideo = "video"
+	trackAudio = "audio"
+
+	mpdTimescale     = 1000
+	defaultBandwidth = 1000000
+)
+
+var (
+	ErrNoKey = fmt.Errorf("No key for cache")
+)
+
+type Segment struct {
+	Start    uint32
+	Duration uint32
+	Video    []byte
+	Audio    []byte
+}
+
+// data return the fragment of track in the segment
+func (segment *Segment) data(track string) []byte {
+	if track == trackVideo {
+		return segment.Video
+	}
+	return segment.Audio
+}
+
+type initSegment struct {
+	data       []byte
+	codecs     string
+	width      int
+	height     int
+	sampleRate int
+}
+
+// SegmentCache keep the segments of the MPD time shift window and the init
+// segment of each track
+type SegmentCache struct {
+	id          string
+	num         int
+	window      int
+	segDuration int
+	startTime   time.Time
+	lock        sync.RWMutex
+	segments    []Segment
+	inits       map[string]initSegment
+}
+
+func NewSegmentCache(id string, segDuration, window, extra int) *SegmentCache {
+	return &SegmentCache{
+		id:          id,
+		num:         window + extra,
+		window:      window,
+		segDuration: segDuration,
+		inits:       make(map[string]initSegment),
+	}
+}
+
+func (cache *SegmentCache) ID() string {
+	return cache.id
+}
+
+// SetStartTime set the wall clock time of the media timestamp 0, it is the
+// availabilityStartTime of the MPD
+func (cache *SegmentCache) SetStartTime(t time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.startTime.IsZero() {
+		cache.startTime = t
+	}
+}
+
+func (cache *SegmentCache) SetInit(track string, init initSegment) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.inits[track] = init
+}
+
+func (cache *SegmentCache) GetInit(track string) ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	init, ok := cache.inits[track]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	return init.data, nil
+}
+
+func (cache *SegmentCache) SetSegment(segment Segment) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if len(cache.segments) >= cache.num {
+		cache.segments = append(cache.segments[:0], cache.segments[len(cache.segments)-cache.num+1:]...)
+	}
+	cache.segments = append(cache.segments, segment)
+}
+
+// GetSegment return the fragment of track starting at start
+func (cache *SegmentCache) GetSegment(track string, start uint32) ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	for i := range cache.segments {
+		if cache.segments[i].Start == start {
+			if data := cache.segments[i].data(track); data != nil {
+				return data, nil
+			}
+		}
+	}
+	return nil, ErrNoKey
+}
+
+type mpd struct {
+	XMLName                    xml.Name  `xml:"MPD"`
+	Xmlns                      string    `xml:"xmlns,attr"`
+	Profiles                   string    `xml:"profiles,attr"`
+	Type                       string    `xml:"type,attr"`
+	AvailabilityStartTime      string    `xml:"availabilityStartTime,attr"`
+	PublishTime                string    `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string    `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string    `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string    `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string    `xml:"suggestedPresentationDelay,attr"`
+	Period                     period    `xml:"Period"`
+	UTCTiming                  utcTiming `xml:"UTCTiming"`
+}
+
+type period struct {
+	ID             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	AdaptationSets []adaptationSet `xml:"AdaptationSet"`
+}
+
+type adaptationSet struct {
+	ID               int             `xml:"id,attr"`
+	ContentType      string          `xml:"contentType,attr"`
+	MimeType         string          `xml:"mimeType,attr"`
+	SegmentAlignment bool            `xml:"segmentAlignment,attr"`
+	StartWithSAP     int             `xml:"startWithSAP,attr"`
+	SegmentTemplate  segmentTemplate `xml:"SegmentTemplate"`
+	Representation   representation  `xml:"Representation"`
+}
+
+type segmentTemplate struct {
+	Timescale      int             `xml:"timescale,attr"`
+	Initialization string          `xml:"initialization,attr"`
+	Media          string          `xml:"media,attr"`
+	Timeline       []timelineEntry `xml:"SegmentTimeline>S"`
+}
+
+type timelineEntry struct {
+	T uint32 `xml:"t,attr"`
+	D uint32 `xml:"d,attr"`
+}
+
+type representation struct {
+	ID                string `xml:"id,attr"`
+	Codecs            string `xml:"codecs,attr"`
+	Bandwidth         int    `xml:"bandwidth,attr"`
+	Width             int    `xml:"width,attr,omitempty"`
+	Height            int    `xml:"height,attr,omitempty"`
+	AudioSamplingRate int    `xml:"audioSamplingRate,attr,omitempty"`
+}
+
+type utcTiming struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+func isoDuration(ms int) string {
+	return fmt.Sprintf("PT%.3fS", float64(ms)/1000)
+}
+
+// GenMPD return the dynamic MPD of the stream, name is the path of the
+// segments relative to the MPD
+func (cache *SegmentCache) GenMPD(name string, now time.Time) ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	if cache.startTime.IsZero() || len(cache.segments) == 0 {
+		return nil, ErrNoKey
+	}
+	segments := cache.segments
+	if len(segments) > cache.window {
+		segments = segments[len(segments)-cache.window:]
+	}
+	depth := 0
+	for _, segment := range segments {
+		depth += int(segment.Duration)
+	}
+
+	m := mpd{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      cache.startTime.UTC().Format(time.RFC3339Nano),
+		PublishTime:                now.UTC().Format(time.RFC3339Nano),
+		MinimumUpdatePeriod:        isoDuration(cache.segDuration),
+		MinBufferTime:              isoDuration(cache.segDuration),
+		TimeShiftBufferDepth:       isoDuration(depth),
+		SuggestedPresentationDelay: isoDuration(3 * cache.segDuration),
+		Period:                     period{ID: "0", Start: "PT0S"},
+		UTCTiming: utcTiming{
+			SchemeIDURI: "urn:mpeg:dash:utc:direct:2014",
+			Value:       now.UTC().Format(time.RFC3339Nano),
+		},
+	}
+	for i, track := range []string{trackVideo, trackAudio} {
+		init, ok := cache.inits[track]
+		if !ok {
+			continue
+		}
+		set := adaptationSet{
+			ID:               i,
+			ContentType:      track,
+			MimeType:         track + "/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			SegmentTemplate: segmentTemplate{
+				Timescale:      mpdTimescale,
+				Initialization: fmt.Sprintf("%s/%s-init.mp4", name, track),
+				Media:          fmt.Sprintf("%s/%s-$Time$.m4s", name, track),
+			},
+			Representation: representation{
+				ID:        track,
+				Codecs:    init.codecs,
+				Bandwidth: defaultBandwidth,
+			},
+		}
+		if track == trackVideo {
+			set.Representation.Width = init.width
+			set.Representation.Height = init.height
+		} else {
+			set.Representation.AudioSamplingRate = init.sampleRate
+		}
+		size, duration := 0, 0
+		for _, segment := range segments {
+			data := segment.data(track)
+			if data == nil {
+				continue
+			}
+			size += len(data)
+			duration += int(segment.Duration)
+			set.SegmentTemplate.Timeline = append(set.SegmentTemplate.Timeline,
+				timelineEntry{T: segment.Start, D: segment.Duration})
+		}
+		if duration > 0 {
+			set.Representation.Bandwidth = size * 8 * 1000 / duration
+		}
+		if len(set.SegmentTemplate.Timeline) > 0 {
+			m.Period.AdaptationSets = append(m.Period.AdaptationSets, set)
+		}
+	}
+
+	w := bytes.NewBufferString(xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
@@ -0,0 +1,45 @@
+package dash
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenMPD(t *testing.T) {
+	at := assert.New(t)
+	c := NewSegmentCache("live/test", 2000, 2, 1)
+
+	_, err := c.GenMPD("test", time.Now())
+	at.Equal(ErrNoKey, err)
+
+	c.SetStartTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.SetInit(trackVideo, initSegment{data: []byte{1}, codecs: "avc1.640028", width: 1280, height: 720})
+	c.SetSegment(Segment{Start: 0, Duration: 2000, Video: []byte{1}})
+	c.SetInit(trackAudio, initSegment{data: []byte{2}, codecs: "mp4a.40.2", sampleRate: 44100})
+	c.SetSegment(Segment{Start: 2000, Duration: 2000, Video: []byte{2}, Audio: []byte{3}})
+	c.SetSegment(Segment{Start: 4000, Duration: 2040, Video: []byte{4}, Audio: []byte{5}})
+	c.SetSegment(Segment{Start: 6040, Duration: 2000, Video: []byte{6}, Audio: []byte{7}})
+
+	body, err := c.GenMPD("test", time.Now())
+	at.Equal(nil, err)
+	mpd := string(body)
+	at.True(strings.Contains(mpd, `type="dynamic"`))
+	at.True(strings.Contains(mpd, `availabilityStartTime="2020-01-01T00:00:00Z"`))
+	at.True(strings.Contains(mpd, `timeShiftBufferDepth="PT4.040S"`))
+	at.True(strings.Contains(mpd, `media="test/video-$Time$.m4s"`))
+	at.True(strings.Contains(mpd, `initialization="test/audio-init.mp4"`))
+	at.True(strings.Contains(mpd, `codecs="avc1.640028"`))
+	at.True(strings.Contains(mpd, `audioSamplingRate="44100"`))
+	at.False(strings.Contains(mpd, `t="2000"`))
+	at.True(strings.Contains(mpd, `<S t="4000" d="2040"></S>`))
+
+	// the first segment left the cache, the second is kept out of the window
+	_, err = c.GetSegment(trackVideo, 0)
+	at.Equal(ErrNoKey, err)
+	data, err := c.GetSegment(trackAudio, 2000)
+	at.Equal(nil, err)
+	at.Equal([]byte{3}, data)
+}
@@ -0,0 +1,216 @@
+package dash
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/protocol/hook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sessionCookie = "livego_dash_session"
+)
+
+var (
+	ErrNoPublisher         = fmt.Errorf("no publisher")
+	ErrInvalidReq          = fmt.Errorf("invalid req url path")
+	ErrNoSupportVideoCodec = fmt.Errorf("no support video codec")
+	ErrNoSupportAudioCodec = fmt.Errorf("no support audio codec")
+	ErrPlayNotAllowed      = fmt.Errorf("play not allowed")
+)
+
+type Server struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    *sync.Map
+	sessions *hook.PlaySessions
+}
+
+func NewServer() *Server {
+	sessionTimeout := configure.Config.GetInt("hls_session_timeout")
+	if sessionTimeout <= 0 {
+		sessionTimeout = 30
+	}
+	ret := &Server{
+		conns:    &sync.Map{},
+		sessions: hook.NewPlaySessions(time.Second * time.Duration(sessionTimeout)),
+	}
+	go ret.checkStop()
+	return ret
+}
+
+func (server *Server) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		server.handle(w, r)
+	})
+	server.listener = listener
+	http.Serve(listener, mux)
+	return nil
+}
+
+func (server *Server) GetWriter(info av.Info) av.WriteCloser {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if v, ok := server.conns.Load(info.Key); ok {
+		s := v.(*Source)
+		if !s.closed {
+			return s
+		}
+		// the publisher reconnected, a closed source takes no more packets
+		log.Debug("replace closed dash source")
+	}
+	log.Debug("new dash source")
+	s := NewSource(info)
+	server.conns.Store(info.Key, s)
+	return s
+}
+
+func (server *Server) getConn(key string) *Source {
+	v, ok := server.conns.Load(key)
+	if !ok {
+		return nil
+	}
+	return v.(*Source)
+}
+
+func (server *Server) checkStop() {
+	for {
+		<-time.After(5 * time.Second)
+
+		// under the lock of GetWriter, so that a source replaced by a
+		// publisher reconnecting is not removed
+		server.lock.Lock()
+		server.conns.Range(func(key, val interface{}) bool {
+			v := val.(*Source)
+			if !v.Alive() && !configure.Config.GetBool("hls_keep_after_end") {
+				log.Debug("check stop and remove: ", v.Info())
+				server.conns.Delete(key)
+			}
+			return true
+		})
+		server.lock.Unlock()
+	}
+}
+
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	switch path.Ext(r.URL.Path) {
+	case ".mpd":
+		key := strings.TrimSuffix(strings.TrimLeft(r.URL.Path, "/"), ".mpd")
+		conn := server.getConn(key)
+		if conn == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		if err := server.authorize(w, r, key); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		body, err := conn.GetCache().GenMPD(path.Base(key), time.Now())
+		if err != nil {
+			log.Debug("GenMPD error: ", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	case ".mp4", ".m4s":
+		key, track, start, err := server.parseSegment(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conn := server.getConn(key)
+		if conn == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		if err := server.authorize(w, r, key); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		var data []byte
+		if start < 0 {
+			data, err = conn.GetCache().GetInit(track)
+		} else {
+			data, err = conn.GetCache().GetSegment(track, uint32(start))
+		}
+		if err != nil {
+			log.Debug("GetSegment error: ", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", track+"/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
+
+// authorize run the on_play hook once per viewer session, a session being
+// identified by the stream key, the viewer address and the session cookie
+// issued with the first manifest, so that viewers sharing an address are
+// told apart. A cookie the server did not sign is replaced.
+func (server *Server) authorize(w http.ResponseWriter, r *http.Request, key string) error {
+	event := hook.NewHTTPEvent(hook.ProtocolDASH, key, r)
+	if cookie, err := r.Cookie(sessionCookie); err == nil && hook.ValidSessionID(cookie.Value) {
+		event.ClientID = cookie.Value
+	} else if path.Ext(r.URL.Path) == ".mpd" {
+		event.ClientID = hook.NewSessionID()
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: event.ClientID, Path: "/", HttpOnly: true})
+	}
+	id := key + "@" + event.Addr
+	if event.ClientID != "" {
+		id += "/" + event.ClientID
+	}
+	if err := server.sessions.Authorize(id, event); err != nil {
+		log.Debugf("on_play %s err=%v", key, err)
+		return ErrPlayNotAllowed
+	}
+	return nil
+}
+
+// parseSegment split /APP/NAME/TRACK-TIME.m4s and /APP/NAME/TRACK-init.mp4,
+// start is negative for init segments
+func (server *Server) parseSegment(pathstr string) (key, track string, start int64, err error) {
+	paths := strings.SplitN(strings.TrimLeft(pathstr, "/"), "/", 3)
+	if len(paths) != 3 {
+		err = ErrInvalidReq
+		return
+	}
+	key = paths[0] + "/" + paths[1]
+	name := strings.TrimSuffix(paths[2], path.Ext(paths[2]))
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		err = ErrInvalidReq
+		return
+	}
+	track = name[:i]
+	if track != trackVideo && track != trackAudio {
+		err = ErrInvalidReq
+		return
+	}
+	if name[i+1:] == "init" {
+		start = -1
+		return
+	}
+	start, err = strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil || start < 0 {
+		err = ErrInvalidReq
+	}
+	return
+}
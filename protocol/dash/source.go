@@ -0,0 +1,264 @@
+package dash
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/fmp4"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxQueueNum = 512
+)
+
+// Source cut a stream in fMP4 segments, video and audio are muxed apart as
+// DASH players expect one track per representation
+type Source struct {
+	av.RWBaser
+	info        av.Info
+	segDuration int64
+	started     bool
+	segStart    uint32
+	hasVideo    bool
+	initChanged bool
+	video       *fmp4.Muxer
+	audio       *fmp4.Muxer
+	demuxer     *flv.Demuxer
+	cache       *SegmentCache
+	closed      bool
+	packetQueue chan *av.Packet
+}
+
+func NewSource(info av.Info) *Source {
+	info.Inter = true
+	// DASH shares the segment duration and window of HLS
+	opts := configure.GetHLSOptions(strings.SplitN(info.Key, "/", 2)[0])
+	s := &Source{
+		info:        info,
+		segDuration: int64(opts.SegmentDuration),
+		RWBaser:     av.NewRWBaser(time.Second * 10),
+		video:       fmp4.NewMuxer(),
+		audio:       fmp4.NewMuxer(),
+		demuxer:     flv.NewDemuxer(),
+		cache:       NewSegmentCache(info.Key, opts.SegmentDuration, opts.PlaylistSize, opts.ExtraSegments),
+		packetQueue: make(chan *av.Packet, maxQueueNum),
+	}
+	go func() {
+		err := s.SendPacket()
+		if err != nil {
+			log.Debug("send packet error: ", err)
+			s.closed = true
+		}
+	}()
+	return s
+}
+
+func (source *Source) GetCache() *SegmentCache {
+	return source.cache
+}
+
+// DropPacket make room in a full queue like the HLS source does: the
+// sequence headers, the key frames and as much audio as fits are kept, in
+// their order, and the other video frames are dropped
+func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
+	log.Warningf("[%v] packet queue max!!!", info)
+	var queued []*av.Packet
+drain:
+	for {
+		select {
+		case p := <-pktQue:
+			queued = append(queued, p)
+		default:
+			break drain
+		}
+	}
+
+	essential := func(p *av.Packet) bool {
+		if !p.IsVideo {
+			return p.IsMetadata
+		}
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && (vh.IsSeq() || vh.IsKeyFrame())
+	}
+	room := maxQueueNum / 2
+	for _, p := range queued {
+		if essential(p) {
+			room--
+		}
+	}
+	for _, p := range queued {
+		switch {
+		case essential(p):
+		case p.IsAudio && room > 0:
+			room--
+		default:
+			continue
+		}
+		pktQue <- p
+	}
+	log.Debug("packet queue len: ", len(pktQue))
+}
+
+func (source *Source) Write(p *av.Packet) (err error) {
+	if source.closed {
+		return fmt.Errorf("dash source closed")
+	}
+	source.SetPreTime()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("dash source has already been closed:%v", e)
+		}
+	}()
+	if len(source.packetQueue) >= maxQueueNum-24 {
+		source.DropPacket(source.packetQueue, source.info)
+	}
+	source.packetQueue <- p
+	return
+}
+
+func (source *Source) SendPacket() error {
+	defer func() {
+		log.Debugf("[%v] dash sender stop", source.info)
+		if r := recover(); r != nil {
+			log.Warning("dash SendPacket panic: ", r)
+		}
+	}()
+
+	log.Debugf("[%v] dash sender start", source.info)
+	for {
+		p, ok := <-source.packetQueue
+		if !ok {
+			return fmt.Errorf("closed")
+		}
+		if p.IsMetadata {
+			continue
+		}
+		err := source.demuxer.Demux(p)
+		if err == flv.ErrAvcEndSEQ {
+			continue
+		} else if err != nil {
+			log.Warning(err)
+			return err
+		}
+		if err := source.mux(p); err != nil {
+			log.Warning(err)
+		}
+	}
+}
+
+func (source *Source) Info() (ret av.Info) {
+	return source.info
+}
+
+func (source *Source) Close(err error) {
+	log.Debug("dash source closed: ", source.info)
+	if !source.closed {
+		close(source.packetQueue)
+	}
+	source.closed = true
+}
+
+func (source *Source) mux(p *av.Packet) error {
+	var vh av.VideoPacketHeader
+	if p.IsVideo {
+		vh = p.Header.(av.VideoPacketHeader)
+		if vh.CodecID() != av.VIDEO_H264 && vh.CodecID() != av.VIDEO_HEVC {
+			return ErrNoSupportVideoCodec
+		}
+		if vh.IsExHeader() && vh.PacketType() == av.PKT_METADATA {
+			return nil
+		}
+		if vh.IsSeq() {
+			source.hasVideo = true
+			source.configure(source.video, p)
+			return nil
+		}
+	} else {
+		ah := p.Header.(av.AudioPacketHeader)
+		switch ah.SoundFormat() {
+		case av.SOUND_AAC:
+			if ah.AACPacketType() == av.AAC_SEQHDR {
+				source.configure(source.audio, p)
+				return nil
+			}
+		case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
+			source.configure(source.audio, p)
+		default:
+			return ErrNoSupportAudioCodec
+		}
+	}
+
+	// segments start on video key frames, audio only streams are cut on
+	// duration boundaries
+	if (p.IsVideo && vh.IsKeyFrame()) || (p.IsAudio && !source.hasVideo) {
+		source.cut(p.TimeStamp)
+	}
+	if !source.started {
+		return nil
+	}
+	if p.IsVideo {
+		return source.video.WritePacket(p)
+	}
+	return source.audio.WritePacket(p)
+}
+
+func (source *Source) configure(muxer *fmp4.Muxer, p *av.Packet) {
+	changed, err := muxer.Configure(p)
+	if err != nil {
+		log.Warning(err)
+	}
+	if changed {
+		source.initChanged = true
+	}
+}
+
+func (source *Source) cut(timestamp uint32) {
+	if !source.started {
+		source.started = true
+		source.segStart = timestamp
+		source.cache.SetStartTime(time.Now().Add(-time.Duration(timestamp) * time.Millisecond))
+		source.writeInit()
+		return
+	}
+	if int64(timestamp)-int64(source.segStart) < source.segDuration {
+		return
+	}
+	source.cache.SetSegment(Segment{
+		Start:    source.segStart,
+		Duration: timestamp - source.segStart,
+		Video:    source.video.Fragment(timestamp),
+		Audio:    source.audio.Fragment(timestamp),
+	})
+	source.segStart = timestamp
+	if source.initChanged {
+		source.writeInit()
+	}
+}
+
+// writeInit publish the init segments, a track configured after the
+// stream started joins at the next segment
+func (source *Source) writeInit() {
+	source.initChanged = false
+	if source.video.Codecs() != "" {
+		width, height := source.video.VideoSize()
+		source.cache.SetInit(trackVideo, initSegment{
+			data:   source.video.InitSegment(),
+			codecs: source.video.Codecs(),
+			width:  width,
+			height: height,
+		})
+	}
+	if source.audio.Codecs() != "" {
+		source.cache.SetInit(trackAudio, initSegment{
+			data:       source.audio.InitSegment(),
+			codecs:     source.audio.Codecs(),
+			sampleRate: source.audio.SampleRate(),
+		})
+	}
+}
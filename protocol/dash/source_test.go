@@ -0,0 +1,51 @@
+package dash
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/stretchr/testify/assert"
+)
+
+type videoHeader struct {
+	key, seq bool
+}
+
+func (h videoHeader) IsKeyFrame() bool       { return h.key }
+func (h videoHeader) IsSeq() bool            { return h.seq }
+func (h videoHeader) IsExHeader() bool       { return false }
+func (h videoHeader) PacketType() uint8      { return 0 }
+func (h videoHeader) CodecID() uint8         { return av.VIDEO_H264 }
+func (h videoHeader) CompositionTime() int32 { return 0 }
+
+func TestDropPacket(t *testing.T) {
+	at := assert.New(t)
+	s := &Source{packetQueue: make(chan *av.Packet, maxQueueNum)}
+
+	s.packetQueue <- &av.Packet{IsVideo: true, Header: videoHeader{key: true, seq: true}}
+	for i := 1; len(s.packetQueue) < maxQueueNum-24; i++ {
+		if i%10 == 0 {
+			s.packetQueue <- &av.Packet{IsVideo: true, Header: videoHeader{key: true}, TimeStamp: uint32(i)}
+		} else if i%2 == 0 {
+			s.packetQueue <- &av.Packet{IsAudio: true, TimeStamp: uint32(i)}
+		} else {
+			s.packetQueue <- &av.Packet{IsVideo: true, Header: videoHeader{}, TimeStamp: uint32(i)}
+		}
+	}
+	s.DropPacket(s.packetQueue, s.info)
+
+	at.True(len(s.packetQueue) <= maxQueueNum/2)
+	first := <-s.packetQueue
+	at.True(first.Header.(av.VideoPacketHeader).IsSeq())
+	keys, last := 0, uint32(0)
+	for len(s.packetQueue) > 0 {
+		p := <-s.packetQueue
+		at.True(p.TimeStamp > last)
+		last = p.TimeStamp
+		if p.IsVideo {
+			at.True(p.Header.(av.VideoPacketHeader).IsKeyFrame())
+			keys++
+		}
+	}
+	at.Equal((maxQueueNum-25)/10, keys)
+}
@@ -4,31 +4,92 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"path"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
-	maxTSCacheNum = 3
+	maxTSCacheNum   = 3
+	segmentTypeFMP4 = "fmp4"
+	// number of complete segments whose parts stay in the playlist
+	maxPartSegments = 2
 )
 
 var (
 	ErrNoKey = fmt.Errorf("No key for cache")
 )
 
+// TSCacheItem keep the playlistSize segments listed in the playlist and
+// extra segments which already left it, for players fetching late. In low
+// latency mode it also keep the partial segments of the segment being built.
+// In DVR mode the playlist covers the segments stored on disk and the memory
+// segments are a cache in front of them.
 type TSCacheItem struct {
-	id   string
-	num  int
-	lock sync.RWMutex
-	ll   *list.List
-	lm   map[string]TSItem
+	id             string
+	num            int
+	playlistSize   int
+	targetDuration int
+	lowLatency     bool
+	partTarget     int
+	fmp4           bool
+	ext            string
+	initName       string
+	keyMethod      string
+	keyURI         string
+	discSeq        int
+	subtitles      string
+	segment        TSItem
+	inits          map[string][]byte
+	lastSeq        int
+	parts          []TSPart
+	notify         chan struct{}
+	lock           sync.RWMutex
+	ll             *list.List
+	lm             map[string]TSItem
+	pm             map[string]TSPart
+	dvr            *dvrStore
 }
 
-func NewTSCacheItem(id string) *TSCacheItem {
+func NewTSCacheItem(id string, opts configure.HLSOptions) *TSCacheItem {
+	if opts.PlaylistSize <= 0 {
+		opts.PlaylistSize = maxTSCacheNum
+	}
+	fmp4 := opts.SegmentType == segmentTypeFMP4
+	var subtitles string
+	if opts.Subtitles {
+		subtitles = opts.SubtitlesLang
+	}
+	var dvr *dvrStore
+	if opts.DVR {
+		var err error
+		window := int64(opts.DVRWindow) * 60 * 1000
+		dvr, err = newDVRStore(opts.DVRDir, id, window, int64(opts.DVRMaxSize)<<20)
+		if err != nil {
+			log.Warningf("[%s] dvr disabled: %v", id, err)
+		}
+	}
 	return &TSCacheItem{
-		id:  id,
-		ll:  list.New(),
-		num: maxTSCacheNum,
-		lm:  make(map[string]TSItem),
+		id:             id,
+		ll:             list.New(),
+		num:            opts.PlaylistSize + opts.ExtraSegments,
+		playlistSize:   opts.PlaylistSize,
+		targetDuration: (opts.SegmentDuration + 999) / 1000,
+		lowLatency:     opts.LowLatency,
+		partTarget:     opts.PartDuration,
+		fmp4:           fmp4,
+		ext:            segmentExt(fmp4),
+		subtitles:      subtitles,
+		inits:          make(map[string][]byte),
+		notify:         make(chan struct{}),
+		lm:             make(map[string]TSItem),
+		pm:             make(map[string]TSPart),
+		dvr:            dvr,
 	}
 }
 
@@ -36,49 +97,412 @@ func (tcCacheItem *TSCacheItem) ID() string {
 	return tcCacheItem.id
 }
 
-// TODO: found data race, fix it
+func (tcCacheItem *TSCacheItem) LowLatency() bool {
+	return tcCacheItem.lowLatency
+}
+
+// BlockTimeout is how long a blocking playlist reload may wait, three
+// target durations as advised by the LL-HLS specification
+func (tcCacheItem *TSCacheItem) BlockTimeout() time.Duration {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+	return time.Duration(3*tcCacheItem.targetDuration) * time.Second
+}
+
+// NextMSN return the media sequence number of the segment being built
+func (tcCacheItem *TSCacheItem) NextMSN() int {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+	return tcCacheItem.lastSeq + 1
+}
+
 func (tcCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
-	var seq int
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	seq := tcCacheItem.lastSeq + 1
+	discSeq := tcCacheItem.discSeq
 	var getSeq bool
-	var maxDuration int
+	var initName, keyMethod, keyURI string
+	sampleAES := tcCacheItem.keyMethod == methodSampleAES
 	m3u8body := bytes.NewBuffer(nil)
-	for e := tcCacheItem.ll.Front(); e != nil; e = e.Next() {
-		key := e.Value.(string)
-		v, ok := tcCacheItem.lm[key]
-		if ok {
-			if v.Duration > maxDuration {
-				maxDuration = v.Duration
-			}
-			if !getSeq {
-				getSeq = true
-				seq = v.SeqNum
-			}
-			fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
+	for _, v := range tcCacheItem.playListItems() {
+		if !getSeq {
+			getSeq = true
+			seq = v.SeqNum
+			discSeq = v.DiscSeq
 		}
+		if v.Discontinuity {
+			m3u8body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if v.KeyMethod != keyMethod || v.KeyURI != keyURI {
+			keyMethod, keyURI = v.KeyMethod, v.KeyURI
+			sampleAES = sampleAES || keyMethod == methodSampleAES
+			m3u8body.WriteString(keyLine(keyMethod, keyURI))
+		}
+		if v.Map != initName {
+			initName = v.Map
+			fmt.Fprintf(m3u8body, "#EXT-X-MAP:URI=\"%s\"\n", initName)
+		}
+		writeSegmentHead(m3u8body, v)
+		// parts are only advertised close to the live edge
+		if tcCacheItem.lowLatency && v.SeqNum > tcCacheItem.lastSeq-maxPartSegments {
+			writeParts(m3u8body, tcCacheItem.lm[v.Name].Parts)
+		}
+		fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
+	}
+	version := 3
+	if sampleAES {
+		version = 5
+	}
+	if tcCacheItem.lowLatency {
+		version = 6
+	}
+	if tcCacheItem.fmp4 {
+		version = 7
 	}
 	w := bytes.NewBuffer(nil)
-	fmt.Fprintf(w,
-		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
-		maxDuration/1000+1, seq)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:%d\n", version)
+	if version == 3 {
+		w.WriteString("#EXT-X-ALLOW-CACHE:NO\n")
+	}
+	fmt.Fprintf(w, "#EXT-X-TARGETDURATION:%d\n", tcCacheItem.targetDuration)
+	if tcCacheItem.lowLatency {
+		partTarget := float64(tcCacheItem.partTarget) / float64(1000)
+		fmt.Fprintf(w, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n#EXT-X-PART-INF:PART-TARGET=%.3f\n",
+			3*partTarget, partTarget)
+	}
+	fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+	if discSeq > 0 {
+		fmt.Fprintf(w, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discSeq)
+	}
+	w.WriteString("\n")
 	w.Write(m3u8body.Bytes())
+	if !tcCacheItem.lowLatency {
+		return w.Bytes(), nil
+	}
+
+	// the tags of the segment being built come with its first part
+	segment := tcCacheItem.segment
+	if len(tcCacheItem.parts) == 0 {
+		segment = TSItem{}
+	}
+	if segment.Discontinuity {
+		w.WriteString("#EXT-X-DISCONTINUITY\n")
+	}
+	if tcCacheItem.keyMethod != keyMethod || tcCacheItem.keyURI != keyURI {
+		w.WriteString(keyLine(tcCacheItem.keyMethod, tcCacheItem.keyURI))
+	}
+	if tcCacheItem.initName != initName {
+		fmt.Fprintf(w, "#EXT-X-MAP:URI=\"%s\"\n", tcCacheItem.initName)
+	}
+	writeSegmentHead(w, segment)
+	writeParts(w, tcCacheItem.parts)
+	fmt.Fprintf(w, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", tcCacheItem.hintName())
+	return w.Bytes(), nil
+}
+
+// Subtitles return the language of the subtitles rendition, it is empty
+// when the stream has none
+func (tcCacheItem *TSCacheItem) Subtitles() string {
+	return tcCacheItem.subtitles
+}
+
+// Bandwidth return the peak bit rate of the segments in memory
+func (tcCacheItem *TSCacheItem) Bandwidth() int {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	bandwidth := 0
+	for _, v := range tcCacheItem.lm {
+		if v.Duration <= 0 {
+			continue
+		}
+		if b := len(v.Data) * 8 * 1000 / v.Duration; b > bandwidth {
+			bandwidth = b
+		}
+	}
+	return bandwidth
+}
+
+// GenSubtitlesPlayList return the playlist of the WebVTT segments, one for
+// each media segment of the playlist
+func (tcCacheItem *TSCacheItem) GenSubtitlesPlayList() ([]byte, error) {
+	if tcCacheItem.subtitles == "" {
+		return nil, ErrNoKey
+	}
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	seq := tcCacheItem.lastSeq + 1
+	discSeq := tcCacheItem.discSeq
+	var getSeq bool
+	body := bytes.NewBuffer(nil)
+	for _, v := range tcCacheItem.playListItems() {
+		if !getSeq {
+			getSeq = true
+			seq = v.SeqNum
+			discSeq = v.DiscSeq
+		}
+		if v.Discontinuity {
+			body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), subtitlesName(v.Name))
+	}
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n",
+		tcCacheItem.targetDuration, seq)
+	if discSeq > 0 {
+		fmt.Fprintf(w, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discSeq)
+	}
+	w.WriteString("\n")
+	w.Write(body.Bytes())
 	return w.Bytes(), nil
 }
 
+// playListItems return the segments of the playlist, the caller must hold the lock
+func (tcCacheItem *TSCacheItem) playListItems() []TSItem {
+	if tcCacheItem.dvr != nil {
+		return tcCacheItem.dvr.list()
+	}
+	var items []TSItem
+	e := tcCacheItem.ll.Front()
+	for skip := tcCacheItem.ll.Len() - tcCacheItem.playlistSize; skip > 0; skip-- {
+		e = e.Next()
+	}
+	for ; e != nil; e = e.Next() {
+		if v, ok := tcCacheItem.lm[e.Value.(string)]; ok {
+			items = append(items, v)
+		}
+	}
+	return items
+}
+
+// writeSegmentHead write the date and the ad break tags of a segment
+func writeSegmentHead(w *bytes.Buffer, item TSItem) {
+	if !item.ProgramDateTime.IsZero() {
+		fmt.Fprintf(w, "#EXT-X-PROGRAM-DATE-TIME:%s\n", formatProgramDateTime(item.ProgramDateTime))
+	}
+	writeSplice(w, item.CueOut, item.CueIn)
+}
+
+func writeParts(w *bytes.Buffer, parts []TSPart) {
+	for _, part := range parts {
+		fmt.Fprintf(w, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", float64(part.Duration)/float64(1000), part.Name)
+		if part.Independent {
+			w.WriteString(",INDEPENDENT=YES")
+		}
+		w.WriteString("\n")
+	}
+}
+
+// hintName return the name of the part being built, the caller must hold the lock
+func (tcCacheItem *TSCacheItem) hintName() string {
+	return partName(tcCacheItem.id, tcCacheItem.lastSeq+1, len(tcCacheItem.parts), tcCacheItem.ext)
+}
+
+// broadcast wake up the blocked requests, the caller must hold the write lock
+func (tcCacheItem *TSCacheItem) broadcast() {
+	close(tcCacheItem.notify)
+	tcCacheItem.notify = make(chan struct{})
+}
+
 func (tcCacheItem *TSCacheItem) SetItem(key string, item TSItem) {
-	if tcCacheItem.ll.Len() == tcCacheItem.num {
+	tcCacheItem.lock.Lock()
+	item.Map = tcCacheItem.initName
+	item.DiscSeq = tcCacheItem.discSeq
+	if item.Discontinuity {
+		tcCacheItem.discSeq++
+	}
+	tcCacheItem.segment = TSItem{}
+	tcCacheItem.lock.Unlock()
+
+	// the segment is on disk before it is announced
+	if tcCacheItem.dvr != nil {
+		if err := tcCacheItem.dvr.add(item); err != nil {
+			log.Warningf("[%s] write dvr segment: %v", tcCacheItem.id, err)
+		}
+	}
+
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	// the target duration must not decrease during the life of the
+	// playlist, segments cut on late key frames raise it
+	if d := (item.Duration + 500) / 1000; d > tcCacheItem.targetDuration {
+		tcCacheItem.targetDuration = d
+	}
+	for tcCacheItem.ll.Len() >= tcCacheItem.num {
 		e := tcCacheItem.ll.Front()
 		tcCacheItem.ll.Remove(e)
 		k := e.Value.(string)
+		for _, part := range tcCacheItem.lm[k].Parts {
+			delete(tcCacheItem.pm, part.Name)
+		}
 		delete(tcCacheItem.lm, k)
 	}
+	item.Parts = tcCacheItem.parts
+	tcCacheItem.parts = nil
 	tcCacheItem.lm[key] = item
 	tcCacheItem.ll.PushBack(key)
+	tcCacheItem.lastSeq = item.SeqNum
+	tcCacheItem.broadcast()
+}
+
+// SetPart add a partial segment to the segment being built
+func (tcCacheItem *TSCacheItem) SetPart(part TSPart) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	tcCacheItem.parts = append(tcCacheItem.parts, part)
+	tcCacheItem.pm[part.Name] = part
+	tcCacheItem.broadcast()
+}
+
+// SetInit set the fMP4 init segment of the following segments, init
+// segments only change with the codec configuration and are all kept
+func (tcCacheItem *TSCacheItem) SetInit(name string, data []byte) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	tcCacheItem.inits[name] = data
+	tcCacheItem.initName = name
+}
+
+// SetKey set the encryption of the segment being built, it is advertised
+// with its parts, complete segments carry their own key
+func (tcCacheItem *TSCacheItem) SetKey(method, uri string) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	tcCacheItem.keyMethod = method
+	tcCacheItem.keyURI = uri
+}
+
+// StartSegment describe the segment being built with the discontinuity,
+// date and ad break of head, they are advertised with its parts
+func (tcCacheItem *TSCacheItem) StartSegment(head TSItem) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	tcCacheItem.segment = head
+}
+
+// Restart drop the parts of the segment left unfinished by a publisher
+// which went away, the next segment published is seq+1
+func (tcCacheItem *TSCacheItem) Restart(seq int) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	for _, part := range tcCacheItem.parts {
+		delete(tcCacheItem.pm, part.Name)
+	}
+	tcCacheItem.parts = nil
+	tcCacheItem.segment = TSItem{}
+	tcCacheItem.lastSeq = seq
+	tcCacheItem.broadcast()
+}
+
+func (tcCacheItem *TSCacheItem) GetInit(name string) ([]byte, error) {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	data, ok := tcCacheItem.inits[name]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	return data, nil
 }
 
 func (tcCacheItem *TSCacheItem) GetItem(key string) (TSItem, error) {
+	tcCacheItem.lock.RLock()
 	item, ok := tcCacheItem.lm[key]
+	tcCacheItem.lock.RUnlock()
+
+	if ok {
+		return item, nil
+	}
+	// segments out of the memory cache are read from disk
+	if tcCacheItem.dvr != nil {
+		return tcCacheItem.dvr.read(key)
+	}
+	return item, ErrNoKey
+}
+
+// GetSubtitles return the WebVTT segment name, the DVR keeps the WebVTT
+// segments of its window in memory
+func (tcCacheItem *TSCacheItem) GetSubtitles(name string) ([]byte, error) {
+	if tcCacheItem.subtitles == "" {
+		return nil, ErrNoKey
+	}
+	media := strings.TrimSuffix(name, path.Ext(name)) + tcCacheItem.ext
+	tcCacheItem.lock.RLock()
+	item, ok := tcCacheItem.lm[media]
+	tcCacheItem.lock.RUnlock()
+
+	if ok {
+		return item.Subtitles, nil
+	}
+	if tcCacheItem.dvr != nil {
+		for _, v := range tcCacheItem.dvr.list() {
+			if v.Name == media {
+				return v.Subtitles, nil
+			}
+		}
+	}
+	return nil, ErrNoKey
+}
+
+// Close remove the DVR segments of the stream
+func (tcCacheItem *TSCacheItem) Close() error {
+	if tcCacheItem.dvr == nil {
+		return nil
+	}
+	return tcCacheItem.dvr.close()
+}
+
+// WaitPart return the partial segment key, a request for the part announced
+// by the preload hint is held until the part is complete
+func (tcCacheItem *TSCacheItem) WaitPart(key string, timeout time.Duration) (TSPart, error) {
+	var part TSPart
+	var ok bool
+	tcCacheItem.wait(func() bool {
+		part, ok = tcCacheItem.pm[key]
+		return ok || key != tcCacheItem.hintName()
+	}, timeout)
 	if !ok {
-		return item, ErrNoKey
+		return part, ErrNoKey
+	}
+	return part, nil
+}
+
+// WaitPlayList block until the playlist contains the part index of the
+// segment msn or a later one, a negative index waits for the whole segment
+func (tcCacheItem *TSCacheItem) WaitPlayList(msn, index int, timeout time.Duration) bool {
+	return tcCacheItem.wait(func() bool {
+		if msn <= tcCacheItem.lastSeq {
+			return true
+		}
+		return msn == tcCacheItem.lastSeq+1 && index >= 0 && index < len(tcCacheItem.parts)
+	}, timeout)
+}
+
+// wait until done return true or timeout, done is called with the read lock held
+func (tcCacheItem *TSCacheItem) wait(done func() bool, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		tcCacheItem.lock.RLock()
+		ok := done()
+		notify := tcCacheItem.notify
+		tcCacheItem.lock.RUnlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return false
+		}
 	}
-	return item, nil
 }
@@ -0,0 +1,345 @@
+package hls
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenM3U8PlayListWindow(t *testing.T) {
+	at := assert.New(t)
+	c := NewTSCacheItem("live/test", configure.HLSOptions{
+		SegmentDuration: 2000,
+		PlaylistSize:    2,
+		ExtraSegments:   1,
+	})
+	for i := 1; i <= 4; i++ {
+		name := fmt.Sprintf("/live/test/%d.ts", i)
+		c.SetItem(name, NewTSItem(name, 2000, i, nil))
+	}
+
+	body, err := c.GenM3U8PlayList()
+	at.Equal(nil, err)
+	playlist := string(body)
+	at.True(strings.Contains(playlist, "#EXT-X-TARGETDURATION:2\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:3\n"))
+	at.False(strings.Contains(playlist, "/live/test/2.ts"))
+	at.True(strings.Contains(playlist, "/live/test/4.ts"))
+
+	// segment 2 left the playlist but is kept for late fetches
+	_, err = c.GetItem("/live/test/2.ts")
+	at.Equal(nil, err)
+	_, err = c.GetItem("/live/test/1.ts")
+	at.Equal(ErrNoKey, err)
+
+	// a long segment raise the target duration for good
+	c.SetItem("/live/test/5.ts", NewTSItem("/live/test/5.ts", 4600, 5, nil))
+	c.SetItem("/live/test/6.ts", NewTSItem("/live/test/6.ts", 2000, 6, nil))
+	c.SetItem("/live/test/7.ts", NewTSItem("/live/test/7.ts", 2000, 7, nil))
+	body, _ = c.GenM3U8PlayList()
+	at.True(strings.Contains(string(body), "#EXT-X-TARGETDURATION:5\n"))
+}
+
+func TestGenM3U8PlayListLowLatency(t *testing.T) {
+	at := assert.New(t)
+	c := NewTSCacheItem("live/test", configure.HLSOptions{
+		SegmentDuration: 2000,
+		PlaylistSize:    3,
+		LowLatency:      true,
+		PartDuration:    1000,
+	})
+	c.SetPart(NewTSPart(partName("live/test", 1, 0, ".ts"), 1000, true, []byte{1}))
+	c.SetPart(NewTSPart(partName("live/test", 1, 1, ".ts"), 1000, false, []byte{2}))
+	c.SetItem("/live/test/1.ts", NewTSItem("/live/test/1.ts", 2000, 1, nil))
+	c.SetPart(NewTSPart(partName("live/test", 2, 0, ".ts"), 1000, true, []byte{3}))
+
+	body, err := c.GenM3U8PlayList()
+	at.Equal(nil, err)
+	playlist := string(body)
+	at.True(strings.Contains(playlist, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-PART-INF:PART-TARGET=1.000\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:1\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-PART:DURATION=1.000,URI=\"/live/test/1.1.ts\"\n#EXTINF:2.000,\n/live/test/1.ts\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-PART:DURATION=1.000,URI=\"/live/test/2.0.ts\",INDEPENDENT=YES\n"))
+	at.True(strings.HasSuffix(playlist, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/live/test/2.1.ts\"\n"))
+
+	// available parts do not block
+	at.True(c.WaitPlayList(2, 0, time.Millisecond))
+	at.False(c.WaitPlayList(2, 1, time.Millisecond))
+
+	// the hinted part is held until published
+	go c.SetPart(NewTSPart(partName("live/test", 2, 1, ".ts"), 1000, false, []byte{4}))
+	part, err := c.WaitPart("/live/test/2.1.ts", time.Second)
+	at.Equal(nil, err)
+	at.Equal([]byte{4}, part.Data)
+	at.True(c.WaitPlayList(2, 1, time.Millisecond))
+
+	_, err = c.WaitPart("/live/test/9.0.ts", time.Second)
+	at.Equal(ErrNoKey, err)
+}
+
+func TestBlockReload(t *testing.T) {
+	at := assert.New(t)
+	c := NewTSCacheItem("live/test", configure.HLSOptions{
+		SegmentDuration: 2000,
+		PlaylistSize:    3,
+		LowLatency:      true,
+		PartDuration:    1000,
+	})
+	c.SetPart(NewTSPart(partName("live/test", 1, 0, ".ts"), 1000, true, []byte{1}))
+	server := &Server{}
+	for query, code := range map[string]int{
+		"":                        http.StatusOK,
+		"_HLS_msn=1&_HLS_part=0":  http.StatusOK,
+		"_HLS_part=0":             http.StatusBadRequest,
+		"_HLS_msn=x":              http.StatusBadRequest,
+		"_HLS_msn=1&_HLS_part=-1": http.StatusBadRequest,
+		"_HLS_msn=9":              http.StatusBadRequest,
+	} {
+		got, _ := server.blockReload(c, httptest.NewRequest("GET", "/live/test.m3u8?"+query, nil))
+		at.Equal(code, got, query)
+	}
+}
+
+func TestGenM3U8PlayListFMP4(t *testing.T) {
+	at := assert.New(t)
+	c := NewTSCacheItem("live/test", configure.HLSOptions{
+		SegmentDuration: 2000,
+		PlaylistSize:    3,
+		SegmentType:     "fmp4",
+	})
+	c.SetInit("/live/test/init1.mp4", []byte{1})
+	c.SetItem("/live/test/1.m4s", NewTSItem("/live/test/1.m4s", 2000, 1, nil))
+	c.SetItem("/live/test/2.m4s", NewTSItem("/live/test/2.m4s", 2000, 2, nil))
+	c.SetInit("/live/test/init2.mp4", []byte{2})
+	c.SetItem("/live/test/3.m4s", NewTSItem("/live/test/3.m4s", 2000, 3, nil))
+
+	body, err := c.GenM3U8PlayList()
+	at.Equal(nil, err)
+	playlist := string(body)
+	at.True(strings.HasPrefix(playlist, "#EXTM3U\n#EXT-X-VERSION:7\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-MAP:URI=\"/live/test/init1.mp4\"\n#EXTINF:2.000,\n/live/test/1.m4s\n#EXTINF:2.000,\n/live/test/2.m4s\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-MAP:URI=\"/live/test/init2.mp4\"\n#EXTINF:2.000,\n/live/test/3.m4s\n"))
+
+	data, err := c.GetInit("/live/test/init1.mp4")
+	at.Equal(nil, err)
+	at.Equal([]byte{1}, data)
+}
+
+func TestGenM3U8PlayListDVR(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "dvr")
+	at.Equal(nil, err)
+	defer os.RemoveAll(dir)
+
+	c := NewTSCacheItem("live/test", configure.HLSOptions{
+		SegmentDuration: 2000,
+		PlaylistSize:    2,
+		DVR:             true,
+		DVRDir:          dir,
+		DVRWindow:       1,
+	})
+	// 40 segments of 2s, the one minute window keep the last 30
+	for i := 1; i <= 40; i++ {
+		name := fmt.Sprintf("/live/test/%d.ts", i)
+		c.SetItem(name, NewTSItem(name, 2000, i, []byte{byte(i)}))
+	}
+	body, err := c.GenM3U8PlayList()
+	at.Equal(nil, err)
+	playlist := string(body)
+	at.True(strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:11\n"))
+	at.Equal(30, strings.Count(playlist, "#EXTINF"))
+
+	// segments out of the memory cache are read from disk
+	item, err := c.GetItem("/live/test/11.ts")
+	at.Equal(nil, err)
+	at.Equal([]byte{11}, item.Data)
+	_, err = c.GetItem("/live/test/10.ts")
+	at.Equal(ErrNoKey, err)
+	_, err = os.Stat(filepath.Join(dir, "live", "test", "10.ts"))
+	at.True(os.IsNotExist(err))
+
+	at.Equal(nil, c.Close())
+	_, err = os.Stat(filepath.Join(dir, "live", "test"))
+	at.True(os.IsNotExist(err))
+}
+
+func TestDVRQuota(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "dvr")
+	at.Equal(nil, err)
+	defer os.RemoveAll(dir)
+
+	store, err := newDVRStore(dir, "live/test", 60000, 3000)
+	at.Equal(nil, err)
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("/live/test/%d.ts", i)
+		at.Equal(nil, store.add(NewTSItem(name, 1000, i, make([]byte, 1000))))
+	}
+	items := store.list()
+	at.Equal(3, len(items))
+	at.Equal(3, items[0].SeqNum)
+}
+
+func TestDVRPath(t *testing.T) {
+	at := assert.New(t)
+	root := filepath.FromSlash("/tmp/dvr")
+
+	dir, err := dvrPath(root, "live/test")
+	at.Equal(nil, err)
+	at.Equal(filepath.Join(root, "live", "test"), dir)
+
+	for _, id := range []string{"", ".", "..", "live/../..", "../dvr2/live", "live/../../etc"} {
+		_, err := dvrPath(root, id)
+		at.Equal(ErrDVRPath, err, id)
+	}
+}
+
+func TestDVRSharedQuota(t *testing.T) {
+	at := assert.New(t)
+	root, err := ioutil.TempDir("", "dvr")
+	at.Equal(nil, err)
+	defer os.RemoveAll(root)
+
+	window := int64(60 * 1000)
+	a, err := newDVRStore(root, "live/a", window, 3000)
+	at.Equal(nil, err)
+	b, err := newDVRStore(root, "live/b", window, 3000)
+	at.Equal(nil, err)
+
+	data := make([]byte, 1000)
+	at.Equal(nil, a.add(TSItem{Name: "1.ts", Duration: 1000, Data: data}))
+	at.Equal(nil, a.add(TSItem{Name: "2.ts", Duration: 1000, Data: data}))
+	at.Equal(nil, b.add(TSItem{Name: "1.ts", Duration: 1000, Data: data}))
+	at.Equal(nil, b.add(TSItem{Name: "2.ts", Duration: 1000, Data: data}))
+
+	// the quota is shared, the oldest segment of the directory is evicted
+	at.Equal(1, len(a.list()))
+	at.Equal("2.ts", a.list()[0].Name)
+	at.Equal(2, len(b.list()))
+	_, err = os.Stat(filepath.Join(root, "live", "a", "1.ts"))
+	at.True(os.IsNotExist(err))
+
+	at.Equal(nil, b.close())
+	at.Equal(int64(1000), a.quota.size)
+	at.Equal(nil, a.close())
+}
+
+func TestGenM3U8PlayListKey(t *testing.T) {
+	at := assert.New(t)
+	c := NewTSCacheItem("live/test", configure.HLSOptions{
+		SegmentDuration: 2000,
+		PlaylistSize:    3,
+	})
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprintf("/live/test/%d.ts", i)
+		item := NewTSItem(name, 2000, i, nil)
+		item.KeyMethod = methodAES128
+		item.KeyURI = "/key/live/test/1.key"
+		if i == 3 {
+			item.KeyMethod = methodSampleAES
+			item.KeyURI = "/key/live/test/2.key"
+		}
+		c.SetItem(name, item)
+	}
+	body, err := c.GenM3U8PlayList()
+	at.Equal(nil, err)
+	playlist := string(body)
+	at.True(strings.Contains(playlist, "#EXT-X-VERSION:5\n"))
+	at.Equal(1, strings.Count(playlist, "#EXT-X-KEY:METHOD=AES-128,URI=\"/key/live/test/1.key\"\n"))
+	at.True(strings.Contains(playlist, "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"/key/live/test/2.key\"\n#EXTINF:2.000,\n/live/test/3.ts\n"))
+}
+
+func TestGenM3U8PlayListDiscontinuity(t *testing.T) {
+	at := assert.New(t)
+	c := NewTSCacheItem("live/test", configure.HLSOptions{
+		SegmentDuration: 2000,
+		PlaylistSize:    2,
+		LowLatency:      true,
+		PartDuration:    1000,
+	})
+	c.SetItem("/live/test/1.ts", NewTSItem("/live/test/1.ts", 2000, 1, nil))
+	c.SetPart(NewTSPart(partName("live/test", 2, 0, ".ts"), 1000, true, []byte{1}))
+
+	// a publisher reconnecting drops the unfinished segment and continues
+	c.Restart(1)
+	_, err := c.WaitPart(partName("live/test", 2, 0, ".ts"), 0)
+	at.Equal(ErrNoKey, err)
+	c.StartSegment(TSItem{Discontinuity: true})
+	c.SetPart(NewTSPart(partName("live/test", 2, 0, ".ts"), 1000, true, []byte{2}))
+	body, _ := c.GenM3U8PlayList()
+	at.True(strings.Contains(string(body), "#EXT-X-DISCONTINUITY\n#EXT-X-PART:DURATION=1.000,URI=\"/live/test/2.0.ts\""))
+
+	item := NewTSItem("/live/test/2.ts", 2000, 2, nil)
+	item.Discontinuity = true
+	item.ProgramDateTime = time.Date(2026, 10, 17, 11, 51, 24, 0, time.UTC)
+	c.SetItem(item.Name, item)
+	c.SetItem("/live/test/3.ts", NewTSItem("/live/test/3.ts", 2000, 3, nil))
+	body, _ = c.GenM3U8PlayList()
+	playlist := string(body)
+	at.False(strings.Contains(playlist, "#EXT-X-DISCONTINUITY-SEQUENCE"))
+	at.True(strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME:2026-10-17T11:51:24.000Z\n"+
+		"#EXT-X-PART:DURATION=1.000,URI=\"/live/test/2.0.ts\",INDEPENDENT=YES\n#EXTINF:2.000,\n/live/test/2.ts\n"))
+	at.Equal(1, strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"))
+
+	// the discontinuity left the playlist and is counted in the sequence
+	c.SetItem("/live/test/4.ts", NewTSItem("/live/test/4.ts", 2000, 4, nil))
+	body, _ = c.GenM3U8PlayList()
+	playlist = string(body)
+	at.True(strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:3\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n"))
+	at.False(strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n"))
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	at := assert.New(t)
+	s := &Source{stat: newStatus()}
+	s.stat.update(true, 0)
+	for ts := uint32(40); ts <= 1000; ts += 40 {
+		s.checkTimestamp(ts)
+		s.stat.update(true, ts)
+	}
+	at.False(s.discontinuity)
+
+	// the publisher restarted its clock, the segment keeps its duration
+	s.checkTimestamp(0)
+	s.stat.update(true, 0)
+	at.True(s.discontinuity)
+	at.Equal(int64(1040), s.stat.durationMs())
+
+	s.discontinuity = false
+	s.checkTimestamp(60000)
+	at.True(s.discontinuity)
+}
+
+func TestGenSubtitlesPlayList(t *testing.T) {
+	at := assert.New(t)
+	tsCache := NewTSCacheItem("live/test", configure.HLSOptions{Subtitles: true, SubtitlesLang: "en"})
+	for seq := 1; seq <= 4; seq++ {
+		item := NewTSItem(fmt.Sprintf("/live/test/%d.ts", seq), 3000, seq, []byte("ts"))
+		item.Discontinuity = seq == 3
+		item.Subtitles = []byte(webvttHeader(0))
+		tsCache.SetItem(item.Name, item)
+	}
+	body, err := tsCache.GenSubtitlesPlayList()
+	at.Equal(nil, err)
+	at.Equal("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:2\n\n"+
+		"#EXTINF:3.000,\n/live/test/2.vtt\n"+
+		"#EXT-X-DISCONTINUITY\n#EXTINF:3.000,\n/live/test/3.vtt\n"+
+		"#EXTINF:3.000,\n/live/test/4.vtt\n", string(body))
+
+	data, err := tsCache.GetSubtitles("/live/test/4.vtt")
+	at.Equal(nil, err)
+	at.Equal(webvttHeader(0), string(data))
+	_, err = tsCache.GetSubtitles("/live/test/1.vtt")
+	at.Equal(ErrNoKey, err)
+}
@@ -0,0 +1,226 @@
+package hls
+
+import "strings"
+
+const (
+	cea608Rows    = 15
+	cea608Columns = 32
+)
+
+const (
+	captionPopOn = iota
+	captionRollUp
+	captionPaintOn
+)
+
+// row of the preamble address codes, indexed by the low bits of the first
+// byte, the second row of a pair is selected by bit 0x20 of the second byte
+var cea608PACRows = [8]int{10, 0, 2, 11, 13, 4, 6, 8}
+
+var (
+	cea608Special   = []rune("®°½¿™¢£♪à èâêîôû")
+	cea608Extended1 = []rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»")
+	cea608Extended2 = []rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘")
+	cea608Basic     = map[byte]rune{
+		0x2a: 'á', 0x5c: 'é', 0x5e: 'í', 0x5f: 'ó', 0x60: 'ú',
+		0x7b: 'ç', 0x7c: '÷', 0x7d: 'Ñ', 0x7e: 'ñ', 0x7f: '█',
+	}
+)
+
+type captionScreen [cea608Rows][cea608Columns]rune
+
+func (screen *captionScreen) text() string {
+	var lines []string
+	for _, row := range screen {
+		line := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == 0 {
+				return ' '
+			}
+			return r
+		}, string(row[:])))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// cea608 decode the CC1 captions of the field 1 byte pairs into the text
+// displayed on screen
+type cea608 struct {
+	mode      int
+	rollRows  int
+	channel   int
+	row       int
+	col       int
+	lastCtrl  [2]byte
+	displayed captionScreen
+	buffer    captionScreen
+	dirty     bool
+}
+
+func newCEA608() *cea608 {
+	return &cea608{
+		channel: 1,
+		row:     cea608Rows - 1,
+	}
+}
+
+// memory return the screen written by the current mode
+func (dec *cea608) memory() *captionScreen {
+	if dec.mode == captionPopOn {
+		return &dec.buffer
+	}
+	dec.dirty = true
+	return &dec.displayed
+}
+
+func (dec *cea608) put(r rune) {
+	if dec.col >= cea608Columns {
+		dec.col = cea608Columns - 1
+	}
+	dec.memory()[dec.row][dec.col] = r
+	dec.col++
+}
+
+func (dec *cea608) backspace() {
+	if dec.col > 0 {
+		dec.col--
+		dec.memory()[dec.row][dec.col] = 0
+	}
+}
+
+// decode process a byte pair, it return true with the text on screen when
+// the pair changed it
+func (dec *cea608) decode(b1, b2 byte) (string, bool) {
+	b1, b2 = b1&0x7f, b2&0x7f
+	if b1 < 0x10 {
+		// padding and XDS
+		return "", false
+	}
+	if b1 >= 0x20 {
+		dec.lastCtrl = [2]byte{}
+		if dec.channel == 1 {
+			dec.putBasic(b1)
+			dec.putBasic(b2)
+		}
+	} else if dec.lastCtrl == [2]byte{b1, b2} {
+		// control codes are sent twice
+		dec.lastCtrl = [2]byte{}
+	} else {
+		dec.lastCtrl = [2]byte{b1, b2}
+		dec.channel = 1
+		if b1 >= 0x18 {
+			dec.channel = 2
+		} else {
+			dec.control(b1, b2)
+		}
+	}
+	if !dec.dirty {
+		return "", false
+	}
+	dec.dirty = false
+	return dec.displayed.text(), true
+}
+
+func (dec *cea608) putBasic(b byte) {
+	if b < 0x20 {
+		return
+	}
+	if r, ok := cea608Basic[b]; ok {
+		dec.put(r)
+	} else {
+		dec.put(rune(b))
+	}
+}
+
+func (dec *cea608) control(b1, b2 byte) {
+	switch {
+	case b2 >= 0x40:
+		dec.preamble(b1, b2)
+	case b1 == 0x11 && b2 >= 0x30:
+		dec.put(cea608Special[b2-0x30])
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 < 0x40:
+		// extended characters replace the standard character sent before
+		dec.backspace()
+		if b1 == 0x12 {
+			dec.put(cea608Extended1[b2-0x20])
+		} else {
+			dec.put(cea608Extended2[b2-0x20])
+		}
+	case b1 == 0x11 && b2 >= 0x20:
+		// mid-row codes are displayed as a space
+		dec.put(' ')
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		dec.col += int(b2 - 0x20)
+		if dec.col >= cea608Columns {
+			dec.col = cea608Columns - 1
+		}
+	case b1 == 0x14 && b2 >= 0x20 && b2 < 0x30:
+		dec.command(b2)
+	}
+}
+
+func (dec *cea608) preamble(b1, b2 byte) {
+	row := cea608PACRows[b1&0x07]
+	if b1&0x07 != 0 && b2&0x20 != 0 {
+		row++
+	}
+	if dec.mode == captionRollUp && row < dec.rollRows-1 {
+		row = dec.rollRows - 1
+	}
+	dec.row = row
+	dec.col = 0
+	if b2&0x10 != 0 {
+		dec.col = int(b2&0x0e) >> 1 * 4
+	}
+}
+
+func (dec *cea608) command(cmd byte) {
+	switch cmd {
+	case 0x20: // resume caption loading
+		dec.mode = captionPopOn
+	case 0x21: // backspace
+		dec.backspace()
+	case 0x24: // delete to end of row
+		mem := dec.memory()
+		for col := dec.col; col < cea608Columns; col++ {
+			mem[dec.row][col] = 0
+		}
+	case 0x25, 0x26, 0x27: // roll-up captions with 2, 3 or 4 rows
+		if dec.mode != captionRollUp {
+			dec.displayed = captionScreen{}
+			dec.dirty = true
+			dec.row = cea608Rows - 1
+		}
+		dec.mode = captionRollUp
+		dec.rollRows = int(cmd-0x25) + 2
+		dec.col = 0
+	case 0x29: // resume direct captioning
+		dec.mode = captionPaintOn
+	case 0x2c: // erase displayed memory
+		dec.displayed = captionScreen{}
+		dec.dirty = true
+	case 0x2d: // carriage return
+		if dec.mode != captionRollUp {
+			return
+		}
+		top := dec.row - dec.rollRows + 1
+		for row := 0; row < dec.row; row++ {
+			if row >= top {
+				dec.displayed[row] = dec.displayed[row+1]
+			} else {
+				dec.displayed[row] = [cea608Columns]rune{}
+			}
+		}
+		dec.displayed[dec.row] = [cea608Columns]rune{}
+		dec.col = 0
+		dec.dirty = true
+	case 0x2e: // erase non-displayed memory
+		dec.buffer = captionScreen{}
+	case 0x2f: // end of caption, the loaded caption is displayed
+		dec.displayed, dec.buffer = dec.buffer, dec.displayed
+		dec.mode = captionPopOn
+		dec.dirty = true
+	}
+}
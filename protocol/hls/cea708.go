@@ -0,0 +1,254 @@
+package hls
+
+import "strings"
+
+const cea708Windows = 8
+
+// number of parameter bytes of the C1 commands 0x80 to 0x9f
+var cea708C1Params = [32]int{
+	0, 0, 0, 0, 0, 0, 0, 0, // CW0-CW7
+	1, 1, 1, 1, 1, 1, 0, 0, // CLW DSW HDW TGW DLW DLY DLC RST
+	2, 3, 2, 0, 0, 0, 0, 4, // SPA SPC SPL reserved SWA
+	6, 6, 6, 6, 6, 6, 6, 6, // DF0-DF7
+}
+
+// characters of the G2 set used for captions, the others are spaces
+var cea708G2 = map[byte]rune{
+	0x25: '…', 0x2a: 'Š', 0x2c: 'Œ', 0x30: '█', 0x31: '‘', 0x32: '’',
+	0x33: '“', 0x34: '”', 0x35: '•', 0x39: '™', 0x3a: 'š', 0x3c: 'œ',
+	0x3d: '℠', 0x3f: 'Ÿ', 0x76: '⅛', 0x77: '⅜', 0x78: '⅝', 0x79: '⅞',
+	0x7a: '│', 0x7b: '┐', 0x7c: '└', 0x7d: '─', 0x7e: '┘', 0x7f: '┌',
+}
+
+type captionWindow struct {
+	defined bool
+	visible bool
+	lines   []string
+}
+
+func (window *captionWindow) put(r rune) {
+	if len(window.lines) == 0 {
+		window.lines = []string{""}
+	}
+	window.lines[len(window.lines)-1] += string(r)
+}
+
+// cea708 decode the service 1 of the DTVCC packets into the text displayed
+// by the visible windows, the pen and window attributes are ignored
+type cea708 struct {
+	packet  []byte
+	size    int
+	current int
+	windows [cea708Windows]captionWindow
+	dirty   bool
+}
+
+func newCEA708() *cea708 {
+	return &cea708{}
+}
+
+// decode process a cc_data triplet of cc_type 2 or 3, it return true with
+// the text on screen when a complete packet changed it
+func (dec *cea708) decode(ccType, b1, b2 byte) (string, bool) {
+	if ccType == 3 {
+		// packet start, size_code 0 is a packet of 128 bytes
+		dec.size = int(b1&0x3f) * 2
+		if dec.size == 0 {
+			dec.size = 128
+		}
+		dec.packet = append(dec.packet[:0], b1, b2)
+	} else if dec.size == 0 {
+		// the start of the packet was lost
+		return "", false
+	} else {
+		dec.packet = append(dec.packet, b1, b2)
+	}
+	if len(dec.packet) < dec.size {
+		return "", false
+	}
+	dec.service(dec.packet[1:dec.size])
+	dec.packet = dec.packet[:0]
+	dec.size = 0
+	if !dec.dirty {
+		return "", false
+	}
+	dec.dirty = false
+	return dec.text(), true
+}
+
+// service run the blocks of service 1 in the payload of a packet
+func (dec *cea708) service(data []byte) {
+	for len(data) > 0 {
+		number, size := int(data[0]>>5), int(data[0]&0x1f)
+		data = data[1:]
+		if number == 0 {
+			// null block, the rest of the packet is padding
+			return
+		}
+		if number == 7 && len(data) > 0 {
+			number = int(data[0] & 0x3f)
+			data = data[1:]
+		}
+		if size > len(data) {
+			size = len(data)
+		}
+		if number == 1 {
+			dec.block(data[:size])
+		}
+		data = data[size:]
+	}
+}
+
+func (dec *cea708) block(data []byte) {
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == 0x10:
+			// EXT1, the extended sets
+			if i+1 >= len(data) {
+				return
+			}
+			i++
+			c = data[i]
+			switch {
+			case c < 0x08:
+			case c < 0x10:
+				i++
+			case c < 0x18:
+				i += 2
+			case c < 0x20:
+				i += 3
+			case c < 0x80:
+				if r, ok := cea708G2[c]; ok {
+					dec.put(r)
+				} else {
+					dec.put(' ')
+				}
+			case c < 0x88:
+				i += 4
+			case c < 0x90:
+				i += 5
+			case c < 0xa0:
+				// variable length C3 commands
+				if i+1 < len(data) {
+					i += 1 + int(data[i+1]&0x3f)
+				}
+			default:
+				// G3 has the closed caption icon only
+				dec.put('?')
+			}
+		case c < 0x20:
+			dec.control(c)
+			if c >= 0x18 {
+				i += 2
+			} else if c >= 0x11 {
+				i++
+			}
+		case c < 0x7f:
+			dec.put(rune(c))
+		case c == 0x7f:
+			dec.put('♪')
+		case c < 0xa0:
+			n := cea708C1Params[c-0x80]
+			if i+n >= len(data) {
+				return
+			}
+			dec.command(c, data[i+1:i+1+n])
+			i += n
+		default:
+			// G1 is ISO 8859-1
+			dec.put(rune(c))
+		}
+	}
+}
+
+func (dec *cea708) put(r rune) {
+	window := &dec.windows[dec.current]
+	if !window.defined {
+		return
+	}
+	window.put(r)
+	dec.dirty = dec.dirty || window.visible
+}
+
+func (dec *cea708) control(c byte) {
+	window := &dec.windows[dec.current]
+	if !window.defined {
+		return
+	}
+	switch c {
+	case 0x08: // backspace
+		if n := len(window.lines); n > 0 {
+			line := []rune(window.lines[n-1])
+			if len(line) > 0 {
+				window.lines[n-1] = string(line[:len(line)-1])
+			}
+		}
+	case 0x0c: // form feed, clear the window
+		window.lines = nil
+	case 0x0d: // carriage return
+		window.lines = append(window.lines, "")
+	case 0x0e: // horizontal carriage return, clear the line
+		if n := len(window.lines); n > 0 {
+			window.lines[n-1] = ""
+		}
+	default:
+		return
+	}
+	dec.dirty = dec.dirty || window.visible
+}
+
+// command run a C1 command, the windows are selected by a bit mask
+func (dec *cea708) command(c byte, params []byte) {
+	apply := func(f func(window *captionWindow)) {
+		for i := range dec.windows {
+			if params[0]&(1<<uint(i)) != 0 {
+				visible := dec.windows[i].visible
+				f(&dec.windows[i])
+				dec.dirty = dec.dirty || visible || dec.windows[i].visible
+			}
+		}
+	}
+	switch {
+	case c <= 0x87: // CWx set current window
+		dec.current = int(c - 0x80)
+	case c == 0x88: // CLW clear windows
+		apply(func(window *captionWindow) { window.lines = nil })
+	case c == 0x89: // DSW display windows
+		apply(func(window *captionWindow) { window.visible = window.defined })
+	case c == 0x8a: // HDW hide windows
+		apply(func(window *captionWindow) { window.visible = false })
+	case c == 0x8b: // TGW toggle windows
+		apply(func(window *captionWindow) { window.visible = window.defined && !window.visible })
+	case c == 0x8c: // DLW delete windows
+		apply(func(window *captionWindow) { *window = captionWindow{} })
+	case c == 0x8f: // RST reset
+		for i := range dec.windows {
+			dec.dirty = dec.dirty || dec.windows[i].visible
+			dec.windows[i] = captionWindow{}
+		}
+	case c >= 0x98: // DFx define window, an existing window keeps its text
+		dec.current = int(c - 0x98)
+		window := &dec.windows[dec.current]
+		visible := params[0]&0x20 != 0
+		dec.dirty = dec.dirty || window.visible != visible && len(window.lines) > 0
+		window.defined = true
+		window.visible = visible
+	}
+}
+
+// text return the lines of the visible windows
+func (dec *cea708) text() string {
+	var lines []string
+	for _, window := range dec.windows {
+		if !window.visible {
+			continue
+		}
+		for _, line := range window.lines {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,98 @@
+package hls
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+const (
+	// data message of the encoders sending their system time
+	onFI = "onFI"
+	// layout of the sd and st fields of onFI
+	onFILayout = "02-01-2006 15:04:05"
+	// layout of EXT-X-PROGRAM-DATE-TIME
+	programDateTimeLayout = "2006-01-02T15:04:05.000Z"
+)
+
+// creation date layouts of onMetaData
+var creationDateLayouts = []string{
+	time.RFC3339Nano,
+	time.ANSIC,
+}
+
+// wallClock map the stream timestamps to the wall clock. The mapping is
+// taken on the server clock when the stream starts or its timestamps jump,
+// unless the publisher gave its own clock.
+type wallClock struct {
+	set       bool
+	publisher bool
+	base      time.Time
+	timestamp uint32
+}
+
+// sync map timestamp to the current time, a publisher clock is kept unless
+// reset is set
+func (clock *wallClock) sync(timestamp uint32, reset bool) {
+	if clock.set && clock.publisher && !reset {
+		return
+	}
+	clock.set = true
+	clock.publisher = false
+	clock.base = time.Now()
+	clock.timestamp = timestamp
+}
+
+// setPublisher map timestamp to t given by the publisher
+func (clock *wallClock) setPublisher(t time.Time, timestamp uint32) {
+	clock.set = true
+	clock.publisher = true
+	clock.base = t
+	clock.timestamp = timestamp
+}
+
+// at return the wall clock time of timestamp
+func (clock *wallClock) at(timestamp uint32) time.Time {
+	return clock.base.Add(time.Duration(int64(timestamp)-int64(clock.timestamp)) * time.Millisecond)
+}
+
+// publisherTime return the absolute time carried by a data message, the
+// system time of onFI or the creation date of onMetaData
+func publisherTime(data []byte) (time.Time, bool) {
+	decoder := &amf.Decoder{}
+	values, _ := decoder.DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if len(values) > 0 && values[0] == amf.SetDataFrame {
+		values = values[1:]
+	}
+	if len(values) < 2 {
+		return time.Time{}, false
+	}
+	name, _ := values[0].(string)
+	obj, ok := values[1].(amf.Object)
+	if !ok {
+		return time.Time{}, false
+	}
+	switch name {
+	case onFI:
+		sd, _ := obj["sd"].(string)
+		st, _ := obj["st"].(string)
+		if t, err := time.ParseInLocation(onFILayout, sd+" "+st, time.Local); err == nil {
+			return t, true
+		}
+	case amf.OnMetaData:
+		date, _ := obj["creationdate"].(string)
+		date = strings.TrimSpace(date)
+		for _, layout := range creationDateLayouts {
+			if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func formatProgramDateTime(t time.Time) string {
+	return t.UTC().Format(programDateTimeLayout)
+}
@@ -0,0 +1,51 @@
+package hls
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeData(t *testing.T, values ...interface{}) []byte {
+	b := bytes.NewBuffer(nil)
+	encoder := &amf.Encoder{}
+	if _, err := encoder.EncodeBatch(b, amf.AMF0, values...); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestPublisherTime(t *testing.T) {
+	at := assert.New(t)
+	data := encodeData(t, "onFI", amf.Object{"sd": "17-10-2026", "st": "11:51:24.250"})
+	tm, ok := publisherTime(data)
+	at.True(ok)
+	at.Equal(time.Date(2026, 10, 17, 11, 51, 24, 250*int(time.Millisecond), time.Local), tm)
+
+	data = encodeData(t, amf.SetDataFrame, amf.OnMetaData, amf.Object{"creationdate": "2026-10-17T11:51:24Z"})
+	tm, ok = publisherTime(data)
+	at.True(ok)
+	at.Equal("2026-10-17T11:51:24.000Z", formatProgramDateTime(tm))
+
+	data = encodeData(t, amf.OnMetaData, amf.Object{"width": float64(1280)})
+	_, ok = publisherTime(data)
+	at.False(ok)
+}
+
+func TestWallClock(t *testing.T) {
+	at := assert.New(t)
+	var clock wallClock
+	base := time.Date(2026, 10, 17, 11, 51, 24, 0, time.UTC)
+	clock.setPublisher(base, 1000)
+	at.Equal(base.Add(2500*time.Millisecond), clock.at(3500))
+
+	// the publisher clock is only left when the timestamps jump
+	clock.sync(4000, false)
+	at.Equal(base, clock.at(1000))
+	clock.sync(4000, true)
+	at.True(clock.at(4000).After(base))
+}
@@ -0,0 +1,170 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	encryptionAES128    = "aes-128"
+	encryptionSampleAES = "sample-aes"
+
+	methodAES128    = "AES-128"
+	methodSampleAES = "SAMPLE-AES"
+)
+
+// segmentKey is the key of a segment, the IV of a segment is its media
+// sequence number as the playlist does not carry an IV attribute
+type segmentKey struct {
+	method string
+	uri    string
+	block  cipher.Block
+}
+
+func newSegmentKey(method, uri string, key []byte) (*segmentKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentKey{
+		method: method,
+		uri:    uri,
+		block:  block,
+	}, nil
+}
+
+func sequenceIV(seq int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+// keyLine return the EXT-X-KEY tag of the segments using method and uri
+func keyLine(method, uri string) string {
+	if method == "" {
+		return "#EXT-X-KEY:METHOD=NONE\n"
+	}
+	return fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"%s\"\n", method, uri)
+}
+
+// encryptSegment encrypt a whole segment with AES-128 CBC and PKCS7 padding
+func (key *segmentKey) encryptSegment(seq int, data []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data)+padding)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(key.block, sequenceIV(seq)).CryptBlocks(out, out)
+	return out
+}
+
+// encryptVideo apply SAMPLE-AES to the slice NAL units of an Annex B access
+// unit: the emulation prevention bytes are removed, after 32 clear bytes one
+// block of 16 bytes in ten is encrypted, the CBC chain restart with each NAL
+// unit and start code emulation prevention is applied again to the result
+func (key *segmentKey) encryptVideo(seq int, data []byte) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+len(data)/64))
+	iv := sequenceIV(seq)
+	for len(data) > 0 {
+		start, next := nextNALU(data)
+		nalu := data[start:next]
+		out.Write(data[:start])
+		data = data[next:]
+		if len(nalu) <= 48 || (nalu[0]&0x1f != 1 && nalu[0]&0x1f != 5) {
+			out.Write(nalu)
+			continue
+		}
+		enc := removeEmulationPrevention(nalu)
+		mode := cipher.NewCBCEncrypter(key.block, iv)
+		for i := 32; i+aes.BlockSize < len(enc); i += 160 {
+			mode.CryptBlocks(enc[i:i+aes.BlockSize], enc[i:i+aes.BlockSize])
+		}
+		writeEmulationPrevention(out, enc)
+	}
+	return out.Bytes()
+}
+
+// encryptAudio apply SAMPLE-AES to an ADTS frame, the header and 16 bytes
+// stay clear, then the full blocks are encrypted
+func (key *segmentKey) encryptAudio(seq int, frame []byte) []byte {
+	if len(frame) < 7 {
+		return frame
+	}
+	header := 7
+	if frame[1]&0x01 == 0 {
+		header = 9
+	}
+	start := header + 16
+	if len(frame) <= start {
+		return frame
+	}
+	out := make([]byte, len(frame))
+	copy(out, frame)
+	end := start + (len(frame)-start)/aes.BlockSize*aes.BlockSize
+	cipher.NewCBCEncrypter(key.block, sequenceIV(seq)).CryptBlocks(out[start:end], out[start:end])
+	return out
+}
+
+// nextNALU return the bounds of the first NAL unit of an Annex B buffer,
+// start is the offset after its start code and next the offset of the
+// following start code
+func nextNALU(data []byte) (start, next int) {
+	for start+2 < len(data) && !(data[start] == 0 && data[start+1] == 0 && data[start+2] == 1) {
+		start++
+	}
+	if start+2 >= len(data) {
+		return len(data), len(data)
+	}
+	start += 3
+	next = start
+	for next+2 < len(data) {
+		if data[next] == 0 && data[next+1] == 0 && (data[next+2] == 1 ||
+			(data[next+2] == 0 && next+3 < len(data) && data[next+3] == 1)) {
+			return start, next
+		}
+		next++
+	}
+	return start, len(data)
+}
+
+// removeEmulationPrevention return a copy of the NAL unit b without the 0x03
+// bytes which follow two zero bytes
+func removeEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// writeEmulationPrevention write b inserting 0x03 after two zero bytes
+// followed by a byte lower than 4
+func writeEmulationPrevention(w *bytes.Buffer, b []byte) {
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			w.WriteByte(0x03)
+			zeros = 0
+		}
+		w.WriteByte(c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+func TestEncryptSegment(t *testing.T) {
+	at := assert.New(t)
+	key, err := newSegmentKey(methodAES128, "/key/live/test/1.key", testKey)
+	at.Equal(nil, err)
+
+	data := bytes.Repeat([]byte{0x47}, 188)
+	out := key.encryptSegment(7, data)
+	at.Equal(192, len(out))
+
+	block, _ := aes.NewCipher(testKey)
+	cipher.NewCBCDecrypter(block, sequenceIV(7)).CryptBlocks(out, out)
+	at.Equal(data, out[:188])
+	at.Equal(bytes.Repeat([]byte{4}, 4), out[188:])
+}
+
+func TestEncryptVideo(t *testing.T) {
+	at := assert.New(t)
+	key, _ := newSegmentKey(methodSampleAES, "/key/live/test/1.key", testKey)
+
+	sps := []byte{0x67, 0x64, 0x00, 0x28}
+	slice := make([]byte, 400)
+	slice[0] = 0x65
+	for i := 1; i < len(slice); i++ {
+		slice[i] = byte(i)
+	}
+	// an escaped 00 00 01 in the clear leader shifts the encrypted blocks
+	copy(slice[10:], []byte{0, 0, 3, 1})
+	raw := removeEmulationPrevention(slice)
+	var au []byte
+	au = append(au, 0, 0, 0, 1)
+	au = append(au, sps...)
+	au = append(au, 0, 0, 0, 1)
+	au = append(au, slice...)
+
+	out := key.encryptVideo(3, au)
+	// the SPS is left clear
+	at.Equal(au[:8], out[:8])
+	start, _ := nextNALU(out[8:])
+	enc := removeEmulationPrevention(out[8+start:])
+	at.Equal(len(raw), len(enc))
+	at.Equal(raw[:32], enc[:32])
+	at.NotEqual(raw[32:48], enc[32:48])
+	at.Equal(raw[48:192], enc[48:192])
+
+	// decrypt the protected blocks with a single CBC chain
+	block, _ := aes.NewCipher(testKey)
+	mode := cipher.NewCBCDecrypter(block, sequenceIV(3))
+	for i := 32; i+16 < len(enc); i += 160 {
+		mode.CryptBlocks(enc[i:i+16], enc[i:i+16])
+	}
+	at.Equal(raw, enc)
+}
+
+func TestEncryptAudio(t *testing.T) {
+	at := assert.New(t)
+	key, _ := newSegmentKey(methodSampleAES, "/key/live/test/1.key", testKey)
+
+	frame := make([]byte, 7+16+40)
+	frame[0], frame[1] = 0xff, 0xf1
+	out := key.encryptAudio(3, frame)
+	at.Equal(frame[:23], out[:23])
+	at.NotEqual(frame[23:55], out[23:55])
+	// the last partial block stays clear
+	at.Equal(frame[55:], out[55:])
+
+	short := make([]byte, 7+16)
+	short[0], short[1] = 0xff, 0xf1
+	at.Equal(short, key.encryptAudio(3, short))
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "keys")
+	at.Equal(nil, err)
+	defer os.RemoveAll(dir)
+
+	provider := NewFileKeyProvider(dir)
+	id, key, err := provider.NewKey("live/test")
+	at.Equal(nil, err)
+	at.Equal(keyLen, len(key))
+	got, err := provider.Key("live/test", id)
+	at.Equal(nil, err)
+	at.Equal(key, got)
+	_, err = provider.Key("live/test", "1")
+	at.Equal(ErrNoKey, err)
+	_, err = provider.Key("live/test", "../test/"+id)
+	at.Equal(ErrInvalidKey, err)
+}
+
+func TestHTTPKeyProvider(t *testing.T) {
+	at := assert.New(t)
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		at.Equal("live/test", r.URL.Query().Get("stream"))
+		w.Write([]byte(hex.EncodeToString(testKey)))
+	}))
+	defer ts.Close()
+
+	provider := NewHTTPKeyProvider(ts.URL)
+	id, key, err := provider.NewKey("live/test")
+	at.Equal(nil, err)
+	at.Equal(testKey, key)
+	got, err := provider.Key("live/test", id)
+	at.Equal(nil, err)
+	at.Equal(testKey, got)
+	at.Equal(1, calls)
+
+	// the key service is not asked for ids the stream did not issue
+	_, err = provider.Key("live/test", "1")
+	at.Equal(ErrNoKey, err)
+	_, err = provider.Key("live/other", id)
+	at.Equal(ErrNoKey, err)
+	at.Equal(1, calls)
+}
@@ -0,0 +1,212 @@
+package hls
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrDVRPath = fmt.Errorf("dvr path outside of the dvr directory")
+
+type dvrItem struct {
+	TSItem
+	size    int64
+	written time.Time
+}
+
+// dvrQuota is the disk usage of all the streams stored in a DVR directory,
+// when it exceeds maxSize the oldest segment of the directory is evicted
+type dvrQuota struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	stores  map[*dvrStore]struct{}
+}
+
+var dvrQuotas = struct {
+	sync.Mutex
+	m map[string]*dvrQuota
+}{m: make(map[string]*dvrQuota)}
+
+func getDVRQuota(root string, maxSize int64) *dvrQuota {
+	dvrQuotas.Lock()
+	defer dvrQuotas.Unlock()
+
+	quota, ok := dvrQuotas.m[root]
+	if !ok {
+		quota = &dvrQuota{stores: make(map[*dvrStore]struct{})}
+		dvrQuotas.m[root] = quota
+	}
+	quota.lock.Lock()
+	quota.maxSize = maxSize
+	quota.lock.Unlock()
+	return quota
+}
+
+// dvrStore keep the segments of the DVR window on disk, the segments are
+// evicted when they leave the window or the DVR directory exceeds its quota
+type dvrStore struct {
+	dir      string
+	window   int64
+	quota    *dvrQuota
+	lock     sync.RWMutex
+	items    []dvrItem
+	duration int64
+	size     int64
+}
+
+// dvrPath return the directory of the stream id under the absolute root, the
+// id comes from the publisher so a path not strictly under root is refused
+func dvrPath(root, id string) (string, error) {
+	dir := filepath.Join(root, filepath.FromSlash(id))
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrDVRPath
+	}
+	return dir, nil
+}
+
+// newDVRStore create the store of the stream id under root, segments left by
+// a previous publication of the stream are removed. maxSize is the quota of
+// all the streams stored under root.
+func newDVRStore(root, id string, window, maxSize int64) (*dvrStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := dvrPath(root, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &dvrStore{
+		dir:    dir,
+		window: window,
+		quota:  getDVRQuota(root, maxSize),
+	}
+	store.quota.lock.Lock()
+	store.quota.stores[store] = struct{}{}
+	store.quota.lock.Unlock()
+	return store, nil
+}
+
+func (store *dvrStore) path(name string) string {
+	return filepath.Join(store.dir, path.Base(name))
+}
+
+// add write the segment to disk and evict the segments which left the window,
+// then the oldest segments of the directory while it exceeds its quota. The
+// live segment of a stream is never evicted.
+func (store *dvrStore) add(item TSItem) error {
+	if err := ioutil.WriteFile(store.path(item.Name), item.Data, 0644); err != nil {
+		return err
+	}
+	size := int64(len(item.Data))
+	item.Data = nil
+	item.Parts = nil
+
+	quota := store.quota
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	store.lock.Lock()
+	store.items = append(store.items, dvrItem{TSItem: item, size: size, written: time.Now()})
+	store.duration += int64(item.Duration)
+	store.size += size
+	quota.size += size
+	for len(store.items) > 1 && store.duration > store.window {
+		quota.size -= store.evict()
+	}
+	store.lock.Unlock()
+
+	for quota.maxSize > 0 && quota.size > quota.maxSize {
+		var oldest *dvrStore
+		var written time.Time
+		for s := range quota.stores {
+			s.lock.RLock()
+			if len(s.items) > 1 && (oldest == nil || s.items[0].written.Before(written)) {
+				oldest, written = s, s.items[0].written
+			}
+			s.lock.RUnlock()
+		}
+		if oldest == nil {
+			break
+		}
+		oldest.lock.Lock()
+		quota.size -= oldest.evict()
+		oldest.lock.Unlock()
+	}
+	return nil
+}
+
+// evict remove the oldest segment and return its size, store.lock is held
+func (store *dvrStore) evict() int64 {
+	old := store.items[0]
+	store.items = store.items[1:]
+	store.duration -= int64(old.Duration)
+	store.size -= old.size
+	if err := os.Remove(store.path(old.Name)); err != nil {
+		log.Warning("remove dvr segment: ", err)
+	}
+	return old.size
+}
+
+// list return the segments of the window without their data
+func (store *dvrStore) list() []TSItem {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	items := make([]TSItem, len(store.items))
+	for i := range store.items {
+		items[i] = store.items[i].TSItem
+	}
+	return items
+}
+
+// read load the segment name from disk
+func (store *dvrStore) read(name string) (TSItem, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, v := range store.items {
+		if v.Name != name {
+			continue
+		}
+		data, err := ioutil.ReadFile(store.path(name))
+		if err != nil {
+			return v.TSItem, err
+		}
+		v.Data = data
+		return v.TSItem, nil
+	}
+	return TSItem{}, ErrNoKey
+}
+
+// close remove the segments from disk
+func (store *dvrStore) close() error {
+	store.quota.lock.Lock()
+	defer store.quota.lock.Unlock()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.quota.stores, store)
+	store.quota.size -= store.size
+	store.items = nil
+	store.size = 0
+	return os.RemoveAll(store.dir)
+}
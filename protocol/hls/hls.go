@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,21 +14,25 @@ import (
 	"github.com/gwuhaolin/livego/configure"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/hook"
 
+	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	duration = 3000
-)
-
 var (
 	ErrNoPublisher         = fmt.Errorf("no publisher")
 	ErrInvalidReq          = fmt.Errorf("invalid req url path")
 	ErrNoSupportVideoCodec = fmt.Errorf("no support video codec")
 	ErrNoSupportAudioCodec = fmt.Errorf("no support audio codec")
+	ErrPlayNotAllowed      = fmt.Errorf("play not allowed")
+	ErrPlayListTimeout     = fmt.Errorf("playlist update timeout")
 )
 
+// reconnectGrace is how long the numbering of a removed stream is kept for
+// its publisher to reconnect
+const reconnectGrace = 10 * time.Minute
+
 var crossdomainxml = []byte(`<?xml version="1.0" ?>
 <cross-domain-policy>
 	<allow-access-from domain="*" />
@@ -36,12 +41,25 @@ var crossdomainxml = []byte(`<?xml version="1.0" ?>
 
 type Server struct {
 	listener net.Listener
+	lock     sync.Mutex
 	conns    *sync.Map
+	// sequences keep the numbering of the removed streams so that segment
+	// names are not reused by a publisher reconnecting within reconnectGrace
+	sequences *cache.Cache
+	sessions  *hook.PlaySessions
+	viewers   *sessionStore
 }
 
 func NewServer() *Server {
+	sessionTimeout := configure.Config.GetInt("hls_session_timeout")
+	if sessionTimeout <= 0 {
+		sessionTimeout = 30
+	}
 	ret := &Server{
-		conns: &sync.Map{},
+		conns:     &sync.Map{},
+		sequences: cache.New(reconnectGrace, reconnectGrace/2),
+		sessions:  hook.NewPlaySessions(time.Second * time.Duration(sessionTimeout)),
+		viewers:   newSessionStore(time.Second * time.Duration(sessionTimeout)),
 	}
 	go ret.checkStop()
 	return ret
@@ -63,16 +81,27 @@ func (server *Server) Serve(listener net.Listener) error {
 	return nil
 }
 
+// GetWriter return the source of info.Key, a publisher reconnecting on the
+// key continues the playlist and the segment numbering of the previous one
 func (server *Server) GetWriter(info av.Info) av.WriteCloser {
-	var s *Source
-	v, ok := server.conns.Load(info.Key)
-	if !ok {
-		log.Debug("new hls source")
-		s = NewSource(info)
-		server.conns.Store(info.Key, s)
-	} else {
-		s = v.(*Source)
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	var state sequence
+	if v, ok := server.conns.Load(info.Key); ok {
+		s := v.(*Source)
+		if !s.closed {
+			return s
+		}
+		log.Debug("resume hls source")
+		state = s.sequence()
+	} else if v, ok := server.sequences.Get(info.Key); ok {
+		server.sequences.Delete(info.Key)
+		state = v.(sequence)
 	}
+	log.Debug("new hls source")
+	s := newSource(info, state)
+	server.conns.Store(info.Key, s)
 	return s
 }
 
@@ -88,14 +117,17 @@ func (server *Server) checkStop() {
 	for {
 		<-time.After(5 * time.Second)
 
+		server.lock.Lock()
 		server.conns.Range(func(key, val interface{}) bool {
 			v := val.(*Source)
 			if !v.Alive() && !configure.Config.GetBool("hls_keep_after_end") {
 				log.Debug("check stop and remove: ", v.Info())
 				server.conns.Delete(key)
+				server.sequences.SetDefault(key.(string), v.release())
 			}
 			return true
 		})
+		server.lock.Unlock()
 	}
 }
 
@@ -105,50 +137,338 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 		w.Write(crossdomainxml)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, recordPrefix) && strings.Count(r.URL.Path, "/") > 3 {
+		server.handleRecord(w, r)
+		return
+	}
 	switch path.Ext(r.URL.Path) {
+	case ".key":
+		server.handleKey(w, r)
 	case ".m3u8":
 		key, _ := server.parseM3u8(r.URL.Path)
+		if strings.Count(key, "/") == 2 {
+			server.handleStreamPlayList(w, r, path.Dir(key), path.Base(key))
+			return
+		}
+		if server.handleMaster(w, r, key) {
+			return
+		}
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
+		if err := server.authorize(w, r, key); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		tsCache := conn.GetCacheInc()
 		if tsCache == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
+		if tsCache.LowLatency() {
+			if code, err := server.blockReload(tsCache, r); err != nil {
+				http.Error(w, err.Error(), code)
+				return
+			}
+		}
 		body, err := tsCache.GenM3U8PlayList()
 		if err != nil {
 			log.Debug("GenM3U8PlayList error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
+		server.writePlayList(w, r, key, body)
+	case ".vtt":
+		key, _ := server.parseTs(r.URL.Path)
+		tsCache := server.streamCache(w, r, key)
+		if tsCache == nil {
+			return
+		}
+		data, err := tsCache.GetSubtitles(r.URL.Path)
+		if err != nil {
+			log.Debug("GetSubtitles error: ", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Content-Type", "application/x-mpegURL")
-		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
-		w.Write(body)
-	case ".ts":
+		w.Header().Set("Content-Type", "text/vtt")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		server.served(w, r, key, len(data), false)
+	case ".ts", ".m4s", ".mp4":
 		key, _ := server.parseTs(r.URL.Path)
 		conn := server.getConn(key)
 		if conn == nil {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
+		if err := server.authorize(w, r, key); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		tsCache := conn.GetCacheInc()
-		item, err := tsCache.GetItem(r.URL.Path)
+		if tsCache == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		var data []byte
+		var err error
+		if path.Ext(r.URL.Path) == ".mp4" {
+			data, err = tsCache.GetInit(r.URL.Path)
+		} else {
+			data, err = server.getData(tsCache, r.URL.Path)
+		}
 		if err != nil {
 			log.Debug("GetItem error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if path.Ext(r.URL.Path) == ".ts" {
+			w.Header().Set("Content-Type", "video/mp2ts")
+		} else {
+			w.Header().Set("Content-Type", "video/mp4")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		server.served(w, r, key, len(data), path.Ext(r.URL.Path) != ".mp4")
+	}
+}
+
+// handleMaster serve the master playlist when key names a variant group of
+// its application, it return false for other keys
+func (server *Server) handleMaster(w http.ResponseWriter, r *http.Request, key string) bool {
+	paths := strings.SplitN(key, "/", 2)
+	if len(paths) != 2 {
+		return false
+	}
+	group, ok := configure.Variants.Get(paths[0], paths[1])
+	if !ok {
+		return false
+	}
+	if err := server.authorize(w, r, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return true
+	}
+	body, err := GenMasterPlayList(group, func(name string) *TSCacheItem {
+		conn := server.getConn(paths[0] + "/" + name)
+		if conn == nil {
+			return nil
+		}
+		return conn.GetCacheInc()
+	}, r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return true
+	}
+	server.writePlayList(w, r, key, body)
+	return true
+}
+
+// handleStreamPlayList serve the playlists below the stream key, the
+// subtitles playlist and the master playlist linking it to the stream
+func (server *Server) handleStreamPlayList(w http.ResponseWriter, r *http.Request, key, name string) {
+	tsCache := server.streamCache(w, r, key)
+	if tsCache == nil {
+		return
+	}
+	var body []byte
+	var err error
+	switch name {
+	case "master":
+		body, err = GenStreamMasterPlayList(path.Base(key), tsCache, r.URL.RawQuery)
+	case "subtitles":
+		body, err = tsCache.GenSubtitlesPlayList()
+	default:
+		err = ErrInvalidReq
+	}
+	if err != nil {
+		log.Debug("stream playlist error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	server.writePlayList(w, r, key, body)
+}
+
+// writePlayList serve a playlist of the stream key, a viewer without
+// session is issued one which is added to the URIs of the playlist
+func (server *Server) writePlayList(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	session := server.viewers.get(w, r, key, true)
+	body = withSession(body, session.ID)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+	server.viewers.served(session, len(body), false)
+}
+
+// served count the n bytes served to the viewer session of r, segment is
+// set for media segments and partial segments
+func (server *Server) served(w http.ResponseWriter, r *http.Request, key string, n int, segment bool) {
+	if session := server.viewers.get(w, r, key, false); session != nil {
+		server.viewers.served(session, n, segment)
+	}
+}
+
+// Stats return the HLS viewers of the stream key, or of every stream when
+// key is empty
+func (server *Server) Stats(key string) []StreamStat {
+	return server.viewers.stats(key)
+}
+
+// streamCache return the cache of the stream key to an authorized viewer,
+// the request is answered with an error when it return nil
+func (server *Server) streamCache(w http.ResponseWriter, r *http.Request, key string) *TSCacheItem {
+	conn := server.getConn(key)
+	if conn == nil {
+		http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+		return nil
+	}
+	if err := server.authorize(w, r, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+	tsCache := conn.GetCacheInc()
+	if tsCache == nil {
+		http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+	}
+	return tsCache
+}
+
+// handleKey serve the key /key/APP/NAME/ID.key to the viewers admitted by
+// the on_play hook of the stream, keys are never served without the hook
+func (server *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(strings.TrimPrefix(r.URL.Path, keyPrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, keyPrefix) || len(paths) != 3 || strings.Contains(r.URL.Path, "..") {
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+		return
+	}
+	key := paths[0] + "/" + paths[1]
+	if !hasOnPlay(paths[0]) {
+		http.Error(w, ErrPlayNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	if err := server.authorize(w, r, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	data, err := GetKeyProvider(paths[0]).Key(key, strings.TrimSuffix(paths[2], ".key"))
+	if err != nil {
+		log.Debug("get key error: ", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+	server.served(w, r, key, len(data), false)
+}
+
+// hasOnPlay tell whether the viewers of appname are authorized by an
+// on_play hook
+func hasOnPlay(appname string) bool {
+	app, ok := configure.GetApplication(appname)
+	return ok && app.OnPlay != ""
+}
+
+// handleRecord serve the files of the recordings, the index of a stream key
+// at /record/APP/NAME/index.json and the recordings below it
+func (server *Server) handleRecord(w http.ResponseWriter, r *http.Request) {
+	paths := strings.SplitN(strings.TrimPrefix(r.URL.Path, recordPrefix), "/", 3)
+	if len(paths) != 3 || paths[2] == "" || strings.Contains(r.URL.Path, "..") {
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+		return
+	}
+	key := paths[0] + "/" + paths[1]
+	if err := server.authorize(w, r, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	opts := configure.GetHLSOptions(paths[0])
+	filename := filepath.Join(opts.RecordDir, filepath.FromSlash(key), filepath.FromSlash(paths[2]))
+	switch filepath.Ext(filename) {
+	case ".m3u8":
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/x-mpegURL")
+	case ".json":
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+	case ".ts":
 		w.Header().Set("Content-Type", "video/mp2ts")
-		w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
-		w.Write(item.Data)
+	case ".m4s", ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+	default:
+		http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+		return
 	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeFile(w, r, filename)
+}
+
+// getData return a segment, or in low latency mode a partial segment
+func (server *Server) getData(tsCache *TSCacheItem, name string) ([]byte, error) {
+	item, err := tsCache.GetItem(name)
+	if err == nil || !tsCache.LowLatency() {
+		return item.Data, err
+	}
+	part, err := tsCache.WaitPart(name, tsCache.BlockTimeout())
+	return part.Data, err
+}
+
+// blockReload hold a playlist request carrying the _HLS_msn and _HLS_part
+// directives until the requested part is available
+func (server *Server) blockReload(tsCache *TSCacheItem, r *http.Request) (int, error) {
+	query := r.URL.Query()
+	if query.Get("_HLS_msn") == "" {
+		// a part is only meaningful within a media sequence number
+		if query.Get("_HLS_part") != "" {
+			return http.StatusBadRequest, ErrInvalidReq
+		}
+		return http.StatusOK, nil
+	}
+	msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+	if err != nil || msn < 0 {
+		return http.StatusBadRequest, ErrInvalidReq
+	}
+	part := -1
+	if query.Get("_HLS_part") != "" {
+		part, err = strconv.Atoi(query.Get("_HLS_part"))
+		if err != nil || part < 0 {
+			return http.StatusBadRequest, ErrInvalidReq
+		}
+	}
+	// requests too far in the future are rejected instead of held
+	if msn > tsCache.NextMSN()+1 {
+		return http.StatusBadRequest, ErrInvalidReq
+	}
+	if !tsCache.WaitPlayList(msn, part, tsCache.BlockTimeout()) {
+		return http.StatusServiceUnavailable, ErrPlayListTimeout
+	}
+	return http.StatusOK, nil
+}
+
+// authorize run the on_play hook once per viewer session. The viewer
+// session is issued by the first playlist request, so that viewers sharing
+// an address are told apart; players which keep neither the session query
+// nor the cookie are identified by their address only.
+func (server *Server) authorize(w http.ResponseWriter, r *http.Request, key string) error {
+	event := hook.NewHTTPEvent(hook.ProtocolHLS, key, r)
+	id := key + "@" + event.Addr
+	playlist := path.Ext(r.URL.Path) == ".m3u8" && !strings.HasPrefix(r.URL.Path, recordPrefix)
+	if session := server.viewers.get(w, r, key, playlist); session != nil {
+		event.ClientID = session.ID
+		id += "/" + session.ID
+	}
+	if err := server.sessions.Authorize(id, event); err != nil {
+		log.Debugf("on_play %s err=%v", key, err)
+		return ErrPlayNotAllowed
+	}
+	return nil
 }
 
 func (server *Server) parseM3u8(pathstr string) (key string, err error) {
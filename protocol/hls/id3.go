@@ -0,0 +1,88 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+const (
+	// owner of the PRIV frame carrying the AMF0 data message
+	id3AMFOwner  = "com.github.gwuhaolin.livego.amf0"
+	id3HeaderLen = 10
+)
+
+// dataMessageID3 convert an AMF data message of the publisher to an ID3 tag:
+// a TXXX frame described by the handler name holding the JSON encoding of
+// its arguments, and a PRIV frame holding the message itself. onMetaData
+// describes the stream and is not converted.
+func dataMessageID3(data []byte) ([]byte, bool) {
+	decoder := &amf.Decoder{}
+	values, _ := decoder.DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if len(values) > 0 && values[0] == amf.SetDataFrame {
+		// AMF0 string marker and length
+		data = data[3+len(amf.SetDataFrame):]
+		values = values[1:]
+	}
+	if len(values) == 0 {
+		return nil, false
+	}
+	name, ok := values[0].(string)
+	if !ok || name == amf.OnMetaData {
+		return nil, false
+	}
+	var frames [][]byte
+	if args, err := json.Marshal(values[1:]); err == nil {
+		frames = append(frames, id3TXXX(name, string(args)))
+	}
+	frames = append(frames, id3PRIV(id3AMFOwner, data))
+	return id3Tag(frames...), true
+}
+
+// id3Tag return an ID3v2.4 tag made of frames
+func id3Tag(frames ...[]byte) []byte {
+	size := 0
+	for _, frame := range frames {
+		size += len(frame)
+	}
+	tag := make([]byte, id3HeaderLen, id3HeaderLen+size)
+	copy(tag, []byte{'I', 'D', '3', 0x04, 0x00, 0x00})
+	putSyncSafe(tag[6:], size)
+	for _, frame := range frames {
+		tag = append(tag, frame...)
+	}
+	return tag
+}
+
+// id3Frame return the frame id with body
+func id3Frame(id string, body []byte) []byte {
+	frame := make([]byte, id3HeaderLen, id3HeaderLen+len(body))
+	copy(frame, id)
+	putSyncSafe(frame[4:], len(body))
+	return append(frame, body...)
+}
+
+// id3TXXX return a user defined text frame in UTF-8
+func id3TXXX(description, value string) []byte {
+	body := []byte{0x03}
+	body = append(body, description...)
+	body = append(body, 0x00)
+	body = append(body, value...)
+	return id3Frame("TXXX", body)
+}
+
+// id3PRIV return a private frame of owner
+func id3PRIV(owner string, data []byte) []byte {
+	body := append([]byte(owner), 0x00)
+	body = append(body, data...)
+	return id3Frame("PRIV", body)
+}
+
+// putSyncSafe write n on 4 bytes of 7 bits
+func putSyncSafe(b []byte, n int) {
+	b[0] = byte(n >> 21 & 0x7f)
+	b[1] = byte(n >> 14 & 0x7f)
+	b[2] = byte(n >> 7 & 0x7f)
+	b[3] = byte(n & 0x7f)
+}
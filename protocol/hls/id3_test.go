@@ -0,0 +1,34 @@
+package hls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataMessageID3(t *testing.T) {
+	at := assert.New(t)
+	msg := encodeData(t, "onTextData", amf.Object{"text": "hello"})
+	tag, ok := dataMessageID3(msg)
+	at.True(ok)
+
+	txxx := id3TXXX("onTextData", `[{"text":"hello"}]`)
+	priv := id3PRIV(id3AMFOwner, msg)
+	at.Equal([]byte{'I', 'D', '3', 0x04, 0x00, 0x00}, tag[:6])
+	size := len(txxx) + len(priv)
+	at.Equal([]byte{0, 0, byte(size >> 7), byte(size & 0x7f)}, tag[6:10])
+	at.Equal(txxx, tag[10:10+len(txxx)])
+	at.Equal(priv, tag[10+len(txxx):])
+	at.Equal([]byte{'T', 'X', 'X', 'X', 0, 0, 0, byte(len(txxx) - 10), 0, 0, 0x03}, txxx[:11])
+
+	// the PRIV frame carries the message without @setDataFrame
+	tag, ok = dataMessageID3(encodeData(t, amf.SetDataFrame, "onCuePoint", amf.Object{"name": "ad"}))
+	at.True(ok)
+	at.True(bytes.HasSuffix(tag, encodeData(t, "onCuePoint", amf.Object{"name": "ad"})))
+
+	_, ok = dataMessageID3(encodeData(t, amf.SetDataFrame, amf.OnMetaData, amf.Object{"width": float64(1280)}))
+	at.False(ok)
+}
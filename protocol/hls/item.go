@@ -1,10 +1,34 @@
 package hls
 
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
 type TSItem struct {
 	Name     string
 	SeqNum   int
 	Duration int
 	Data     []byte
+	Parts    []TSPart
+	// Map is the init segment of fMP4 segments
+	Map string
+	// KeyMethod and KeyURI describe the encryption of the segment
+	KeyMethod string
+	KeyURI    string
+	// Discontinuity is set when the segment does not continue the previous
+	// one, DiscSeq is the number of discontinuities before the segment
+	Discontinuity bool
+	DiscSeq       int
+	// ProgramDateTime is the wall clock time of the first sample
+	ProgramDateTime time.Time
+	// CueOut and CueIn are set on the segments starting and ending an ad break
+	CueOut *Splice
+	CueIn  *Splice
+	// Subtitles is the WebVTT segment of the segment time span
+	Subtitles []byte
 }
 
 func NewTSItem(name string, duration, seqNum int, b []byte) TSItem {
@@ -16,3 +40,39 @@ func NewTSItem(name string, duration, seqNum int, b []byte) TSItem {
 	copy(item.Data, b)
 	return item
 }
+
+// TSPart is a LL-HLS partial segment, Independent is set when it starts
+// with a random access point
+type TSPart struct {
+	Name        string
+	Duration    int
+	Independent bool
+	Data        []byte
+}
+
+func NewTSPart(name string, duration int, independent bool, b []byte) TSPart {
+	var part TSPart
+	part.Name = name
+	part.Duration = duration
+	part.Independent = independent
+	part.Data = make([]byte, len(b))
+	copy(part.Data, b)
+	return part
+}
+
+// partName return the URI of the partial segment index of media sequence msn
+func partName(key string, msn, index int, ext string) string {
+	return fmt.Sprintf("/%s/%d.%d%s", key, msn, index, ext)
+}
+
+// subtitlesName return the URI of the WebVTT segment of the segment name
+func subtitlesName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".vtt"
+}
+
+func segmentExt(fmp4 bool) string {
+	if fmp4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
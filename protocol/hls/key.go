@@ -0,0 +1,213 @@
+package hls
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	keyPrefix = "/key/"
+	keyLen    = 16
+	// how long the keys fetched from a key service are cached
+	keyCacheTTL = time.Hour
+
+	keyProviderFile = "file"
+	keyProviderHTTP = "http"
+)
+
+var (
+	ErrInvalidKey = fmt.Errorf("invalid key")
+)
+
+// KeyProvider supply the AES-128 keys of encrypted streams, stream is the
+// stream key and id the key identifier written in the playlist
+type KeyProvider interface {
+	// NewKey return a new key of stream
+	NewKey(stream string) (id string, key []byte, err error)
+	// Key return the key id of stream
+	Key(stream, id string) ([]byte, error)
+}
+
+// keyProviders keep a provider per application, providers cache keys
+var keyProviders sync.Map
+
+// GetKeyProvider return the key provider of the application appname
+func GetKeyProvider(appname string) KeyProvider {
+	if v, ok := keyProviders.Load(appname); ok {
+		return v.(KeyProvider)
+	}
+	opts := configure.GetHLSOptions(appname)
+	var provider KeyProvider
+	if opts.KeyProvider == keyProviderHTTP {
+		provider = NewHTTPKeyProvider(opts.KeyURL)
+	} else {
+		provider = NewFileKeyProvider(opts.KeyDir)
+	}
+	v, _ := keyProviders.LoadOrStore(appname, provider)
+	return v.(KeyProvider)
+}
+
+// newKeyID return an identifier made of the current time, unique for a stream
+func newKeyID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+func validKeyID(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// keyURI return the URI of the key id of stream served by the HLS server
+func keyURI(stream, id string) string {
+	return fmt.Sprintf("%s%s/%s.key", keyPrefix, stream, id)
+}
+
+// FileKeyProvider generate random keys and store them in dir, one file per
+// key, so that recordings stay readable after a restart
+type FileKeyProvider struct {
+	dir string
+}
+
+func NewFileKeyProvider(dir string) *FileKeyProvider {
+	return &FileKeyProvider{dir: dir}
+}
+
+func (provider *FileKeyProvider) path(stream, id string) string {
+	return filepath.Join(provider.dir, filepath.FromSlash(stream), id+".key")
+}
+
+func (provider *FileKeyProvider) NewKey(stream string) (string, []byte, error) {
+	id := newKeyID()
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", nil, err
+	}
+	filename := provider.path(stream, id)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filename, key, 0600); err != nil {
+		return "", nil, err
+	}
+	return id, key, nil
+}
+
+func (provider *FileKeyProvider) Key(stream, id string) ([]byte, error) {
+	if !validKeyID(id) {
+		return nil, ErrInvalidKey
+	}
+	key, err := ioutil.ReadFile(provider.path(stream, id))
+	if os.IsNotExist(err) {
+		return nil, ErrNoKey
+	} else if err != nil {
+		return nil, err
+	}
+	if len(key) != keyLen {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// HTTPKeyProvider fetch keys from a key service with
+// GET URL?stream=STREAM&id=ID, the service reply with the 16 key bytes,
+// raw or hex encoded. The service create the key on its first request, so
+// only the ids issued by NewKey are requested from it.
+type HTTPKeyProvider struct {
+	url    string
+	client *http.Client
+	keys   *cache.Cache
+	lock   sync.RWMutex
+	issued map[string]bool
+}
+
+func NewHTTPKeyProvider(keyURL string) *HTTPKeyProvider {
+	timeout := configure.Config.GetInt("hook_timeout")
+	if timeout <= 0 {
+		timeout = 5
+	}
+	return &HTTPKeyProvider{
+		url:    keyURL,
+		client: &http.Client{Timeout: time.Second * time.Duration(timeout)},
+		keys:   cache.New(keyCacheTTL, keyCacheTTL),
+		issued: make(map[string]bool),
+	}
+}
+
+func (provider *HTTPKeyProvider) NewKey(stream string) (string, []byte, error) {
+	id := newKeyID()
+	provider.lock.Lock()
+	provider.issued[stream+"/"+id] = true
+	provider.lock.Unlock()
+	key, err := provider.Key(stream, id)
+	return id, key, err
+}
+
+func (provider *HTTPKeyProvider) Key(stream, id string) ([]byte, error) {
+	if !validKeyID(id) {
+		return nil, ErrInvalidKey
+	}
+	if v, ok := provider.keys.Get(stream + "/" + id); ok {
+		return v.([]byte), nil
+	}
+	// the service would create any other key
+	provider.lock.RLock()
+	issued := provider.issued[stream+"/"+id]
+	provider.lock.RUnlock()
+	if !issued {
+		return nil, ErrNoKey
+	}
+	query := url.Values{}
+	query.Set("stream", stream)
+	query.Set("id", id)
+	sep := "?"
+	if strings.Contains(provider.url, "?") {
+		sep = "&"
+	}
+	resp, err := provider.client.Get(provider.url + sep + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoKey
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("key service status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4*keyLen))
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(body)
+	if err != nil {
+		return nil, err
+	}
+	provider.keys.SetDefault(stream+"/"+id, key)
+	return key, nil
+}
+
+// parseKey accept a raw key or its hex encoding
+func parseKey(b []byte) ([]byte, error) {
+	if len(b) == keyLen {
+		return b, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != keyLen {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
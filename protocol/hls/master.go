@@ -0,0 +1,91 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/gwuhaolin/livego/configure"
+)
+
+// group of the subtitles renditions in the master playlists
+const subtitlesGroup = "subs"
+
+// GenMasterPlayList return the master playlist of group, renditions are
+// listed when live returns their cache. The subtitles of the first live
+// rendition having some are shared by all of them. query is appended to the
+// media playlist URIs so that viewer credentials reach the renditions.
+func GenMasterPlayList(group configure.VariantGroup, live func(name string) *TSCacheItem, query string) ([]byte, error) {
+	w := bytes.NewBuffer(nil)
+	w.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	count := 0
+	subtitles := false
+	for _, r := range group.Renditions {
+		tsCache := live(r.Name)
+		if tsCache == nil || tsCache.Subtitles() == "" {
+			continue
+		}
+		writeSubtitlesMedia(w, tsCache.Subtitles(), r.Name+"/subtitles.m3u8", query)
+		subtitles = true
+		break
+	}
+	for _, r := range group.Renditions {
+		if live(r.Name) == nil {
+			continue
+		}
+		count++
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d", r.Bandwidth)
+		if r.Resolution != "" {
+			fmt.Fprintf(w, ",RESOLUTION=%s", r.Resolution)
+		}
+		if r.Codecs != "" {
+			fmt.Fprintf(w, ",CODECS=\"%s\"", r.Codecs)
+		}
+		if r.FrameRate > 0 {
+			fmt.Fprintf(w, ",FRAME-RATE=%.3f", r.FrameRate)
+		}
+		if subtitles {
+			fmt.Fprintf(w, ",SUBTITLES=\"%s\"", subtitlesGroup)
+		}
+		writeURI(w, r.Name+".m3u8", query)
+	}
+	if count == 0 {
+		return nil, ErrNoPublisher
+	}
+	return w.Bytes(), nil
+}
+
+// GenStreamMasterPlayList return the master playlist linking the stream
+// name to its subtitles, it is served next to them at
+// /APP/NAME/master.m3u8
+func GenStreamMasterPlayList(name string, tsCache *TSCacheItem, query string) ([]byte, error) {
+	if tsCache.Subtitles() == "" {
+		return nil, ErrNoKey
+	}
+	bandwidth := tsCache.Bandwidth()
+	if bandwidth == 0 {
+		return nil, ErrNoPublisher
+	}
+	w := bytes.NewBuffer(nil)
+	w.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	writeSubtitlesMedia(w, tsCache.Subtitles(), "subtitles.m3u8", query)
+	fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,SUBTITLES=\"%s\"", bandwidth, subtitlesGroup)
+	writeURI(w, "../"+name+".m3u8", query)
+	return w.Bytes(), nil
+}
+
+func writeSubtitlesMedia(w *bytes.Buffer, language, uri, query string) {
+	if query != "" {
+		uri += "?" + query
+	}
+	fmt.Fprintf(w, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s\"\n",
+		subtitlesGroup, language, language, uri)
+}
+
+// writeURI end the current tag line and write uri with query
+func writeURI(w *bytes.Buffer, uri, query string) {
+	w.WriteString("\n" + uri)
+	if query != "" {
+		w.WriteString("?" + query)
+	}
+	w.WriteString("\n")
+}
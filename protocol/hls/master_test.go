@@ -0,0 +1,68 @@
+package hls
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenMasterPlayList(t *testing.T) {
+	at := assert.New(t)
+	group := configure.VariantGroup{
+		Name: "show",
+		Renditions: []configure.Rendition{
+			{Name: "show_1080", Bandwidth: 6000000, Resolution: "1920x1080", Codecs: "avc1.640028,mp4a.40.2", FrameRate: 30},
+			{Name: "show_720", Bandwidth: 3000000, Resolution: "1280x720"},
+			{Name: "show_480", Bandwidth: 1000000},
+		},
+	}
+	caches := map[string]*TSCacheItem{
+		"show_1080": NewTSCacheItem("live/show_1080", configure.HLSOptions{}),
+		"show_720":  NewTSCacheItem("live/show_720", configure.HLSOptions{}),
+	}
+	live := func(name string) *TSCacheItem {
+		return caches[name]
+	}
+
+	body, err := GenMasterPlayList(group, live, "token=abc")
+	at.Equal(nil, err)
+	at.Equal("#EXTM3U\n#EXT-X-VERSION:3\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,CODECS=\"avc1.640028,mp4a.40.2\",FRAME-RATE=30.000\n"+
+		"show_1080.m3u8?token=abc\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720\n"+
+		"show_720.m3u8?token=abc\n", string(body))
+
+	// the subtitles of a rendition are shared by the group
+	caches["show_720"] = NewTSCacheItem("live/show_720", configure.HLSOptions{Subtitles: true, SubtitlesLang: "fr"})
+	body, err = GenMasterPlayList(group, live, "")
+	at.Equal(nil, err)
+	at.Equal("#EXTM3U\n#EXT-X-VERSION:3\n"+
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"fr\",LANGUAGE=\"fr\",DEFAULT=YES,AUTOSELECT=YES,URI=\"show_720/subtitles.m3u8\"\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,CODECS=\"avc1.640028,mp4a.40.2\",FRAME-RATE=30.000,SUBTITLES=\"subs\"\n"+
+		"show_1080.m3u8\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720,SUBTITLES=\"subs\"\n"+
+		"show_720.m3u8\n", string(body))
+
+	_, err = GenMasterPlayList(group, func(string) *TSCacheItem { return nil }, "")
+	at.Equal(ErrNoPublisher, err)
+}
+
+func TestGenStreamMasterPlayList(t *testing.T) {
+	at := assert.New(t)
+	tsCache := NewTSCacheItem("live/movie", configure.HLSOptions{Subtitles: true, SubtitlesLang: "en"})
+	_, err := GenStreamMasterPlayList("movie", tsCache, "")
+	at.Equal(ErrNoPublisher, err)
+
+	tsCache.SetItem("/live/movie/1.ts", NewTSItem("/live/movie/1.ts", 2000, 1, make([]byte, 50000)))
+	body, err := GenStreamMasterPlayList("movie", tsCache, "token=abc")
+	at.Equal(nil, err)
+	at.Equal("#EXTM3U\n#EXT-X-VERSION:3\n"+
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"en\",LANGUAGE=\"en\",DEFAULT=YES,AUTOSELECT=YES,URI=\"subtitles.m3u8?token=abc\"\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=200000,SUBTITLES=\"subs\"\n"+
+		"../movie.m3u8?token=abc\n", string(body))
+
+	_, err = GenStreamMasterPlayList("movie", NewTSCacheItem("live/movie", configure.HLSOptions{}), "")
+	at.Equal(ErrNoKey, err)
+}
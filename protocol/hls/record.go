@@ -0,0 +1,280 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	recordPrefix   = "/record/"
+	recordPlayList = "index.m3u8"
+	recordIndex    = "index.json"
+)
+
+// indexLock serialize the updates of the recording indexes
+var indexLock sync.Mutex
+
+// RecordSession describe a recording in the index of its stream key
+type RecordSession struct {
+	ID       string     `json:"id"`
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end,omitempty"`
+	Duration int        `json:"duration"`
+	Segments int        `json:"segments"`
+	Live     bool       `json:"live"`
+	URL      string     `json:"url"`
+}
+
+// recorder persist every segment of a publication with an EVENT playlist,
+// finalized as a VOD playlist when the publication ends. A recording is
+// served at /record/APP/NAME/ID/index.m3u8.
+type recorder struct {
+	lock           sync.Mutex
+	key            string
+	root           string
+	dir            string
+	session        RecordSession
+	fmp4           bool
+	targetDuration int
+	initName       string
+	items          []TSItem
+	playlist       *playlistState
+	closed         bool
+}
+
+// playlistState is what the EVENT playlist written on disk declared so far,
+// a segment which fits it is appended to the file
+type playlistState struct {
+	version        int
+	targetDuration int
+	initName       string
+	keyMethod      string
+	keyURI         string
+}
+
+// newRecorder start a recording of key under root, targetDuration in seconds
+// is the target duration announced by the EVENT playlist
+func newRecorder(root, key string, fmp4 bool, targetDuration int) (*recorder, error) {
+	start := time.Now()
+	id := strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+	rec := &recorder{
+		key:            key,
+		root:           filepath.Join(root, filepath.FromSlash(key)),
+		fmp4:           fmp4,
+		targetDuration: targetDuration,
+		session: RecordSession{
+			ID:    id,
+			Start: start,
+			Live:  true,
+			URL:   fmt.Sprintf("%s%s/%s/%s", recordPrefix, key, id, recordPlayList),
+		},
+	}
+	rec.dir = filepath.Join(rec.root, id)
+	if err := os.MkdirAll(rec.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := rec.writeIndex(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// writeInit save a fMP4 init segment, the following segments refer to it
+func (rec *recorder) writeInit(name string, data []byte) error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.closed {
+		return nil
+	}
+	rec.initName = path.Base(name)
+	return ioutil.WriteFile(filepath.Join(rec.dir, rec.initName), data, 0644)
+}
+
+// write save a segment and append it to the EVENT playlist, segments are
+// named after their media sequence number
+func (rec *recorder) write(item TSItem) error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.closed {
+		return nil
+	}
+	name := fmt.Sprintf("%d%s", item.SeqNum, segmentExt(rec.fmp4))
+	if err := ioutil.WriteFile(filepath.Join(rec.dir, name), item.Data, 0644); err != nil {
+		return err
+	}
+	if d := (item.Duration + 500) / 1000; d > rec.targetDuration {
+		rec.targetDuration = d
+	}
+	v := TSItem{
+		Name:      name,
+		SeqNum:    item.SeqNum,
+		Duration:  item.Duration,
+		Map:       rec.initName,
+		KeyMethod: item.KeyMethod,
+		KeyURI:    item.KeyURI,
+		// a recording starts with its first segment
+		Discontinuity:   item.Discontinuity && len(rec.items) > 0,
+		ProgramDateTime: item.ProgramDateTime,
+		CueOut:          item.CueOut,
+		CueIn:           item.CueIn,
+	}
+	rec.items = append(rec.items, v)
+	rec.session.Segments++
+	rec.session.Duration += item.Duration
+
+	// the playlist is rewritten when the segment does not fit its header
+	if rec.playlist == nil {
+		return rec.writePlayList("EVENT", false)
+	}
+	state := *rec.playlist
+	lines := bytes.NewBuffer(nil)
+	writeRecordSegment(lines, &state, v)
+	if state.version != rec.playlist.version || rec.targetDuration > state.targetDuration {
+		return rec.writePlayList("EVENT", false)
+	}
+	f, err := os.OpenFile(filepath.Join(rec.dir, recordPlayList), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	rec.playlist = &state
+	return f.Close()
+}
+
+// close finalize the playlist as VOD and mark the session as ended in the index
+func (rec *recorder) close() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.closed {
+		return nil
+	}
+	rec.closed = true
+	if err := rec.writePlayList("VOD", true); err != nil {
+		return err
+	}
+	rec.session.Live = false
+	end := time.Now()
+	rec.session.End = &end
+	return rec.writeIndex()
+}
+
+// writePlayList replace the playlist of the recording with a temporary file
+// renamed over it, the caller must hold the lock
+func (rec *recorder) writePlayList(playListType string, end bool) error {
+	state := playlistState{version: 3, targetDuration: rec.targetDuration}
+	if rec.fmp4 {
+		state.version = 7
+	}
+	if state.targetDuration == 0 {
+		state.targetDuration = 1
+	}
+	body := bytes.NewBuffer(nil)
+	for _, v := range rec.items {
+		writeRecordSegment(body, &state, v)
+	}
+	if end {
+		body.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	seq := 0
+	if len(rec.items) > 0 {
+		seq = rec.items[0].SeqNum
+	}
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-PLAYLIST-TYPE:%s\n#EXT-X-TARGETDURATION:%d\n",
+		state.version, playListType, state.targetDuration)
+	fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:%d\n\n", seq)
+	w.Write(body.Bytes())
+	if err := writeFileAtomic(filepath.Join(rec.dir, recordPlayList), w.Bytes()); err != nil {
+		return err
+	}
+	rec.playlist = &state
+	return nil
+}
+
+// writeRecordSegment write the lines of the segment v to w, the tags already
+// in effect in state are not repeated
+func writeRecordSegment(w *bytes.Buffer, state *playlistState, v TSItem) {
+	if v.Discontinuity {
+		w.WriteString("#EXT-X-DISCONTINUITY\n")
+	}
+	if v.KeyMethod != state.keyMethod || v.KeyURI != state.keyURI {
+		state.keyMethod, state.keyURI = v.KeyMethod, v.KeyURI
+		w.WriteString(keyLine(state.keyMethod, state.keyURI))
+		if state.keyMethod == methodSampleAES && state.version < 5 {
+			state.version = 5
+		}
+	}
+	if v.Map != state.initName {
+		state.initName = v.Map
+		fmt.Fprintf(w, "#EXT-X-MAP:URI=\"%s\"\n", state.initName)
+	}
+	writeSegmentHead(w, v)
+	fmt.Fprintf(w, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
+}
+
+// writeIndex add or replace the session in the index of the stream key
+func (rec *recorder) writeIndex() error {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+
+	sessions, err := readRecordIndex(rec.root)
+	if err != nil {
+		log.Warningf("[%s] recording index reset: %v", rec.key, err)
+	}
+	found := false
+	for i := range sessions {
+		if sessions[i].ID == rec.session.ID {
+			sessions[i] = rec.session
+			found = true
+		}
+	}
+	if !found {
+		sessions = append(sessions, rec.session)
+	}
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(rec.root, recordIndex), data)
+}
+
+// readRecordIndex return the recordings of the stream key stored in dir
+func readRecordIndex(dir string) ([]RecordSession, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, recordIndex))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sessions []RecordSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// writeFileAtomic replace filename so that readers never see a partial file
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,78 @@
+package hls
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "record")
+	at.Equal(nil, err)
+	defer os.RemoveAll(dir)
+
+	rec, err := newRecorder(dir, "live/test", false, 2)
+	at.Equal(nil, err)
+	at.Equal(nil, rec.write(NewTSItem("/live/test/100.ts", 2000, 1, []byte{1})))
+	at.Equal(nil, rec.write(NewTSItem("/live/test/102.ts", 2400, 2, []byte{2})))
+
+	playlist, err := ioutil.ReadFile(filepath.Join(rec.dir, recordPlayList))
+	at.Equal(nil, err)
+	at.True(strings.Contains(string(playlist), "#EXT-X-PLAYLIST-TYPE:EVENT\n"))
+	at.True(strings.Contains(string(playlist), "#EXTINF:2.400,\n2.ts\n"))
+	at.False(strings.Contains(string(playlist), "#EXT-X-ENDLIST"))
+	data, err := ioutil.ReadFile(filepath.Join(rec.dir, "1.ts"))
+	at.Equal(nil, err)
+	at.Equal([]byte{1}, data)
+
+	sessions, err := readRecordIndex(filepath.Join(dir, "live", "test"))
+	at.Equal(nil, err)
+	at.Equal(1, len(sessions))
+	at.True(sessions[0].Live)
+
+	at.Equal(nil, rec.close())
+	playlist, _ = ioutil.ReadFile(filepath.Join(rec.dir, recordPlayList))
+	at.True(strings.Contains(string(playlist), "#EXT-X-PLAYLIST-TYPE:VOD\n"))
+	at.True(strings.HasSuffix(string(playlist), "#EXT-X-ENDLIST\n"))
+	// segments written after the end are ignored
+	at.Equal(nil, rec.write(NewTSItem("/live/test/104.ts", 2000, 3, []byte{3})))
+	_, err = os.Stat(filepath.Join(rec.dir, "3.ts"))
+	at.True(os.IsNotExist(err))
+
+	sessions, _ = readRecordIndex(filepath.Join(dir, "live", "test"))
+	at.Equal(1, len(sessions))
+	at.False(sessions[0].Live)
+	at.Equal(4400, sessions[0].Duration)
+	at.Equal(2, sessions[0].Segments)
+	at.Equal("/record/live/test/"+rec.session.ID+"/index.m3u8", sessions[0].URL)
+}
+
+func TestRecorderAppend(t *testing.T) {
+	at := assert.New(t)
+	dir, err := ioutil.TempDir("", "record")
+	at.Equal(nil, err)
+	defer os.RemoveAll(dir)
+
+	rec, err := newRecorder(dir, "live/test", false, 2)
+	at.Equal(nil, err)
+	at.Equal(nil, rec.write(NewTSItem("/live/test/1.ts", 2000, 1, []byte{1})))
+	at.Equal(nil, rec.write(NewTSItem("/live/test/2.ts", 2000, 2, []byte{2})))
+	playlist, _ := ioutil.ReadFile(filepath.Join(rec.dir, recordPlayList))
+	at.Equal("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-TARGETDURATION:2\n"+
+		"#EXT-X-MEDIA-SEQUENCE:1\n\n#EXTINF:2.000,\n1.ts\n#EXTINF:2.000,\n2.ts\n", string(playlist))
+
+	// a segment longer than the target duration rewrites the header
+	at.Equal(nil, rec.write(NewTSItem("/live/test/3.ts", 3600, 3, []byte{3})))
+	playlist, _ = ioutil.ReadFile(filepath.Join(rec.dir, recordPlayList))
+	at.True(strings.Contains(string(playlist), "#EXT-X-TARGETDURATION:4\n"))
+	at.Equal(3, strings.Count(string(playlist), "#EXTINF"))
+
+	at.Equal(nil, rec.close())
+	_, err = os.Stat(filepath.Join(rec.dir, recordPlayList+".tmp"))
+	at.True(os.IsNotExist(err))
+}
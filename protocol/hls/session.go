@@ -0,0 +1,204 @@
+package hls
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/hook"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// query parameter and cookie carrying the viewer session
+	sessionParam  = "hls_session"
+	sessionCookie = "livego_hls_session"
+)
+
+var uriAttr = regexp.MustCompile(`URI="[^"]*"`)
+
+// Session is an HLS viewer, it is issued on the first playlist request and
+// expires when the viewer stops requesting
+type Session struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"key"`
+	Addr        string    `json:"addr"`
+	UserAgent   string    `json:"user_agent"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastRequest time.Time `json:"last_request"`
+	Bytes       uint64    `json:"bytes"`
+	Segments    uint64    `json:"segments"`
+}
+
+// StreamStat is the HLS viewers of a stream
+type StreamStat struct {
+	Key      string    `json:"key"`
+	Viewers  int       `json:"viewers"`
+	Bytes    uint64    `json:"bytes"`
+	Sessions []Session `json:"sessions"`
+}
+
+type sessionStore struct {
+	lock     sync.Mutex
+	sessions *cache.Cache
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	store := &sessionStore{
+		sessions: cache.New(ttl, ttl/2),
+	}
+	store.sessions.OnEvicted(func(id string, v interface{}) {
+		log.Debug("hls session expired: ", id)
+	})
+	return store
+}
+
+// requestSession return the session id carried by the query or the cookie
+// of r, an id which was not issued by the server is ignored
+func requestSession(r *http.Request) string {
+	id := r.URL.Query().Get(sessionParam)
+	if id == "" {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			id = cookie.Value
+		}
+	}
+	if !hook.ValidSessionID(id) {
+		return ""
+	}
+	return id
+}
+
+// issuedSession return the session issued to w by a previous get for the
+// same request
+func issuedSession(w http.ResponseWriter) string {
+	resp := http.Response{Header: w.Header()}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// get return the session of r, a playlist request of a viewer without
+// session is issued a new one with a cookie. A session which expired is
+// restarted with its id, the id being signed by the server.
+func (store *sessionStore) get(w http.ResponseWriter, r *http.Request, key string, playlist bool) *Session {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	id := requestSession(r)
+	if id == "" {
+		id = issuedSession(w)
+	}
+	if v, found := store.sessions.Get(id); found {
+		s := v.(*Session)
+		if playlist {
+			s.Key = key
+		}
+		s.LastRequest = time.Now()
+		store.sessions.SetDefault(id, s)
+		return s
+	}
+	if id == "" {
+		if !playlist {
+			return nil
+		}
+		id = hook.NewSessionID()
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true})
+	}
+	now := time.Now()
+	s := &Session{
+		ID:          id,
+		Key:         key,
+		UserAgent:   r.UserAgent(),
+		CreatedAt:   now,
+		LastRequest: now,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		s.Addr = host
+	}
+	store.sessions.SetDefault(id, s)
+	return s
+}
+
+// served count what was served to the session s
+func (store *sessionStore) served(s *Session, bytes int, segment bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	s.Bytes += uint64(bytes)
+	if segment {
+		s.Segments++
+	}
+}
+
+// stats return the viewers of the stream key, or of every stream when key
+// is empty
+func (store *sessionStore) stats(key string) []StreamStat {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	streams := make(map[string]*StreamStat)
+	for _, item := range store.sessions.Items() {
+		s := *item.Object.(*Session)
+		if key != "" && s.Key != key {
+			continue
+		}
+		stat, ok := streams[s.Key]
+		if !ok {
+			stat = &StreamStat{Key: s.Key}
+			streams[s.Key] = stat
+		}
+		stat.Viewers++
+		stat.Bytes += s.Bytes
+		stat.Sessions = append(stat.Sessions, s)
+	}
+	stats := make([]StreamStat, 0, len(streams))
+	for _, stat := range streams {
+		sort.Slice(stat.Sessions, func(i, j int) bool {
+			return stat.Sessions[i].CreatedAt.Before(stat.Sessions[j].CreatedAt)
+		})
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+// withSession add the session id to the URIs of a playlist, players do not
+// keep the query of the playlist for the URIs it lists
+func withSession(body []byte, id string) []byte {
+	param := sessionParam + "=" + id
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			lines[i] = appendQuery(line, param)
+			continue
+		}
+		lines[i] = uriAttr.ReplaceAllStringFunc(line, func(attr string) string {
+			return `URI="` + appendQuery(attr[len(`URI="`):len(attr)-1], param) + `"`
+		})
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func appendQuery(uri, param string) string {
+	if strings.Contains(uri, param) {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + param
+	}
+	return uri + "?" + param
+}
@@ -0,0 +1,68 @@
+package hls
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStore(t *testing.T) {
+	at := assert.New(t)
+	store := newSessionStore(time.Minute)
+
+	// segments of an unknown viewer are not counted
+	w := httptest.NewRecorder()
+	at.Nil(store.get(w, httptest.NewRequest("GET", "/live/movie/1.ts", nil), "live/movie", false))
+
+	// the first playlist request issue the session with a cookie
+	r := httptest.NewRequest("GET", "/live/movie.m3u8", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	s := store.get(w, r, "live/movie", true)
+	at.Equal("10.0.0.1", s.Addr)
+	at.Equal(sessionCookie+"="+s.ID+"; Path=/; HttpOnly", w.Header().Get("Set-Cookie"))
+	store.served(s, 100, false)
+	// on_play authorization and the playlist share the session issued
+	at.Equal(s, store.get(w, r, "live/movie", true))
+
+	// the session is found by query or by cookie
+	w = httptest.NewRecorder()
+	at.Equal(s, store.get(w, httptest.NewRequest("GET", "/live/movie/1.ts?hls_session="+s.ID, nil), "live/movie", false))
+	store.served(s, 1000, true)
+	r = httptest.NewRequest("GET", "/live/movie/2.ts", nil)
+	r.Header.Set("Cookie", sessionCookie+"="+s.ID)
+	at.Equal(s, store.get(w, r, "live/movie", false))
+	store.served(s, 1000, true)
+
+	// an id the server did not issue is replaced
+	w = httptest.NewRecorder()
+	forged := store.get(w, httptest.NewRequest("GET", "/live/movie.m3u8?hls_session=viewer1", nil), "live/movie", true)
+	at.NotEqual("viewer1", forged.ID)
+	at.Equal(sessionCookie+"="+forged.ID+"; Path=/; HttpOnly", w.Header().Get("Set-Cookie"))
+	store.sessions.Delete(forged.ID)
+
+	store.get(httptest.NewRecorder(), httptest.NewRequest("GET", "/live/movie.m3u8", nil), "live/movie", true)
+	store.get(httptest.NewRecorder(), httptest.NewRequest("GET", "/live/show.m3u8", nil), "live/show", true)
+
+	stats := store.stats("live/movie")
+	at.Equal(1, len(stats))
+	at.Equal("live/movie", stats[0].Key)
+	at.Equal(2, stats[0].Viewers)
+	at.Equal(uint64(2100), stats[0].Bytes)
+	at.Equal(s.ID, stats[0].Sessions[0].ID)
+	at.Equal(uint64(2), stats[0].Sessions[0].Segments)
+	at.Equal(2, len(store.stats("")))
+}
+
+func TestWithSession(t *testing.T) {
+	at := assert.New(t)
+	body := "#EXTM3U\n#EXT-X-MAP:URI=\"/live/movie/init1.mp4\"\n" +
+		"#EXTINF:3.000,\n/live/movie/1.m4s\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/live/movie/2.0.m4s\"\n" +
+		"movie_720.m3u8?token=abc\n"
+	at.Equal("#EXTM3U\n#EXT-X-MAP:URI=\"/live/movie/init1.mp4?hls_session=abc\"\n"+
+		"#EXTINF:3.000,\n/live/movie/1.m4s?hls_session=abc\n"+
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/live/movie/2.0.m4s?hls_session=abc\"\n"+
+		"movie_720.m3u8?token=abc&hls_session=abc\n", string(withSession([]byte(body), "abc")))
+}
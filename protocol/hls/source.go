@@ -3,11 +3,15 @@ package hls
 import (
 	"bytes"
 	"fmt"
-	"github.com/gwuhaolin/livego/configure"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gwuhaolin/livego/configure"
+
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/fmp4"
 	"github.com/gwuhaolin/livego/container/ts"
 	"github.com/gwuhaolin/livego/parser"
 
@@ -18,42 +22,155 @@ const (
 	videoHZ      = 90000
 	aacSampleLen = 1024
 	maxQueueNum  = 512
+	tsPacketLen  = 188
 
 	h264_default_hz uint64 = 90
+
+	// a timestamp jump larger than this is a discontinuity
+	maxTimestampJump = 10000 // ms
 )
 
+// sequence is where the numbering of a stream resumes when its publisher
+// reconnects, tsCache is set while the previous playlist is still served
+type sequence struct {
+	seq     int
+	initSeq int
+	tsCache *TSCacheItem
+}
+
 type Source struct {
 	av.RWBaser
-	seq         int
-	info        av.Info
-	bwriter     *bytes.Buffer
-	btswriter   *bytes.Buffer
-	demuxer     *flv.Demuxer
-	muxer       *ts.Muxer
-	pts, dts    uint64
-	stat        *status
-	align       *align
-	cache       *audioCache
-	tsCache     *TSCacheItem
-	tsparser    *parser.CodecParser
-	closed      bool
-	packetQueue chan *av.Packet
+	seq             int
+	info            av.Info
+	segDuration     int64
+	lowLatency      bool
+	partDuration    int64
+	partStart       uint32
+	hasTimestamp    bool
+	frameTimestamp  uint32
+	frameInterval   int64
+	discontinuity   bool
+	publisherClock  bool
+	timedMetadata   bool
+	clock           wallClock
+	segment         TSItem
+	cues            []cuePoint
+	splice          *cuePoint
+	adBreak         *Splice
+	spliceID        uint32
+	subtitles       *subtitleTrack
+	partOffset      int
+	partIndex       int
+	partIndependent bool
+	segExt          string
+	initSeq         int
+	initChanged     bool
+	soundFormat     byte
+	videoCodec      uint8
+	hasAudio        bool
+	hasVideo        bool
+	bwriter         *bytes.Buffer
+	btswriter       *bytes.Buffer
+	demuxer         *flv.Demuxer
+	muxer           *ts.Muxer
+	fmuxer          *fmp4.Muxer
+	pts, dts        uint64
+	stat            *status
+	align           *align
+	cache           *audioCache
+	tsCache         *TSCacheItem
+	recorder        *recorder
+	encryption      string
+	keyRotation     int
+	keyProvider     KeyProvider
+	segKey          *segmentKey
+	keySegments     int
+	aacConfig       []byte
+	videoConfig     []byte
+	tsparser        *parser.CodecParser
+	closed          bool
+	packetQueue     chan *av.Packet
 }
 
 func NewSource(info av.Info) *Source {
+	return newSource(info, sequence{})
+}
+
+// newSource create the source of a publication continuing the segment
+// numbering of state, it also continues its playlist when state has one
+func newSource(info av.Info, state sequence) *Source {
 	info.Inter = true
+	appname := strings.SplitN(info.Key, "/", 2)[0]
+	opts := configure.GetHLSOptions(appname)
+	if opts.Encryption != "" {
+		if opts.Encryption != encryptionAES128 && opts.Encryption != encryptionSampleAES {
+			log.Warningf("[%v] unknown hls_encryption %q, using %s", info, opts.Encryption, encryptionAES128)
+			opts.Encryption = encryptionAES128
+		}
+		if opts.SegmentType == segmentTypeFMP4 {
+			log.Warningf("[%v] hls encryption uses ts segments", info)
+			opts.SegmentType = "ts"
+		}
+	}
+	if opts.Encryption != "" && !hasOnPlay(appname) {
+		// the keys would be served to anyone
+		log.Errorf("[%v] hls_encryption needs an on_play hook, the stream is not encrypted", info)
+		opts.Encryption = ""
+	}
 	s := &Source{
-		info:        info,
-		align:       &align{},
-		stat:        newStatus(),
-		RWBaser:     av.NewRWBaser(time.Second * 10),
-		cache:       newAudioCache(),
-		demuxer:     flv.NewDemuxer(),
-		muxer:       ts.NewMuxer(),
-		tsCache:     NewTSCacheItem(info.Key),
-		tsparser:    parser.NewCodecParser(),
-		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
-		packetQueue: make(chan *av.Packet, maxQueueNum),
+		info:           info,
+		seq:            state.seq,
+		initSeq:        state.initSeq,
+		segDuration:    int64(opts.SegmentDuration),
+		lowLatency:     opts.LowLatency,
+		partDuration:   int64(opts.PartDuration),
+		encryption:     opts.Encryption,
+		keyRotation:    opts.KeyRotation,
+		publisherClock: opts.PublisherClock,
+		align:          &align{},
+		stat:           newStatus(),
+		RWBaser:        av.NewRWBaser(time.Second * 10),
+		cache:          newAudioCache(),
+		demuxer:        flv.NewDemuxer(),
+		muxer:          ts.NewMuxer(),
+		tsCache:        state.tsCache,
+		tsparser:       parser.NewCodecParser(),
+		bwriter:        bytes.NewBuffer(make([]byte, 100*1024)),
+		packetQueue:    make(chan *av.Packet, maxQueueNum),
+	}
+	if s.tsCache == nil {
+		s.tsCache = NewTSCacheItem(info.Key, opts)
+	} else {
+		// players are told the new publication does not continue the
+		// segments already listed
+		s.discontinuity = true
+	}
+	if s.seq > 0 {
+		s.tsCache.Restart(s.seq)
+	}
+	if opts.SegmentType == segmentTypeFMP4 {
+		s.fmuxer = fmp4.NewMuxer()
+		if opts.TimedMetadata {
+			log.Warningf("[%v] hls timed metadata needs ts segments", info)
+		}
+	} else if opts.TimedMetadata {
+		s.timedMetadata = true
+		s.muxer.SetMetadata(true)
+	}
+	s.segExt = segmentExt(s.fmuxer != nil)
+	if opts.Subtitles {
+		s.subtitles = newSubtitleTrack()
+	}
+	if s.encryption != "" {
+		s.keyProvider = GetKeyProvider(appname)
+	}
+	if opts.Record {
+		rec, err := newRecorder(opts.RecordDir, info.Key, s.fmuxer != nil, (opts.SegmentDuration+999)/1000)
+		if err != nil {
+			log.Warningf("[%v] hls record disabled: %v", info, err)
+		} else {
+			s.recorder = rec
+		}
 	}
 	go func() {
 		err := s.SendPacket()
@@ -136,6 +253,7 @@ func (source *Source) SendPacket() error {
 		p, ok := <-source.packetQueue
 		if ok {
 			if p.IsMetadata {
+				source.parseMetadata(p)
 				continue
 			}
 
@@ -171,33 +289,74 @@ func (source *Source) Info() (ret av.Info) {
 	return source.info
 }
 
-func (source *Source) cleanup() {
-	close(source.packetQueue)
-	source.bwriter = nil
-	source.btswriter = nil
-	source.cache = nil
-	source.tsCache = nil
+// sequence return the state a reconnecting publisher resumes from, the
+// playlist is kept until the source is released
+func (source *Source) sequence() sequence {
+	return sequence{
+		seq:     source.seq,
+		initSeq: source.initSeq,
+		tsCache: source.tsCache,
+	}
+}
+
+// release close the source and remove its segments, only the numbering
+// is kept for a later publication
+func (source *Source) release() sequence {
+	source.Close(nil)
+	state := source.sequence()
+	if err := state.tsCache.Close(); err != nil {
+		log.Warning("hls dvr cleanup: ", err)
+	}
+	state.tsCache = nil
+	return state
 }
 
+// Close stop the source, the playlist is still served so that a publisher
+// reconnecting on the same key continues it
 func (source *Source) Close(err error) {
 	log.Debug("hls source closed: ", source.info)
-	if !source.closed && !configure.Config.GetBool("hls_keep_after_end") {
-		source.cleanup()
+	if source.recorder != nil {
+		if err := source.recorder.close(); err != nil {
+			log.Warning("hls record close: ", err)
+		}
+	}
+	if !source.closed {
+		close(source.packetQueue)
 	}
 	source.closed = true
 }
 
-func (source *Source) cut() {
+func (source *Source) cut(timestamp uint32) {
 	newf := true
 	if source.btswriter == nil {
 		source.btswriter = bytes.NewBuffer(nil)
-	} else if source.btswriter != nil && source.stat.durationMs() >= duration {
-		source.flushAudio()
+	} else if source.btswriter != nil && (source.stat.durationMs() >= source.segDuration ||
+		source.discontinuity || source.splice != nil) {
+		source.flush(timestamp)
+		source.cutPart(timestamp)
 
 		source.seq++
-		filename := fmt.Sprintf("/%s/%d.ts", source.info.Key, time.Now().Unix())
-		item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
-		source.tsCache.SetItem(filename, item)
+		filename := fmt.Sprintf("/%s/%d%s", source.info.Key, source.seq, source.segExt)
+		// the segment last until this key frame, as its parts do
+		duration := int(int64(timestamp) - source.stat.firstTimestamp)
+		if data, ok := source.encryptSegment(source.seq, source.btswriter.Bytes()); ok {
+			item := NewTSItem(filename, duration, source.seq, data)
+			item.Discontinuity = source.segment.Discontinuity
+			item.ProgramDateTime = source.segment.ProgramDateTime
+			item.CueOut, item.CueIn = source.segment.CueOut, source.segment.CueIn
+			if source.subtitles != nil {
+				item.Subtitles = source.subtitles.segment(uint32(source.stat.firstTimestamp), timestamp)
+			}
+			if source.segKey != nil {
+				item.KeyMethod, item.KeyURI = source.segKey.method, source.segKey.uri
+			}
+			source.tsCache.SetItem(filename, item)
+			if source.recorder != nil {
+				if err := source.recorder.write(item); err != nil {
+					log.Warning("hls record: ", err)
+				}
+			}
+		}
 
 		source.btswriter.Reset()
 		source.stat.resetAndNew()
@@ -205,41 +364,395 @@ func (source *Source) cut() {
 		newf = false
 	}
 	if newf {
-		source.btswriter.Write(source.muxer.PAT())
-		source.btswriter.Write(source.muxer.PMT(av.SOUND_AAC, true))
+		source.segment = TSItem{
+			Discontinuity:   source.discontinuity,
+			ProgramDateTime: source.clock.at(timestamp),
+		}
+		source.discontinuity = false
+		source.applySplice(timestamp)
+		source.tsCache.StartSegment(source.segment)
+		source.rotateKey()
+		if source.fmuxer == nil {
+			source.btswriter.Write(source.muxer.PAT())
+			source.btswriter.Write(source.pmt())
+		} else if source.initChanged {
+			source.initSeq++
+			source.initChanged = false
+			name := fmt.Sprintf("/%s/init%d.mp4", source.info.Key, source.initSeq)
+			init := source.fmuxer.InitSegment()
+			source.tsCache.SetInit(name, init)
+			if source.recorder != nil {
+				if err := source.recorder.writeInit(name, init); err != nil {
+					log.Warning("hls record: ", err)
+				}
+			}
+		}
+		source.partStart = timestamp
+		source.partOffset = 0
+		source.partIndex = 0
+		source.partIndependent = true
+	}
+}
+
+// checkTimestamp track the frame interval of the main track, a timestamp
+// going back or jumping forward starts a new segment after a discontinuity.
+// The segment being built is shifted so that its duration stays right.
+func (source *Source) checkTimestamp(timestamp uint32) {
+	interval := int64(timestamp) - int64(source.frameTimestamp)
+	if source.hasTimestamp && (interval < 0 || interval > maxTimestampJump) {
+		log.Debugf("[%v] hls timestamp jump %d ms", source.info, interval)
+		shift := interval - source.frameInterval
+		if source.stat.hasSetFirstTs {
+			source.stat.firstTimestamp += shift
+			source.stat.lastTimestamp += shift
+		}
+		source.partStart = uint32(int64(source.partStart) + shift)
+		source.discontinuity = true
+		source.clock.sync(timestamp, true)
+		if source.subtitles != nil {
+			source.subtitles.reset(timestamp)
+		}
+	} else if interval > 0 {
+		source.frameInterval = interval
+	}
+	if !source.hasTimestamp {
+		source.clock.sync(timestamp, false)
+	}
+	source.hasTimestamp = true
+	source.frameTimestamp = timestamp
+}
+
+// parseMetadata handle the data messages of the publisher, cue points
+// signal ad breaks and onTextData carries subtitles, they give the wall
+// clock when hls_publisher_clock is set and are muxed as ID3 timed metadata
+// at their timestamp when hls_timed_metadata is set
+func (source *Source) parseMetadata(p *av.Packet) {
+	if cue, ok := parseCuePoint(p.Data, p.TimeStamp); ok {
+		source.cues = append(source.cues, cue)
+	}
+	if source.subtitles != nil {
+		if text, ok := parseTextData(p.Data); ok {
+			source.subtitles.textData(p.TimeStamp, text)
+		}
+	}
+	if source.publisherClock {
+		if t, ok := publisherTime(p.Data); ok {
+			source.clock.setPublisher(t, p.TimeStamp)
+		}
+	}
+	if !source.timedMetadata || source.btswriter == nil {
+		return
+	}
+	if tag, ok := dataMessageID3(p.Data); ok {
+		meta := av.Packet{
+			IsMetadata: true,
+			TimeStamp:  p.TimeStamp,
+			Data:       tag,
+		}
+		if err := source.muxer.Mux(&meta, source.btswriter); err != nil {
+			log.Warning("hls timed metadata: ", err)
+		}
+	}
+}
+
+// dueCue remove and return the first cue point at timestamp, the random
+// access point closest to a splice point starts its segment
+func (source *Source) dueCue(timestamp uint32) *cuePoint {
+	for i, cue := range source.cues {
+		if int64(cue.timestamp)-int64(timestamp) <= source.frameInterval/2 {
+			source.cues = append(source.cues[:i], source.cues[i+1:]...)
+			return &cue
+		}
+	}
+	return nil
+}
+
+// applySplice start or end an ad break with the segment starting at
+// timestamp, an out of the network without SCTE-35 payload is described by
+// a splice_insert and its planned duration schedules the return
+func (source *Source) applySplice(timestamp uint32) {
+	cue := source.splice
+	source.splice = nil
+	if cue == nil {
+		return
+	}
+	if cue.out {
+		if source.adBreak != nil {
+			return
+		}
+		splice := cue.splice
+		if splice.EventID == 0 {
+			source.spliceID++
+			splice.EventID = source.spliceID
+		}
+		if splice.ID == "" {
+			splice.ID = strconv.FormatUint(uint64(splice.EventID), 10)
+		}
+		splice.Start = source.segment.ProgramDateTime
+		if len(splice.SCTE35) == 0 {
+			splice.SCTE35 = spliceInsert(splice.EventID, true, splice.PlannedDuration)
+		}
+		source.adBreak = &splice
+		source.segment.CueOut = &splice
+		if splice.PlannedDuration > 0 {
+			source.cues = append(source.cues, cuePoint{
+				timestamp: timestamp + uint32(splice.PlannedDuration*1000),
+				auto:      true,
+				splice:    Splice{EventID: splice.EventID},
+			})
+		}
+		return
+	}
+	// the planned return of a break which already ended is ignored
+	if source.adBreak == nil || (cue.auto && cue.splice.EventID != source.adBreak.EventID) {
+		return
+	}
+	splice := *source.adBreak
+	splice.End = source.segment.ProgramDateTime
+	splice.SCTE35 = cue.splice.SCTE35
+	if len(splice.SCTE35) == 0 {
+		splice.SCTE35 = spliceInsert(splice.EventID, false, 0)
+	}
+	source.adBreak = nil
+	source.segment.CueIn = &splice
+}
+
+// partFull tell whether the frame at timestamp would make the part being
+// built longer than the part target, parts must not exceed it
+func (source *Source) partFull(timestamp uint32) bool {
+	return int64(timestamp)-int64(source.partStart)+source.frameInterval > source.partDuration
+}
+
+// cutPart publish what was muxed since the previous part as a LL-HLS
+// partial segment of the segment being built
+func (source *Source) cutPart(timestamp uint32) {
+	if !source.lowLatency {
+		return
+	}
+	source.flush(timestamp)
+	if source.btswriter.Len() <= source.partOffset {
+		return
+	}
+	name := partName(source.info.Key, source.seq+1, source.partIndex, source.segExt)
+	duration := int(int64(timestamp) - int64(source.partStart))
+	if data, ok := source.encryptSegment(source.seq+1, source.btswriter.Bytes()[source.partOffset:]); ok {
+		source.tsCache.SetPart(NewTSPart(name, duration, source.partIndependent, data))
+	}
+
+	source.partStart = timestamp
+	source.partOffset = source.btswriter.Len()
+	source.partIndex++
+	source.partIndependent = false
+}
+
+// rotateKey select the key and the encryption method of the segment
+// starting, SAMPLE-AES only applies to H.264 and AAC, other codecs fall back
+// to AES-128
+func (source *Source) rotateKey() {
+	if source.encryption == "" {
+		return
+	}
+	if source.segKey == nil || (source.keyRotation > 0 && source.keySegments >= source.keyRotation) {
+		id, key, err := source.keyProvider.NewKey(source.info.Key)
+		if err == nil {
+			source.segKey, err = newSegmentKey(methodAES128, keyURI(source.info.Key, id), key)
+		}
+		if err != nil {
+			log.Warningf("[%v] hls key rotation: %v", source.info, err)
+		} else {
+			source.keySegments = 0
+		}
+	}
+	if source.segKey == nil {
+		return
+	}
+	source.keySegments++
+	source.segKey.method = methodAES128
+	if source.encryption == encryptionSampleAES && source.fmuxer == nil &&
+		(!source.hasVideo || source.videoCodec == av.VIDEO_H264) &&
+		(!source.hasAudio || source.soundFormat == av.SOUND_AAC) {
+		source.segKey.method = methodSampleAES
+	}
+	source.muxer.SetSampleAES(source.segKey.method == methodSampleAES, source.aacConfig)
+	source.tsCache.SetKey(source.segKey.method, source.segKey.uri)
+}
+
+// encryptSegment return the data of segment or part seq as it is served, ok
+// is false when an encrypted stream has no key to publish it
+func (source *Source) encryptSegment(seq int, data []byte) ([]byte, bool) {
+	if source.encryption == "" {
+		return data, true
+	}
+	if source.segKey == nil {
+		return nil, false
+	}
+	if source.segKey.method == methodAES128 {
+		return source.segKey.encryptSegment(seq, data), true
+	}
+	return data, true
+}
+
+// encryptSample apply SAMPLE-AES to the frame of p, frames of a codec the
+// method does not support are dropped until the next segment
+func (source *Source) encryptSample(p *av.Packet) bool {
+	if source.segKey == nil || source.segKey.method != methodSampleAES {
+		return true
+	}
+	if p.IsVideo {
+		if source.videoCodec != av.VIDEO_H264 {
+			return false
+		}
+		p.Data = source.segKey.encryptVideo(source.seq+1, p.Data)
+		return true
+	}
+	if source.soundFormat != av.SOUND_AAC {
+		return false
+	}
+	p.Data = source.segKey.encryptAudio(source.seq+1, p.Data)
+	return true
+}
+
+func (source *Source) pmt() []byte {
+	return source.muxer.PMT(source.soundFormat, source.hasAudio, source.hasVideo)
+}
+
+// updatePMT announce a track found after the segment started, MP3 has no
+// sequence header and is only seen with its first frame, so the PMT written
+// by cut is replaced in place
+func (source *Source) updatePMT() {
+	if source.fmuxer == nil && source.btswriter != nil && source.btswriter.Len() >= 2*tsPacketLen {
+		copy(source.btswriter.Bytes()[tsPacketLen:2*tsPacketLen], source.pmt())
+	}
+}
+
+func (source *Source) setSoundFormat(soundFormat byte) {
+	if source.hasAudio && source.soundFormat == soundFormat {
+		return
+	}
+	if source.hasAudio {
+		source.discontinuity = true
+	}
+	source.hasAudio = true
+	source.soundFormat = soundFormat
+	sampleRate, _ := source.tsparser.SampleRate()
+	source.muxer.SetAudioCodec(soundFormat, sampleRate)
+	source.updatePMT()
+}
+
+// configure pass the codec configuration carried by p to the fMP4 muxer, a
+// new init segment is written with the next segment when it changed
+func (source *Source) configure(p *av.Packet) {
+	if source.fmuxer == nil {
+		return
+	}
+	changed, err := source.fmuxer.Configure(p)
+	if err != nil {
+		log.Warning(err)
+	}
+	if changed {
+		source.initChanged = true
 	}
 }
 
+func (source *Source) setVideoCodec(codecID uint8) {
+	if source.hasVideo && source.videoCodec == codecID {
+		return
+	}
+	if source.hasVideo {
+		source.discontinuity = true
+	}
+	source.hasVideo = true
+	source.videoCodec = codecID
+	source.muxer.SetVideoCodec(codecID)
+	source.updatePMT()
+}
+
 func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 	var compositionTime int32
 	var ah av.AudioPacketHeader
 	var vh av.VideoPacketHeader
 	if p.IsVideo {
 		vh = p.Header.(av.VideoPacketHeader)
-		if vh.CodecID() != av.VIDEO_H264 {
+		if vh.CodecID() != av.VIDEO_H264 && vh.CodecID() != av.VIDEO_HEVC {
 			return compositionTime, false, ErrNoSupportVideoCodec
 		}
 		compositionTime = vh.CompositionTime()
+		if vh.IsExHeader() && vh.PacketType() == av.PKT_METADATA {
+			return compositionTime, true, nil
+		}
 		if vh.IsKeyFrame() && vh.IsSeq() {
-			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
+			err := source.tsparser.Parse(p, source.bwriter)
+			if err == nil {
+				// new codec parameters are a discontinuity
+				if source.videoConfig != nil && !bytes.Equal(source.videoConfig, p.Data) {
+					source.discontinuity = true
+				}
+				source.videoConfig = append([]byte(nil), p.Data...)
+				source.setVideoCodec(vh.CodecID())
+				source.configure(p)
+			}
+			return compositionTime, true, err
 		}
 	} else {
 		ah = p.Header.(av.AudioPacketHeader)
-		if ah.SoundFormat() != av.SOUND_AAC {
+		switch ah.SoundFormat() {
+		case av.SOUND_AAC:
+			if ah.AACPacketType() == av.AAC_SEQHDR {
+				err := source.tsparser.Parse(p, source.bwriter)
+				if err == nil {
+					if source.aacConfig != nil && !bytes.Equal(source.aacConfig, p.Data) {
+						source.discontinuity = true
+					}
+					source.aacConfig = append([]byte(nil), p.Data...)
+					if source.segKey != nil && source.segKey.method == methodSampleAES {
+						source.muxer.SetSampleAES(true, source.aacConfig)
+					}
+					source.setSoundFormat(av.SOUND_AAC)
+					source.configure(p)
+				}
+				return compositionTime, true, err
+			}
+		case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
+		default:
 			return compositionTime, false, ErrNoSupportAudioCodec
 		}
-		if ah.AACPacketType() == av.AAC_SEQHDR {
-			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
-		}
 	}
 	source.bwriter.Reset()
 	if err := source.tsparser.Parse(p, source.bwriter); err != nil {
 		return compositionTime, false, err
 	}
-	p.Data = source.bwriter.Bytes()
+	if source.subtitles != nil && p.IsVideo && vh.CodecID() == av.VIDEO_H264 {
+		pts := uint32(int64(p.TimeStamp) + int64(compositionTime))
+		source.subtitles.captions(p.TimeStamp, pts, source.tsparser.Captions())
+	}
+	// fMP4 samples keep the length prefixed NAL units and raw AAC frames
+	if source.fmuxer == nil {
+		p.Data = source.bwriter.Bytes()
+	}
+	if p.IsAudio {
+		source.setSoundFormat(ah.SoundFormat())
+		if ah.SoundFormat() != av.SOUND_AAC {
+			source.configure(p)
+		}
+	}
 
-	if p.IsVideo && vh.IsKeyFrame() {
-		source.cut()
+	// segments start on video key frames, audio only streams are cut on
+	// duration boundaries
+	mainTrack := p.IsVideo || !source.hasVideo
+	if mainTrack {
+		source.checkTimestamp(p.TimeStamp)
+	}
+	randomAccess := (p.IsVideo && vh.IsKeyFrame()) || (p.IsAudio && !source.hasVideo)
+	if randomAccess {
+		source.splice = source.dueCue(p.TimeStamp)
+		source.cut(p.TimeStamp)
+	}
+	if source.lowLatency && source.btswriter != nil && mainTrack && source.partFull(p.TimeStamp) {
+		source.cutPart(p.TimeStamp)
+		source.partIndependent = randomAccess
+	}
+	if source.fmuxer == nil && !source.encryptSample(p) {
+		return compositionTime, true, nil
 	}
 	return compositionTime, false, nil
 }
@@ -250,10 +763,25 @@ func (source *Source) calcPtsDts(isVideo bool, ts, compositionTs uint32) {
 		source.pts = source.dts + uint64(compositionTs)*h264_default_hz
 	} else {
 		sampleRate, _ := source.tsparser.SampleRate()
-		source.align.align(&source.dts, uint32(videoHZ*aacSampleLen/sampleRate))
+		frameSamples, err := source.tsparser.FrameSamples()
+		if err != nil {
+			frameSamples = aacSampleLen
+		}
+		source.align.align(&source.dts, uint32(videoHZ*frameSamples/sampleRate))
 		source.pts = source.dts
 	}
 }
+
+// flush write what is buffered by the muxers, timestamp is the time of the
+// next packet
+func (source *Source) flush(timestamp uint32) {
+	if source.fmuxer != nil {
+		source.btswriter.Write(source.fmuxer.Fragment(timestamp))
+		return
+	}
+	source.flushAudio()
+}
+
 func (source *Source) flushAudio() error {
 	return source.muxAudio(1)
 }
@@ -270,6 +798,9 @@ func (source *Source) muxAudio(limit byte) error {
 }
 
 func (source *Source) tsMux(p *av.Packet) error {
+	if source.fmuxer != nil {
+		return source.fmuxer.WritePacket(p)
+	}
 	if p.IsVideo {
 		return source.muxer.Mux(p, source.btswriter)
 	} else {
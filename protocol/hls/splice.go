@@ -0,0 +1,157 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/container/ts"
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+const (
+	onCuePoint = "onCuePoint"
+
+	spliceTableID    = 0xfc
+	spliceInsertType = 0x05
+	// bytes between section_length and splice_command_type
+	spliceHeaderLen = 10
+)
+
+// Splice is an ad break signalled by the publisher, Start and End are the
+// wall clock times of the segments starting and ending the break
+type Splice struct {
+	ID              string
+	EventID         uint32
+	Start           time.Time
+	End             time.Time
+	PlannedDuration float64
+	// SCTE35 is the splice_info_section of the splice point
+	SCTE35 []byte
+}
+
+// cuePoint is a splice point waiting for the random access point starting
+// its segment, auto is set on the return planned by the break duration
+type cuePoint struct {
+	out       bool
+	auto      bool
+	timestamp uint32
+	splice    Splice
+}
+
+// parseCuePoint return the splice point of an onCuePoint message. The cue
+// point name is out or in, its time in seconds is the splice position and
+// its parameters may give the id, the duration in seconds and the scte35
+// splice_info_section, hex or base64 encoded.
+func parseCuePoint(data []byte, timestamp uint32) (cuePoint, bool) {
+	decoder := &amf.Decoder{}
+	values, _ := decoder.DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if len(values) > 0 && values[0] == amf.SetDataFrame {
+		values = values[1:]
+	}
+	if len(values) < 2 || values[0] != onCuePoint {
+		return cuePoint{}, false
+	}
+	obj, ok := values[1].(amf.Object)
+	if !ok {
+		return cuePoint{}, false
+	}
+	var cue cuePoint
+	name, _ := obj["name"].(string)
+	switch strings.ToLower(name) {
+	case "out", "cue-out", "scte35-out":
+		cue.out = true
+	case "in", "cue-in", "scte35-in":
+	default:
+		return cuePoint{}, false
+	}
+	cue.timestamp = timestamp
+	if t, ok := obj["time"].(float64); ok && t > 0 {
+		cue.timestamp = uint32(t * 1000)
+	}
+	params, _ := obj["parameters"].(amf.Object)
+	switch id := params["id"].(type) {
+	case string:
+		cue.splice.ID = id
+	case float64:
+		cue.splice.ID = strconv.FormatUint(uint64(id), 10)
+	}
+	if id, err := strconv.ParseUint(cue.splice.ID, 10, 32); err == nil {
+		cue.splice.EventID = uint32(id)
+	}
+	switch d := params["duration"].(type) {
+	case float64:
+		cue.splice.PlannedDuration = d
+	case string:
+		cue.splice.PlannedDuration, _ = strconv.ParseFloat(d, 64)
+	}
+	if s, ok := params["scte35"].(string); ok {
+		cue.splice.SCTE35 = decodeSCTE35(s)
+	}
+	return cue, true
+}
+
+// decodeSCTE35 accept a 0x prefixed hex or a base64 splice_info_section
+func decodeSCTE35(s string) []byte {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		b, _ := hex.DecodeString(s[2:])
+		return b
+	}
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return b
+}
+
+// spliceInsert return a splice_info_section with an immediate splice_insert
+// of the whole program, out of the network at the start of a break
+func spliceInsert(eventID uint32, out bool, duration float64) []byte {
+	flags := byte(0x5f) // program_splice_flag, splice_immediate_flag
+	if out {
+		flags |= 0x80
+	}
+	cmd := []byte{spliceInsertType, byte(eventID >> 24), byte(eventID >> 16), byte(eventID >> 8), byte(eventID), 0x7f}
+	if out && duration > 0 {
+		d := uint64(duration * 90000)
+		// break_duration with auto_return
+		cmd = append(cmd, flags|0x20, 0xfe|byte(d>>32&0x01), byte(d>>24), byte(d>>16), byte(d>>8), byte(d))
+	} else {
+		cmd = append(cmd, flags)
+	}
+	// unique_program_id, avail_num, avails_expected
+	cmd = append(cmd, 0x00, 0x00, 0x00, 0x00)
+
+	cmdLen := len(cmd) - 1
+	sectionLen := spliceHeaderLen + len(cmd) + 2 + 4
+	section := []byte{spliceTableID, 0x30 | byte(sectionLen>>8&0x0f), byte(sectionLen),
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xf0 | byte(cmdLen>>8&0x0f), byte(cmdLen)}
+	section = append(section, cmd...)
+	// descriptor_loop_length
+	section = append(section, 0x00, 0x00)
+	crc := ts.GenCrc32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// writeSplice write the ad break tags of a segment starting or ending a break
+func writeSplice(w *bytes.Buffer, out, in *Splice) {
+	if out != nil {
+		fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"%s\",START-DATE=\"%s\"", out.ID, formatProgramDateTime(out.Start))
+		if out.PlannedDuration > 0 {
+			fmt.Fprintf(w, ",PLANNED-DURATION=%.3f", out.PlannedDuration)
+		}
+		fmt.Fprintf(w, ",SCTE35-OUT=0x%X\n", out.SCTE35)
+		if out.PlannedDuration > 0 {
+			fmt.Fprintf(w, "#EXT-X-CUE-OUT:DURATION=%.3f\n", out.PlannedDuration)
+		} else {
+			w.WriteString("#EXT-X-CUE-OUT\n")
+		}
+	}
+	if in != nil {
+		fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"%s\",START-DATE=\"%s\",DURATION=%.3f,SCTE35-IN=0x%X\n",
+			in.ID, formatProgramDateTime(in.Start), in.End.Sub(in.Start).Seconds(), in.SCTE35)
+		w.WriteString("#EXT-X-CUE-IN\n")
+	}
+}
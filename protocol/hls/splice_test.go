@@ -0,0 +1,100 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/container/ts"
+	"github.com/gwuhaolin/livego/protocol/amf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCuePoint(t *testing.T) {
+	at := assert.New(t)
+	data := encodeData(t, "onCuePoint", amf.Object{
+		"name": "out",
+		"time": float64(12.5),
+		"parameters": amf.Object{
+			"id":       "42",
+			"duration": "30",
+			"scte35":   "0xFC3000",
+		},
+	})
+	cue, ok := parseCuePoint(data, 1000)
+	at.True(ok)
+	at.True(cue.out)
+	at.Equal(uint32(12500), cue.timestamp)
+	at.Equal("42", cue.splice.ID)
+	at.Equal(uint32(42), cue.splice.EventID)
+	at.Equal(float64(30), cue.splice.PlannedDuration)
+	at.Equal([]byte{0xfc, 0x30, 0x00}, cue.splice.SCTE35)
+
+	cue, ok = parseCuePoint(encodeData(t, amf.SetDataFrame, "onCuePoint", amf.Object{"name": "in"}), 1000)
+	at.True(ok)
+	at.False(cue.out)
+	at.Equal(uint32(1000), cue.timestamp)
+
+	_, ok = parseCuePoint(encodeData(t, "onCuePoint", amf.Object{"name": "chapter"}), 1000)
+	at.False(ok)
+}
+
+func TestSpliceInsert(t *testing.T) {
+	at := assert.New(t)
+	section := spliceInsert(7, true, 30)
+	at.Equal(byte(spliceTableID), section[0])
+	at.Equal(len(section)-3, int(section[1]&0x0f)<<8|int(section[2]))
+	at.Equal(byte(spliceInsertType), section[13])
+	at.Equal([]byte{0, 0, 0, 7}, section[14:18])
+	// out of network, program splice, duration, immediate
+	at.Equal(byte(0xff), section[19])
+	at.Equal(uint64(30*90000), uint64(section[20]&0x01)<<32|uint64(section[21])<<24|
+		uint64(section[22])<<16|uint64(section[23])<<8|uint64(section[24]))
+	at.Equal(len(section)-13-1-2-4, int(section[11]&0x0f)<<8|int(section[12]))
+	// the CRC of a section followed by its CRC is zero
+	at.Equal(uint32(0), ts.GenCrc32(section))
+
+	section = spliceInsert(7, false, 0)
+	at.Equal(byte(0x5f), section[19])
+	at.Equal(uint32(0), ts.GenCrc32(section))
+}
+
+func TestApplySplice(t *testing.T) {
+	at := assert.New(t)
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	s := &Source{frameInterval: 40}
+	s.cues = []cuePoint{{out: true, timestamp: 10000, splice: Splice{PlannedDuration: 30}}}
+
+	at.Nil(s.dueCue(9000))
+	s.splice = s.dueCue(9980)
+	at.NotNil(s.splice)
+	s.segment = TSItem{ProgramDateTime: start}
+	s.applySplice(9980)
+	out := s.segment.CueOut
+	at.NotNil(out)
+	at.Equal("1", out.ID)
+	at.Equal(start, out.Start)
+	at.Equal(spliceInsert(1, true, 30), out.SCTE35)
+
+	// the break returns after its planned duration
+	at.Nil(s.dueCue(20000))
+	s.splice = s.dueCue(39980)
+	s.segment = TSItem{ProgramDateTime: start.Add(30 * time.Second)}
+	s.applySplice(39980)
+	in := s.segment.CueIn
+	at.NotNil(in)
+	at.Equal("1", in.ID)
+	at.Equal(30*time.Second, in.End.Sub(in.Start))
+	at.Equal(spliceInsert(1, false, 0), in.SCTE35)
+	at.Nil(s.adBreak)
+
+	body := bytes.NewBuffer(nil)
+	writeSplice(body, out, in)
+	at.Equal("#EXT-X-DATERANGE:ID=\"1\",START-DATE=\"2026-10-17T12:00:00.000Z\",PLANNED-DURATION=30.000,"+
+		"SCTE35-OUT=0x"+strings.ToUpper(hex.EncodeToString(out.SCTE35))+"\n#EXT-X-CUE-OUT:DURATION=30.000\n"+
+		"#EXT-X-DATERANGE:ID=\"1\",START-DATE=\"2026-10-17T12:00:00.000Z\",DURATION=30.000,"+
+		"SCTE35-IN=0x"+strings.ToUpper(hex.EncodeToString(in.SCTE35))+"\n#EXT-X-CUE-IN\n", body.String())
+}
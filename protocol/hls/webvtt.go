@@ -0,0 +1,208 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+const (
+	onTextData = "onTextData"
+	// how long an onTextData text stays on screen when no other replaces it
+	textDataDuration = 5000 // ms
+	// frames waiting for their presentation order, B-frames are
+	// only a few frames ahead
+	maxCaptionFrames = 32
+)
+
+var webvttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+type subtitleCue struct {
+	start uint32
+	end   uint32
+	text  string
+}
+
+type captionFrame struct {
+	pts  uint32
+	data []byte
+}
+
+// subtitleTrack build the WebVTT segments of a stream from the onTextData
+// messages and the CEA-608 or CEA-708 captions of the video, the text on
+// screen is the last one received from either
+type subtitleTrack struct {
+	decoder *cea608
+	dtvcc   *cea708
+	// the CEA-708 captions replace the CEA-608 ones once some are decoded
+	dtvccText bool
+	frames    []captionFrame
+	text      string
+	start     uint32
+	expires   uint32
+	cues      []subtitleCue
+}
+
+func newSubtitleTrack() *subtitleTrack {
+	return &subtitleTrack{
+		decoder: newCEA608(),
+		dtvcc:   newCEA708(),
+	}
+}
+
+// show put text on screen at timestamp, the previous text becomes a cue
+func (track *subtitleTrack) show(timestamp uint32, text string) {
+	if text == track.text {
+		return
+	}
+	if track.text != "" && timestamp > track.start {
+		track.cues = append(track.cues, subtitleCue{
+			start: track.start,
+			end:   timestamp,
+			text:  track.text,
+		})
+	}
+	track.text = text
+	track.start = timestamp
+}
+
+// textData show the text of an onTextData message for a few seconds
+func (track *subtitleTrack) textData(timestamp uint32, text string) {
+	track.show(timestamp, text)
+	track.expires = timestamp + textDataDuration
+}
+
+// captions decode the cc_data triplets of a video frame, the frames are
+// decoded in presentation order once no frame decoded earlier can precede
+// them
+func (track *subtitleTrack) captions(dts, pts uint32, data []byte) {
+	if len(data) > 0 {
+		i := sort.Search(len(track.frames), func(i int) bool {
+			return track.frames[i].pts > pts
+		})
+		track.frames = append(track.frames, captionFrame{})
+		copy(track.frames[i+1:], track.frames[i:])
+		track.frames[i] = captionFrame{pts: pts, data: append([]byte(nil), data...)}
+	}
+	n := 0
+	for n < len(track.frames) && (track.frames[n].pts <= dts || len(track.frames)-n > maxCaptionFrames) {
+		track.decode(track.frames[n])
+		n++
+	}
+	track.frames = track.frames[n:]
+}
+
+// decode apply the captions of frame, the screen is shown as it is at the
+// end of the frame
+func (track *subtitleTrack) decode(frame captionFrame) {
+	var text string
+	changed := false
+	for i := 0; i+3 <= len(frame.data); i += 3 {
+		if frame.data[i]&0x04 == 0 {
+			continue
+		}
+		switch ccType := frame.data[i] & 0x03; ccType {
+		case 0:
+			// the field 1 pairs carrying CC1
+			if t, ok := track.decoder.decode(frame.data[i+1], frame.data[i+2]); ok && !track.dtvccText {
+				text, changed = t, true
+			}
+		case 2, 3:
+			// the DTVCC packets carrying the CEA-708 services
+			if t, ok := track.dtvcc.decode(ccType, frame.data[i+1], frame.data[i+2]); ok {
+				text, changed = t, true
+				track.dtvccText = track.dtvccText || t != ""
+			}
+		}
+	}
+	if changed {
+		track.show(frame.pts, text)
+		track.expires = 0
+	}
+}
+
+// reset drop the cues of the timeline left by a timestamp jump
+func (track *subtitleTrack) reset(timestamp uint32) {
+	track.frames = nil
+	track.cues = nil
+	track.expires = 0
+	track.start = timestamp
+}
+
+// segment return the WebVTT segment of the media segment from start to
+// end, a cue spanning several segments is repeated in each of them
+func (track *subtitleTrack) segment(start, end uint32) []byte {
+	if track.expires != 0 && track.expires <= end {
+		track.show(track.expires, "")
+		track.expires = 0
+	}
+	w := bytes.NewBufferString(webvttHeader(start))
+	cues := track.cues[:0]
+	for _, cue := range track.cues {
+		writeCue(w, cue, start, end)
+		if cue.end > end {
+			cues = append(cues, cue)
+		}
+	}
+	track.cues = cues
+	if track.text != "" {
+		writeCue(w, subtitleCue{start: track.start, end: end, text: track.text}, start, end)
+	}
+	return w.Bytes()
+}
+
+// webvttHeader map the local time start of a WebVTT segment to the MPEG-TS
+// timestamp of its media segment, the stream timestamps in milliseconds are
+// written by the muxer as 90kHz timestamps wrapping at 2^33
+func webvttHeader(start uint32) string {
+	mpegts := uint64(start) * 90 % (1 << 33)
+	return fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:%s\n\n", mpegts, webvttTime(start))
+}
+
+// writeCue write the part of cue between start and end
+func writeCue(w *bytes.Buffer, cue subtitleCue, start, end uint32) {
+	if cue.start < start {
+		cue.start = start
+	}
+	if cue.end > end {
+		cue.end = end
+	}
+	if cue.start >= cue.end {
+		return
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.Replace(cue.text, "\r\n", "\n", -1), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, webvttEscaper.Replace(line))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s --> %s\n%s\n\n", webvttTime(cue.start), webvttTime(cue.end), strings.Join(lines, "\n"))
+}
+
+func webvttTime(ms uint32) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// parseTextData return the text of an onTextData message
+func parseTextData(data []byte) (string, bool) {
+	decoder := &amf.Decoder{}
+	values, _ := decoder.DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if len(values) > 0 && values[0] == amf.SetDataFrame {
+		values = values[1:]
+	}
+	if len(values) < 2 || values[0] != onTextData {
+		return "", false
+	}
+	obj, ok := values[1].(amf.Object)
+	if !ok {
+		return "", false
+	}
+	text, ok := obj["text"].(string)
+	return text, ok
+}
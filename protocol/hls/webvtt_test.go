@@ -0,0 +1,148 @@
+package hls
+
+import (
+	"testing"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ccData return the field 1 cc_data triplets of pairs
+func ccData(pairs ...byte) []byte {
+	var data []byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		data = append(data, 0xfc, pairs[i], pairs[i+1])
+	}
+	return data
+}
+
+func TestCEA608(t *testing.T) {
+	at := assert.New(t)
+	dec := newCEA608()
+	decode := func(pairs ...byte) (text string, changed bool) {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if t, ok := dec.decode(pairs[i], pairs[i+1]); ok {
+				text, changed = t, true
+			}
+		}
+		return
+	}
+
+	// pop-on captions are shown by the end of caption, the parity bit of
+	// the doubled control codes is ignored
+	_, changed := decode(0x94, 0x20, 0x94, 0x20, 0x14, 0x70, 'H', 'I', 0x11, 0x37, 0x11, 0x37)
+	at.False(changed)
+	text, changed := decode(0x14, 0x2f, 0x14, 0x2f)
+	at.True(changed)
+	at.Equal("HI♪", text)
+	text, changed = decode(0x14, 0x2c)
+	at.True(changed)
+	at.Equal("", text)
+
+	// roll-up captions are shown as they come
+	text, _ = decode(0x14, 0x25, 0x14, 0x70, 'A', 'B')
+	at.Equal("AB", text)
+	text, _ = decode(0x14, 0x2d, 'C', 'D')
+	at.Equal("AB\nCD", text)
+	text, _ = decode(0x14, 0x2d, 'E', 'F')
+	at.Equal("CD\nEF", text)
+
+	// extended characters replace the character before them
+	text, _ = decode('e', 0x00, 0x12, 0x26)
+	at.Equal("CD\nEF‘", text)
+
+	// the second channel is ignored
+	_, changed = decode(0x1c, 0x2c, 'X', 'Y')
+	at.False(changed)
+}
+
+// dtvccData return the cc_data triplets of a DTVCC packet carrying data in
+// service 1
+func dtvccData(data ...byte) []byte {
+	packet := append([]byte{0, 1<<5 | byte(len(data))}, data...)
+	if len(packet)%2 != 0 {
+		packet = append(packet, 0)
+	}
+	packet[0] = byte(len(packet) / 2)
+	var cc []byte
+	for i := 0; i < len(packet); i += 2 {
+		header := byte(0xfe)
+		if i == 0 {
+			header = 0xff
+		}
+		cc = append(cc, header, packet[i], packet[i+1])
+	}
+	return cc
+}
+
+func TestCEA708(t *testing.T) {
+	at := assert.New(t)
+	dec := newCEA708()
+	decode := func(cc []byte) (text string, changed bool) {
+		for i := 0; i+3 <= len(cc); i += 3 {
+			if t, ok := dec.decode(cc[i]&0x03, cc[i+1], cc[i+2]); ok {
+				text, changed = t, true
+			}
+		}
+		return
+	}
+
+	// a hidden window is written then displayed
+	_, changed := decode(dtvccData(0x98, 0x00, 0, 0, 0, 0, 0, 'H', 'I', 0x0d, 0x7f, 0x10, 0x35))
+	at.False(changed)
+	text, changed := decode(dtvccData(0x89, 0x01))
+	at.True(changed)
+	at.Equal("HI\n♪•", text)
+	// a block of another service is skipped
+	_, changed = decode([]byte{0xff, 0x02, 2<<5 | 1, 0xfe, 'X', 0})
+	at.False(changed)
+	text, changed = decode(dtvccData(0x88, 0x01))
+	at.True(changed)
+	at.Equal("", text)
+}
+
+func TestSubtitleTrack(t *testing.T) {
+	at := assert.New(t)
+	track := newSubtitleTrack()
+
+	// the caption of a B-frame decoded first is applied in presentation order
+	track.captions(1000, 1100, ccData(0x14, 0x20, 0x14, 0x70, 'H', 'I', 0x14, 0x2f))
+	at.Equal("", track.text)
+	track.captions(1033, 1033, nil)
+	track.captions(1100, 1133, nil)
+	at.Equal("HI", track.text)
+	track.captions(3000, 3000, ccData(0x14, 0x2c))
+
+	at.Equal(webvttHeader(0)+"00:00:01.100 --> 00:00:02.000\nHI\n\n", string(track.segment(0, 2000)))
+	at.Equal(webvttHeader(2000)+"00:00:02.000 --> 00:00:03.000\nHI\n\n", string(track.segment(2000, 4000)))
+
+	// onTextData is shown until replaced or for a few seconds
+	track.textData(4500, "a < b")
+	at.Equal(webvttHeader(4000)+"00:00:04.500 --> 00:00:06.000\na &lt; b\n\n", string(track.segment(4000, 6000)))
+	at.Equal(webvttHeader(6000)+"00:00:06.000 --> 00:00:09.500\na &lt; b\n\n", string(track.segment(6000, 12000)))
+	at.Equal(webvttHeader(12000), string(track.segment(12000, 14000)))
+
+	// CEA-708 captions replace the CEA-608 ones of the same stream
+	track.captions(15000, 15000, append(dtvccData(0x98, 0x20, 0, 0, 0, 0, 0, 'H', 'E', 'Y'),
+		ccData(0x14, 0x2c, 0x14, 0x70, 'X', 0x80, 0x14, 0x2f)...))
+	at.Equal("HEY", track.text)
+	track.captions(16000, 16000, ccData(0x14, 0x20, 0x14, 0x70, 'Y', 0x80, 0x14, 0x2f))
+	at.Equal("HEY", track.text)
+}
+
+func TestWebVTTHeader(t *testing.T) {
+	at := assert.New(t)
+	at.Equal("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:180000,LOCAL:00:00:02.000\n\n", webvttHeader(2000))
+	// the MPEG-TS timestamps wrap after 26h30
+	at.Equal("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:89938,LOCAL:26:30:44.717\n\n", webvttHeader(95443717+1000))
+}
+
+func TestParseTextData(t *testing.T) {
+	at := assert.New(t)
+	text, ok := parseTextData(encodeData(t, amf.SetDataFrame, "onTextData", amf.Object{"text": "hello", "language": "eng"}))
+	at.True(ok)
+	at.Equal("hello", text)
+	_, ok = parseTextData(encodeData(t, "onCuePoint", amf.Object{"text": "hello"}))
+	at.False(ok)
+}
@@ -0,0 +1,130 @@
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ActionPublish  = "on_publish"
+	ActionPlay     = "on_play"
+	ActionPlayDone = "on_play_done"
+
+	maxBodyLen = 4 * 1024
+)
+
+var (
+	ErrUnauthorized = fmt.Errorf("hook unauthorized")
+	ErrRejected     = fmt.Errorf("hook rejected")
+	ErrInvalidName  = fmt.Errorf("hook returned invalid stream name")
+)
+
+// Event is posted as JSON to the configured callback url
+type Event struct {
+	Action   string            `json:"action"`
+	Protocol string            `json:"protocol,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	App      string            `json:"app"`
+	Name     string            `json:"name"`
+	TcUrl    string            `json:"tcUrl,omitempty"`
+	Query    map[string]string `json:"query,omitempty"`
+	Addr     string            `json:"addr"`
+	FlashVer string            `json:"flashVer,omitempty"`
+	SwfUrl   string            `json:"swfUrl,omitempty"`
+	PageUrl  string            `json:"pageUrl,omitempty"`
+	// ClientID tell apart the viewers of a stream sharing an address, it
+	// is the same in on_play and on_play_done
+	ClientID string `json:"clientId,omitempty"`
+}
+
+type Result struct {
+	Status int
+	Body   []byte
+}
+
+func (r *Result) OK() bool {
+	return r.Status >= 200 && r.Status < 300
+}
+
+// Err maps a non 2xx reply to ErrUnauthorized or ErrRejected
+func (r *Result) Err() error {
+	switch {
+	case r.OK():
+		return nil
+	case r.Status == http.StatusUnauthorized || r.Status == http.StatusForbidden:
+		return ErrUnauthorized
+	default:
+		return ErrRejected
+	}
+}
+
+func newClient() *http.Client {
+	timeout := configure.Config.GetInt("hook_timeout")
+	if timeout <= 0 {
+		timeout = 5
+	}
+	return &http.Client{
+		Timeout: time.Second * time.Duration(timeout),
+	}
+}
+
+// Post send event to hookURL and return the reply
+func Post(hookURL string, event *Event) (*Result, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newClient().Post(hookURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodyLen))
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("hook %s %s: status=%d body=%q", event.Action, hookURL, resp.StatusCode, body)
+	return &Result{
+		Status: resp.StatusCode,
+		Body:   body,
+	}, nil
+}
+
+// OnPublish ask hookURL whether the publisher may go live. A 2xx reply allows
+// the stream; a non empty reply body renames it.
+func OnPublish(hookURL string, event *Event) (name string, err error) {
+	event.Action = ActionPublish
+	ret, err := Post(hookURL, event)
+	if err != nil {
+		return "", err
+	}
+	if err = ret.Err(); err != nil {
+		return "", err
+	}
+
+	name = strings.TrimSpace(string(ret.Body))
+	if name == "" {
+		name = event.Name
+	}
+	if !ValidName(name) {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
+
+// ValidName tell whether name can name a stream, it becomes a path
+// component of the HLS, DVR and archive files
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\?# \t\r\n")
+}
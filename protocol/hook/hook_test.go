@@ -0,0 +1,108 @@
+package hook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnPublish(t *testing.T) {
+	at := assert.New(t)
+
+	var got Event
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		switch got.Query["token"] {
+		case "rename":
+			w.Write([]byte("movie\n"))
+		case "ok":
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	event := &Event{App: "live", Name: "abc", Query: map[string]string{"token": "ok"}}
+	name, err := OnPublish(ts.URL, event)
+	at.Equal(nil, err)
+	at.Equal("abc", name)
+	at.Equal(ActionPublish, got.Action)
+	at.Equal("live", got.App)
+
+	event.Query["token"] = "rename"
+	name, err = OnPublish(ts.URL, event)
+	at.Equal(nil, err)
+	at.Equal("movie", name)
+
+	event.Query["token"] = "bad"
+	_, err = OnPublish(ts.URL, event)
+	at.Equal(ErrUnauthorized, err)
+
+	// the publisher's own name is checked as well when the hook keeps it
+	event.Query["token"] = "ok"
+	event.Name = ".."
+	_, err = OnPublish(ts.URL, event)
+	at.Equal(ErrInvalidName, err)
+}
+
+func TestValidName(t *testing.T) {
+	at := assert.New(t)
+	at.True(ValidName("movie"))
+	at.True(ValidName("movie.1"))
+	for _, name := range []string{"", ".", "..", "../x", "a/b", "a\\b", "a?b", "a b", "a\nb"} {
+		at.False(ValidName(name), name)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	at := assert.New(t)
+	id := NewSessionID()
+	at.True(ValidSessionID(id))
+	at.NotEqual(id, NewSessionID())
+
+	at.False(ValidSessionID(""))
+	at.False(ValidSessionID("viewer1"))
+	at.False(ValidSessionID(id[:16] + NewSessionID()[16:]))
+}
+
+func TestPlaySessionsAuthorize(t *testing.T) {
+	at := assert.New(t)
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+	configure.Config.Set("server", []map[string]interface{}{{"appname": "live", "on_play": ts.URL}})
+	configure.LoadApplications()
+	defer func() {
+		configure.Config.Set("server", nil)
+		configure.LoadApplications()
+	}()
+
+	// the parallel first requests of a session call on_play once
+	sessions := NewPlaySessions(time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			at.Equal(nil, sessions.Authorize("live/test@10.0.0.1/a", &Event{App: "live", Name: "test"}))
+		}()
+	}
+	wg.Wait()
+	at.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	at.Equal(nil, sessions.Authorize("live/test@10.0.0.1/a", &Event{App: "live", Name: "test"}))
+	at.Equal(nil, sessions.Authorize("live/test@10.0.0.1/b", &Event{App: "live", Name: "test"}))
+	at.Equal(int32(2), atomic.LoadInt32(&calls))
+}
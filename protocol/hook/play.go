@@ -0,0 +1,162 @@
+package hook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ProtocolRTMP    = "rtmp"
+	ProtocolHTTPFLV = "httpflv"
+	ProtocolHLS     = "hls"
+	ProtocolDASH    = "dash"
+)
+
+// sessionSecret sign the viewer session ids issued by this process
+var sessionSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("session secret: ", err)
+	}
+	return secret
+}()
+
+// NewSessionID issue the id of an HTTP viewer session, a random part
+// followed by its signature so that clients cannot choose their id
+func NewSessionID() string {
+	id := uid.NewId()
+	return id + signSession(id)
+}
+
+// ValidSessionID tell whether id was issued by NewSessionID
+func ValidSessionID(id string) bool {
+	n := len(id) / 2
+	return len(id) == 32 && hmac.Equal([]byte(id[n:]), []byte(signSession(id[:n])))
+}
+
+func signSession(id string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(id))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// NewHTTPEvent build a play event from an HTTP-FLV or HLS request for key
+func NewHTTPEvent(protocol, key string, r *http.Request) *Event {
+	event := &Event{
+		Protocol: protocol,
+		Key:      key,
+		Query:    make(map[string]string),
+		PageUrl:  r.Referer(),
+	}
+	if paths := strings.SplitN(key, "/", 2); len(paths) == 2 {
+		event.App = paths[0]
+		event.Name = paths[1]
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event.Addr = host
+	}
+	for k, v := range r.URL.Query() {
+		event.Query[k] = v[0]
+	}
+	return event
+}
+
+// OnPlay ask the application's on_play hook whether the viewer may play,
+// applications without on_play allow every viewer
+func OnPlay(event *Event) error {
+	app, ok := configure.GetApplication(event.App)
+	if !ok || app.OnPlay == "" {
+		return nil
+	}
+	event.Action = ActionPlay
+	ret, err := Post(app.OnPlay, event)
+	if err != nil {
+		return err
+	}
+	return ret.Err()
+}
+
+// OnPlayDone notify the application's on_play_done hook in background
+func OnPlayDone(event *Event) {
+	app, ok := configure.GetApplication(event.App)
+	if !ok || app.OnPlayDone == "" {
+		return
+	}
+	done := *event
+	done.Action = ActionPlayDone
+	go func() {
+		if _, err := Post(app.OnPlayDone, &done); err != nil {
+			log.Warning("on_play_done err: ", err)
+		}
+	}()
+}
+
+// PlaySessions cache the on_play result of stateless viewers such as HLS,
+// so that only the first request of a session trigger the callback. A session
+// which is not seen for ttl expires and fires on_play_done.
+type PlaySessions struct {
+	lock     sync.Mutex
+	pending  map[string]*pendingPlay
+	sessions *cache.Cache
+}
+
+// pendingPlay is an on_play call in progress, the requests of its session
+// wait for its result
+type pendingPlay struct {
+	done chan struct{}
+	err  error
+}
+
+func NewPlaySessions(ttl time.Duration) *PlaySessions {
+	s := &PlaySessions{
+		pending:  make(map[string]*pendingPlay),
+		sessions: cache.New(ttl, ttl/2),
+	}
+	s.sessions.OnEvicted(func(id string, v interface{}) {
+		log.Debug("play session expired: ", id)
+		OnPlayDone(v.(*Event))
+	})
+	return s
+}
+
+// Authorize check the session id, calling on_play when the session is new.
+// The parallel first requests of a session share a single on_play call.
+func (s *PlaySessions) Authorize(id string, event *Event) error {
+	s.lock.Lock()
+	if v, found := s.sessions.Get(id); found {
+		s.sessions.SetDefault(id, v)
+		s.lock.Unlock()
+		return nil
+	}
+	if p, ok := s.pending[id]; ok {
+		s.lock.Unlock()
+		<-p.done
+		return p.err
+	}
+	p := &pendingPlay{done: make(chan struct{})}
+	s.pending[id] = p
+	s.lock.Unlock()
+
+	p.err = OnPlay(event)
+	s.lock.Lock()
+	if p.err == nil {
+		s.sessions.SetDefault(id, event)
+	}
+	delete(s.pending, id)
+	s.lock.Unlock()
+	close(p.done)
+	return p.err
+}
@@ -7,7 +7,9 @@ import (
 	"strings"
 
 	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/protocol/hook"
 	"github.com/gwuhaolin/livego/protocol/rtmp"
+	"github.com/gwuhaolin/livego/utils/uid"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -37,6 +39,9 @@ func (server *Server) Serve(l net.Listener) error {
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		server.handleConn(w, r)
 	})
+	mux.HandleFunc("/vod/", func(w http.ResponseWriter, r *http.Request) {
+		server.handleVod(w, r)
+	})
 	mux.HandleFunc("/streams", func(w http.ResponseWriter, r *http.Request) {
 		server.getStream(w, r)
 	})
@@ -133,8 +138,18 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	event := hook.NewHTTPEvent(hook.ProtocolHTTPFLV, path, r)
+	event.ClientID = uid.NewId()
+	if err := hook.OnPlay(event); err != nil {
+		log.Debugf("on_play %s err=%v", path, err)
+		http.Error(w, "play not allowed", http.StatusForbidden)
+		return
+	}
+	defer hook.OnPlayDone(event)
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	writer := NewFLVWriter(paths[0], paths[1], url, w)
+	writer.Uid = event.ClientID
 
 	server.handler.HandleWriter(writer)
 	writer.Wait()
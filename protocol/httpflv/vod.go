@@ -0,0 +1,181 @@
+package httpflv
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/configure"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/protocol/hook"
+	"github.com/gwuhaolin/livego/utils/pio"
+	"github.com/gwuhaolin/livego/utils/uid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleVod serve a recorded file of flv_dir from /vod/APP/FILE.flv, start
+// is the playback position in seconds, rounded down to a key frame, and
+// realtime paces the tags to their timestamps instead of sending them as
+// fast as the client reads them
+func (server *Server) handleVod(w http.ResponseWriter, r *http.Request) {
+	u := strings.TrimPrefix(r.URL.Path, "/vod/")
+	if !strings.HasSuffix(u, ".flv") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	path := strings.TrimSuffix(u, ".flv")
+	paths := strings.Split(path, "/")
+	if len(paths) != 2 {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	for _, p := range paths {
+		if p == "" || p == "." || p == ".." || strings.Contains(p, "\\") {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	var start uint32
+	if v := query.Get("start"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(seconds) || seconds < 0 || seconds > math.MaxUint32/1000 {
+			http.Error(w, "invalid start", http.StatusBadRequest)
+			return
+		}
+		start = uint32(seconds * 1000)
+	}
+	realtime := configure.Config.GetBool("httpflv_vod_realtime")
+	if v := query.Get("realtime"); v != "" {
+		var err error
+		if realtime, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid realtime", http.StatusBadRequest)
+			return
+		}
+	}
+
+	event := hook.NewHTTPEvent(hook.ProtocolHTTPFLV, path, r)
+	event.ClientID = uid.NewId()
+	if err := hook.OnPlay(event); err != nil {
+		log.Debugf("on_play %s err=%v", path, err)
+		http.Error(w, "play not allowed", http.StatusForbidden)
+		return
+	}
+	defer hook.OnPlayDone(event)
+
+	f, err := os.Open(filepath.Join(configure.Config.GetString("flv_dir"), paths[0], paths[1]+".flv"))
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	reader, err := flv.NewReader(f)
+	if err == nil {
+		err = reader.Seek(start)
+	}
+	if err != nil {
+		log.Warningf("vod %s: %v", f.Name(), err)
+		http.Error(w, "invalid flv file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "video/x-flv")
+	log.Debugf("vod %s from %dms, realtime=%v", f.Name(), start, realtime)
+	if err := sendVod(w, r, reader, realtime); err != nil {
+		log.Debugf("vod %s: %v", f.Name(), err)
+	}
+}
+
+// sendVod write the flv header, the onMetaData and the sequence headers
+// then the tags of reader from its position
+func sendVod(w http.ResponseWriter, r *http.Request, reader *flv.Reader, realtime bool) error {
+	if _, err := w.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		return err
+	}
+	buf := make([]byte, headerLen)
+	p, err := reader.ReadPacket()
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+
+	// the headers take the timestamp of the first frame, players reject
+	// timestamps going back
+	first := p.TimeStamp
+	if metadata := reader.Metadata(); metadata != nil {
+		if err := writeTag(w, buf, av.TAG_SCRIPTDATAAMF0, first, metadata); err != nil {
+			return err
+		}
+	}
+	for _, h := range reader.Headers() {
+		typeID := av.TAG_AUDIO
+		if h.IsVideo {
+			typeID = av.TAG_VIDEO
+		}
+		if err := writeTag(w, buf, typeID, first, h.Data); err != nil {
+			return err
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	begin := time.Now()
+	for {
+		if realtime && p.TimeStamp > first {
+			if wait := time.Duration(p.TimeStamp-first)*time.Millisecond - time.Since(begin); wait > 0 {
+				if flusher != nil {
+					flusher.Flush()
+				}
+				select {
+				case <-time.After(wait):
+				case <-r.Context().Done():
+					return r.Context().Err()
+				}
+			}
+		}
+
+		typeID := av.TAG_SCRIPTDATAAMF0
+		if p.IsVideo {
+			typeID = av.TAG_VIDEO
+		} else if p.IsAudio {
+			typeID = av.TAG_AUDIO
+		}
+		if err := writeTag(w, buf, typeID, p.TimeStamp, p.Data); err != nil {
+			return err
+		}
+
+		if p, err = reader.ReadPacket(); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func writeTag(w io.Writer, h []byte, typeID int, timestamp uint32, data []byte) error {
+	pio.PutU8(h[0:1], uint8(typeID))
+	pio.PutI24BE(h[1:4], int32(len(data)))
+	pio.PutI24BE(h[4:7], int32(timestamp&0xffffff))
+	pio.PutU8(h[7:8], uint8(timestamp>>24&0xff))
+	pio.PutI24BE(h[8:11], 0)
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	pio.PutI32BE(h[:4], int32(len(data)+headerLen))
+	_, err := w.Write(h[:4])
+	return err
+}
@@ -55,21 +55,27 @@ func (cache *Cache) Write(p av.Packet) {
 }
 
 func (cache *Cache) Send(w av.WriteCloser) error {
-	if err := cache.metadata.Send(w); err != nil {
+	if err := cache.SendHeaders(w); err != nil {
 		return err
 	}
 
-	if err := cache.videoSeq.Send(w); err != nil {
+	if err := cache.gop.Send(w); err != nil {
 		return err
 	}
 
-	if err := cache.audioSeq.Send(w); err != nil {
+	return nil
+}
+
+// SendHeaders send the metadata and the sequence headers but not the GOP,
+// for writers which start on the live stream
+func (cache *Cache) SendHeaders(w av.WriteCloser) error {
+	if err := cache.metadata.Send(w); err != nil {
 		return err
 	}
 
-	if err := cache.gop.Send(w); err != nil {
+	if err := cache.videoSeq.Send(w); err != nil {
 		return err
 	}
 
-	return nil
+	return cache.audioSeq.Send(w)
 }
@@ -21,6 +21,12 @@ var (
 	ErrReq = fmt.Errorf("req error")
 )
 
+const (
+	StatusPublishBadName      = "NetStream.Publish.BadName"
+	StatusPublishUnauthorized = "NetStream.Publish.Unauthorized"
+	StatusPlayFailed          = "NetStream.Play.Failed"
+)
+
 var (
 	cmdConnect       = "connect"
 	cmdFcpublish     = "FCPublish"
@@ -70,6 +76,8 @@ type ConnServer struct {
 	transactionID int
 	ConnInfo      ConnectInfo
 	PublishInfo   PublishInfo
+	replyCSID     uint32
+	replySID      uint32
 	decoder       *amf.Decoder
 	encoder       *amf.Encoder
 	bytesw        *bytes.Buffer
@@ -127,6 +135,12 @@ func (connServer *ConnServer) connect(vs []interface{}) error {
 			if tcurl, ok := obimap["tcUrl"]; ok {
 				connServer.ConnInfo.TcUrl = tcurl.(string)
 			}
+			if swfUrl, ok := obimap["swfUrl"].(string); ok {
+				connServer.ConnInfo.SwfUrl = swfUrl
+			}
+			if pageUrl, ok := obimap["pageUrl"].(string); ok {
+				connServer.ConnInfo.PageUrl = pageUrl
+			}
 			if encoding, ok := obimap["objectEncoding"]; ok {
 				connServer.ConnInfo.ObjectEncoding = int(encoding.(float64))
 			}
@@ -198,12 +212,38 @@ func (connServer *ConnServer) publishOrPlay(vs []interface{}) error {
 	return nil
 }
 
-func (connServer *ConnServer) publishResp(cur *ChunkStream) error {
+// PublishAccept answer the pending publish request with NetStream.Publish.Start
+func (connServer *ConnServer) PublishAccept() error {
 	event := make(amf.Object)
 	event["level"] = "status"
 	event["code"] = "NetStream.Publish.Start"
 	event["description"] = "Start publishing."
-	return connServer.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event)
+	return connServer.writeMsg(connServer.replyCSID, connServer.replySID, "onStatus", 0, nil, event)
+}
+
+// PublishReject answer the pending publish request with an error status such
+// as StatusPublishBadName, the caller is expected to close the connection
+func (connServer *ConnServer) PublishReject(code, description string) error {
+	return connServer.errorResp(code, description)
+}
+
+func (connServer *ConnServer) errorResp(code, description string) error {
+	event := make(amf.Object)
+	event["level"] = "error"
+	event["code"] = code
+	event["description"] = description
+	return connServer.writeMsg(connServer.replyCSID, connServer.replySID, "onStatus", 0, nil, event)
+}
+
+// PlayAccept answer the pending play request with NetStream.Play.Start
+func (connServer *ConnServer) PlayAccept() error {
+	return connServer.playResp(&ChunkStream{CSID: connServer.replyCSID, StreamID: connServer.replySID})
+}
+
+// PlayReject answer the pending play request with an error status such as
+// StatusPlayFailed, the caller is expected to close the connection
+func (connServer *ConnServer) PlayReject(code, description string) error {
+	return connServer.errorResp(code, description)
 }
 
 func (connServer *ConnServer) playResp(cur *ChunkStream) error {
@@ -273,9 +313,10 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			if err = connServer.publishOrPlay(vs[1:]); err != nil {
 				return err
 			}
-			if err = connServer.publishResp(c); err != nil {
-				return err
-			}
+			// the reply is sent by PublishAccept or PublishReject once
+			// the publisher has been authorized
+			connServer.replyCSID = c.CSID
+			connServer.replySID = c.StreamID
 			connServer.done = true
 			connServer.isPublisher = true
 			log.Debug("handle publish req done")
@@ -283,9 +324,9 @@ func (connServer *ConnServer) handleCmdMsg(c *ChunkStream) error {
 			if err = connServer.publishOrPlay(vs[1:]); err != nil {
 				return err
 			}
-			if err = connServer.playResp(c); err != nil {
-				return err
-			}
+			// the reply is sent by PlayAccept or PlayReject
+			connServer.replyCSID = c.CSID
+			connServer.replySID = c.StreamID
 			connServer.done = true
 			connServer.isPublisher = false
 			log.Debug("handle play req done")
@@ -0,0 +1,221 @@
+package rtmp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gwuhaolin/livego/av"
+	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/mp4"
+	"github.com/gwuhaolin/livego/container/ts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoPublisher       = fmt.Errorf("stream is not published")
+	ErrRecordingFormat   = fmt.Errorf("recording format must be flv, mp4 or ts")
+	ErrRecordingExists   = fmt.Errorf("stream is already recorded")
+	ErrNoRecording       = fmt.Errorf("stream is not recorded")
+	ErrRecordingCreate   = fmt.Errorf("recording file cannot be created")
+	ErrRecordingDuration = fmt.Errorf("recording max duration must be between 0 and %v", MaxRecordingDuration)
+	errRecordingFinished = fmt.Errorf("recording finished")
+)
+
+// MaxRecordingDuration bound the max duration of a recording, the stream
+// timestamps are 32 bits milliseconds
+const MaxRecordingDuration = 24 * time.Hour
+
+// recorders of the formats a recording can be made in
+var recorders = map[string]av.GetWriter{
+	"flv": new(flv.FlvDvr),
+	"mp4": new(mp4.Mp4Dvr),
+	"ts":  new(ts.TsDvr),
+}
+
+// RecordingStat is a recording started by StartRecording
+type RecordingStat struct {
+	Key         string    `json:"key"`
+	Format      string    `json:"format"`
+	Path        string    `json:"path"`
+	CreatedAt   time.Time `json:"created_at"`
+	Started     bool      `json:"started"`
+	Duration    float64   `json:"duration"`
+	MaxDuration float64   `json:"max_duration,omitempty"`
+	Stopping    bool      `json:"stopping"`
+}
+
+// Recording attach a recorder to a live stream, the recorder receives the
+// stream from its next key frame and stops on the key frame following a
+// stop request or the maximum duration
+type Recording struct {
+	av.WriteCloser
+	lock        sync.Mutex
+	stat        RecordingStat
+	maxDuration uint32
+	hasVideo    bool
+	start       uint32
+	closed      bool
+	onClose     func()
+}
+
+func (r *Recording) Stat() RecordingStat {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stat
+}
+
+func (r *Recording) Write(p *av.Packet) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return errRecordingFinished
+	}
+
+	header := p.IsMetadata
+	randomAccess := false
+	if p.IsVideo {
+		if vh, ok := p.Header.(av.VideoPacketHeader); ok {
+			header = vh.IsSeq()
+			randomAccess = vh.IsKeyFrame() && !header
+			r.hasVideo = r.hasVideo || header
+		}
+	} else if p.IsAudio {
+		if ah, ok := p.Header.(av.AudioPacketHeader); ok {
+			header = ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+		}
+		randomAccess = !header && !r.hasVideo
+	}
+
+	if !r.stat.Started {
+		if !header && !randomAccess {
+			return nil
+		}
+		if randomAccess {
+			r.stat.Started = true
+			r.start = p.TimeStamp
+		}
+	} else if !header {
+		if p.TimeStamp > r.start {
+			r.stat.Duration = float64(p.TimeStamp-r.start) / 1000
+		}
+		if randomAccess && (r.stat.Stopping || (r.maxDuration > 0 && p.TimeStamp-r.start >= r.maxDuration)) {
+			r.close(nil)
+			return errRecordingFinished
+		}
+	}
+	return r.WriteCloser.Write(p)
+}
+
+func (r *Recording) Close(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.close(err)
+}
+
+func (r *Recording) close(err error) {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	// a recording is listed while its file is created, before it has a writer
+	if r.WriteCloser != nil {
+		r.WriteCloser.Close(err)
+	}
+	log.Infof("recording of %s stopped: %s", r.stat.Key, r.stat.Path)
+	if r.onClose != nil {
+		r.onClose()
+	}
+}
+
+// StartRecording record the live stream key in format, flv, mp4 or ts, for
+// maxDuration or until StopRecording when it is zero
+func (rs *RtmpStream) StartRecording(key, format string, maxDuration time.Duration) (RecordingStat, error) {
+	getter, ok := recorders[format]
+	if !ok {
+		return RecordingStat{}, ErrRecordingFormat
+	}
+	if maxDuration < 0 || maxDuration > MaxRecordingDuration {
+		return RecordingStat{}, ErrRecordingDuration
+	}
+	v, ok := rs.streams.Load(key)
+	if !ok || v.(*Stream).GetReader() == nil || !v.(*Stream).isStart {
+		return RecordingStat{}, ErrNoPublisher
+	}
+	s := v.(*Stream)
+
+	r := &Recording{
+		stat: RecordingStat{
+			Key:         key,
+			Format:      format,
+			CreatedAt:   time.Now(),
+			MaxDuration: maxDuration.Seconds(),
+		},
+		maxDuration: uint32(maxDuration / time.Millisecond),
+	}
+	r.onClose = func() {
+		if v, ok := rs.recordings.Load(key); ok && v == r {
+			rs.recordings.Delete(key)
+		}
+	}
+	if _, loaded := rs.recordings.LoadOrStore(key, r); loaded {
+		return RecordingStat{}, ErrRecordingExists
+	}
+	w := getter.GetWriter(s.GetReader().Info())
+	if w == nil {
+		r.Close(nil)
+		return RecordingStat{}, ErrRecordingCreate
+	}
+	r.lock.Lock()
+	if r.closed {
+		// stopped while its file was created
+		r.lock.Unlock()
+		w.Close(nil)
+		return RecordingStat{}, ErrNoRecording
+	}
+	if named, ok := w.(interface{ Name() string }); ok {
+		r.stat.Path = named.Name()
+	}
+	r.WriteCloser = w
+	r.lock.Unlock()
+	s.addLiveWriter(r)
+	log.Infof("recording of %s started: %s", key, r.stat.Path)
+	return r.Stat(), nil
+}
+
+// StopRecording stop the recording of the stream key at its next key frame,
+// or at once when the stream is no longer published
+func (rs *RtmpStream) StopRecording(key string) (RecordingStat, error) {
+	v, ok := rs.recordings.Load(key)
+	if !ok {
+		return RecordingStat{}, ErrNoRecording
+	}
+	r := v.(*Recording)
+	s, ok := rs.streams.Load(key)
+	r.lock.Lock()
+	r.stat.Stopping = true
+	if !ok || !s.(*Stream).isStart || !r.stat.Started {
+		r.close(nil)
+	}
+	stat := r.stat
+	r.lock.Unlock()
+	return stat, nil
+}
+
+// Recordings return the recordings of the stream key, or of every stream
+// when key is empty
+func (rs *RtmpStream) Recordings(key string) []RecordingStat {
+	var stats []RecordingStat
+	rs.recordings.Range(func(k, v interface{}) bool {
+		if key == "" || k.(string) == key {
+			stats = append(stats, v.(*Recording).Stat())
+		}
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gwuhaolin/livego/utils/uid"
@@ -13,6 +14,8 @@ import (
 	"github.com/gwuhaolin/livego/av"
 	"github.com/gwuhaolin/livego/configure"
 	"github.com/gwuhaolin/livego/container/flv"
+	"github.com/gwuhaolin/livego/container/mp4"
+	"github.com/gwuhaolin/livego/protocol/hook"
 	"github.com/gwuhaolin/livego/protocol/rtmp/core"
 
 	log "github.com/sirupsen/logrus"
@@ -67,14 +70,19 @@ func (c *Client) GetHandle() av.Handler {
 
 type Server struct {
 	handler av.Handler
-	getter  av.GetWriter
+	getters []av.GetWriter
 }
 
-func NewRtmpServer(h av.Handler, getter av.GetWriter) *Server {
-	return &Server{
+func NewRtmpServer(h av.Handler, getters ...av.GetWriter) *Server {
+	s := &Server{
 		handler: h,
-		getter:  getter,
 	}
+	for _, getter := range getters {
+		if getter != nil {
+			s.getters = append(s.getters, getter)
+		}
+	}
+	return s
 }
 
 func (s *Server) Serve(listener net.Listener) (err error) {
@@ -111,7 +119,7 @@ func (s *Server) handleConn(conn *core.Conn) error {
 		return err
 	}
 
-	appname, name, _ := connServer.GetInfo()
+	appname, _, _ := connServer.GetInfo()
 
 	if ret := configure.CheckAppName(appname); !ret {
 		err := fmt.Errorf("application name=%s is not configured", appname)
@@ -122,21 +130,16 @@ func (s *Server) handleConn(conn *core.Conn) error {
 
 	log.Debugf("handleConn: IsPublisher=%v", connServer.IsPublisher())
 	if connServer.IsPublisher() {
-		if configure.Config.GetBool("rtmp_noauth") {
-			key, err := configure.RoomKeys.GetKey(name)
-			if err != nil {
-				err := fmt.Errorf("Cannot create key err=%s", err.Error())
-				conn.Close()
-				log.Error("GetKey err: ", err)
-				return err
-			}
-			name = key
-		}
-		channel, err := configure.RoomKeys.GetChannel(name)
+		channel, code, err := s.authPublisher(conn, connServer)
 		if err != nil {
-			err := fmt.Errorf("invalid key err=%s", err.Error())
+			connServer.PublishReject(code, err.Error())
 			conn.Close()
-			log.Error("CheckKey err: ", err)
+			log.Error("authPublisher err: ", err)
+			return err
+		}
+		if err := connServer.PublishAccept(); err != nil {
+			conn.Close()
+			log.Error("PublishAccept err: ", err)
 			return err
 		}
 		connServer.PublishInfo.Name = channel
@@ -147,18 +150,48 @@ func (s *Server) handleConn(conn *core.Conn) error {
 		s.handler.HandleReader(reader)
 		log.Debugf("new publisher: %+v", reader.Info())
 
-		if s.getter != nil {
-			writeType := reflect.TypeOf(s.getter)
+		for _, getter := range s.getters {
+			writeType := reflect.TypeOf(getter)
 			log.Debugf("handleConn:writeType=%v", writeType)
-			writer := s.getter.GetWriter(reader.Info())
+			writer := getter.GetWriter(reader.Info())
 			s.handler.HandleWriter(writer)
 		}
-		if configure.Config.GetBool("flv_archive") {
+		// the archives which could not be created are skipped, their
+		// GetWriter logged why
+		if configure.IsFLVArchive(appname) {
 			flvWriter := new(flv.FlvDvr)
-			s.handler.HandleWriter(flvWriter.GetWriter(reader.Info()))
+			if writer := flvWriter.GetWriter(reader.Info()); writer != nil {
+				s.handler.HandleWriter(writer)
+			}
+		}
+		if configure.IsMP4Archive(appname) {
+			mp4Writer := new(mp4.Mp4Dvr)
+			if writer := mp4Writer.GetWriter(reader.Info()); writer != nil {
+				s.handler.HandleWriter(writer)
+			}
 		}
 	} else {
+		event := newHookEvent(conn, connServer)
+		event.Protocol = hook.ProtocolRTMP
+		event.Key = appname + "/" + event.Name
+		event.ClientID = uid.NewId()
+		if err := hook.OnPlay(event); err != nil {
+			err = fmt.Errorf("on_play %s err=%s", event.Key, err.Error())
+			connServer.PlayReject(core.StatusPlayFailed, err.Error())
+			conn.Close()
+			log.Error("OnPlay err: ", err)
+			return err
+		}
+		if err := connServer.PlayAccept(); err != nil {
+			conn.Close()
+			log.Error("PlayAccept err: ", err)
+			return err
+		}
 		writer := NewVirWriter(connServer)
+		writer.Uid = event.ClientID
+		writer.onClose = func() {
+			hook.OnPlayDone(event)
+		}
 		log.Debugf("new player: %+v", writer.Info())
 		s.handler.HandleWriter(writer)
 	}
@@ -166,6 +199,86 @@ func (s *Server) handleConn(conn *core.Conn) error {
 	return nil
 }
 
+// authPublisher resolve the channel of a publisher, either through the
+// application's on_publish hook or through the room keys. On failure the
+// onStatus code to reply with is returned along with the error.
+func (s *Server) authPublisher(conn *core.Conn, connServer *core.ConnServer) (string, string, error) {
+	channel, code, err := s.resolvePublisher(conn, connServer)
+	if err != nil {
+		return "", code, err
+	}
+	// the channel names the files of the stream on disk
+	if !hook.ValidName(channel) {
+		return "", core.StatusPublishBadName, fmt.Errorf("invalid stream name %q", channel)
+	}
+	return channel, "", nil
+}
+
+func (s *Server) resolvePublisher(conn *core.Conn, connServer *core.ConnServer) (string, string, error) {
+	appname, name, _ := connServer.GetInfo()
+
+	if hookURL, ok := configure.GetOnPublishURL(appname); ok {
+		event := newHookEvent(conn, connServer)
+		channel, err := hook.OnPublish(hookURL, event)
+		if err != nil {
+			code := core.StatusPublishBadName
+			if err == hook.ErrUnauthorized {
+				code = core.StatusPublishUnauthorized
+			}
+			return "", code, fmt.Errorf("on_publish %s/%s err=%s", appname, event.Name, err.Error())
+		}
+		return channel, "", nil
+	}
+
+	if configure.Config.GetBool("rtmp_noauth") {
+		if !hook.ValidName(name) {
+			return "", core.StatusPublishBadName, fmt.Errorf("invalid stream name %q", name)
+		}
+		key, err := configure.RoomKeys.GetKey(name)
+		if err != nil {
+			return "", core.StatusPublishBadName, fmt.Errorf("Cannot create key err=%s", err.Error())
+		}
+		name = key
+	}
+	channel, err := configure.RoomKeys.GetChannel(name)
+	if err != nil {
+		return "", core.StatusPublishBadName, fmt.Errorf("invalid key err=%s", err.Error())
+	}
+	return channel, "", nil
+}
+
+func newHookEvent(conn *core.Conn, connServer *core.ConnServer) *hook.Event {
+	appname, name, _ := connServer.GetInfo()
+	event := &hook.Event{
+		App:      appname,
+		Name:     name,
+		TcUrl:    connServer.ConnInfo.TcUrl,
+		Query:    make(map[string]string),
+		FlashVer: connServer.ConnInfo.Flashver,
+		SwfUrl:   connServer.ConnInfo.SwfUrl,
+		PageUrl:  connServer.ConnInfo.PageUrl,
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		event.Addr = host
+	}
+
+	if u, err := url.Parse(connServer.ConnInfo.TcUrl); err == nil {
+		for k, v := range u.Query() {
+			event.Query[k] = v[0]
+		}
+	}
+	// publishers often put the token behind the stream name, e.g. key?token=xxx
+	if index := strings.Index(name, "?"); index >= 0 {
+		event.Name = name[:index]
+		if values, err := url.ParseQuery(name[index+1:]); err == nil {
+			for k, v := range values {
+				event.Query[k] = v[0]
+			}
+		}
+	}
+	return event
+}
+
 type GetInFo interface {
 	GetInfo() (string, string, string)
 }
@@ -197,6 +310,8 @@ type VirWriter struct {
 	conn        StreamReadWriteCloser
 	packetQueue chan *av.Packet
 	WriteBWInfo StaticsBW
+	onClose     func()
+	closeOnce   sync.Once
 }
 
 func NewVirWriter(conn StreamReadWriteCloser) *VirWriter {
@@ -363,6 +478,9 @@ func (v *VirWriter) Close(err error) {
 	}
 	v.closed = true
 	v.conn.Close(err)
+	if v.onClose != nil {
+		v.closeOnce.Do(v.onClose)
+	}
 }
 
 type VirReader struct {
@@ -18,12 +18,14 @@ var (
 )
 
 type RtmpStream struct {
-	streams *sync.Map //key
+	streams    *sync.Map //key
+	recordings *sync.Map //key
 }
 
 func NewRtmpStream() *RtmpStream {
 	ret := &RtmpStream{
-		streams: &sync.Map{},
+		streams:    &sync.Map{},
+		recordings: &sync.Map{},
 	}
 	go ret.CheckAlive()
 	return ret
@@ -97,7 +99,9 @@ type Stream struct {
 
 type PackWriterCloser struct {
 	init bool
-	w    av.WriteCloser
+	// the writer skips the cached GOP and starts on the live stream
+	headersOnly bool
+	w           av.WriteCloser
 }
 
 func (p *PackWriterCloser) GetWriter() av.WriteCloser {
@@ -148,6 +152,14 @@ func (s *Stream) AddWriter(w av.WriteCloser) {
 	s.ws.Store(info.UID, pw)
 }
 
+// addLiveWriter add a writer which receives the headers of the stream then
+// the live packets, without the cached GOP
+func (s *Stream) addLiveWriter(w av.WriteCloser) {
+	info := w.Info()
+	pw := &PackWriterCloser{w: w, headersOnly: true}
+	s.ws.Store(info.UID, pw)
+}
+
 /*检测本application下是否配置static_push,
 如果配置, 启动push远端的连接*/
 func (s *Stream) StartStaticPush() {
@@ -336,7 +348,11 @@ func (s *Stream) TransStart() {
 			v := val.(*PackWriterCloser)
 			if !v.init {
 				//log.Debugf("cache.send: %v", v.w.Info())
-				if err = s.cache.Send(v.w); err != nil {
+				send := s.cache.Send
+				if v.headersOnly {
+					send = s.cache.SendHeaders
+				}
+				if err = send(v.w); err != nil {
 					log.Debugf("[%s] send cache packet error: %v, remove", v.w.Info(), err)
 					s.ws.Delete(key)
 					return true